@@ -11,6 +11,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/operable/go-relay/relay"
+	"github.com/operable/go-relay/relay/audit"
 	"github.com/operable/go-relay/relay/config"
 )
 
@@ -18,12 +19,14 @@ const (
 	BAD_CONFIG = iota + 1
 	DOCKER_ERR
 	BUS_ERR
+	AUDIT_ERR
 )
 
 var configFile = flag.String("file", "", "Path to configuration file")
 var cpuprofile = flag.String("cpuprofile", "", "Write CPU profile to file")
 var memprofile = flag.String("memprofile", "", "Write memory profile to this file")
 var devMode    = flag.Bool("dev", false, "Enable developer mode")
+var adminListen = flag.String("admin", "", "Serve the HTTP admin API on this address (overrides admin_listen)")
 
 // Populated by build script
 var buildstamp string
@@ -58,6 +61,22 @@ func displayVersionInfo() {
 	}
 }
 
+// verifyAudit implements the verify-audit subcommand, which checks
+// the hash chain of an execution audit log
+func verifyAudit(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: relay verify-audit <audit log path>")
+		return BAD_CONFIG
+	}
+	count, err := audit.Verify(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log verification FAILED after %d records: %s\n", count, err)
+		return AUDIT_ERR
+	}
+	fmt.Printf("Verified %d audit records.\n", count)
+	return 0
+}
+
 func configureLogger(config *config.Config) {
 	if config.LogJSON == true {
 		log.SetFormatter(&log.JSONFormatter{})
@@ -141,11 +160,17 @@ func prepare() *config.Config {
 		return nil
 	}
 	relayConfig.DevMode = *devMode
+	if *adminListen != "" {
+		relayConfig.AdminListen = *adminListen
+	}
 	configureLogger(relayConfig)
 	return relayConfig
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit(os.Args[2:]))
+	}
 	relayConfig := prepare()
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -187,7 +212,7 @@ func main() {
 	log.Infof("Relay %s online.", relayConfig.ID)
 	// Set up signal handlers
 	interruptChannel := make(chan os.Signal, 1)
-	signal.Notify(interruptChannel, syscall.SIGINT)
+	signal.Notify(interruptChannel, syscall.SIGINT, syscall.SIGTERM)
 
 	// Handle HUP signals by reopening logfiles
 	hupChannel := make(chan os.Signal, 1)
@@ -199,14 +224,24 @@ func main() {
 		}
 	}()
 
-	// Wait until we get an interrupt signal
-	<-interruptChannel
+	// Wait until we get an interrupt or termination signal, or lose
+	// the message bus for good
+	exitCode := 0
+	select {
+	case <-interruptChannel:
+	case err := <-myRelay.Failed():
+		log.Errorf("Relay %s can't reach Cog: %s", relayConfig.ID, err)
+		exitCode = BUS_ERR
+	}
 
 	// Shutdown
-	// Remove signal handler so Ctrl-C works
-	signal.Reset(syscall.SIGINT)
+	// Remove signal handlers so a second Ctrl-C skips draining
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
 
 	log.Info("Starting shut down.")
 	myRelay.Stop()
 	log.Infof("Relay %s shut down complete.", relayConfig.ID)
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 }
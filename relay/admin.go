@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/bus"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/metrics"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// adminServer serves Relay's optional HTTP admin and health API
+type adminServer struct {
+	relay    *cogRelay
+	listener net.Listener
+}
+
+type readiness struct {
+	Ready        bool              `json:"ready"`
+	BusConnected bool              `json:"bus_connected"`
+	BusEndpoint  string            `json:"bus_endpoint,omitempty"`
+	BusOutage    string            `json:"bus_outage,omitempty"`
+	BusBackoff   *bus.BackoffState `json:"bus_backoff,omitempty"`
+	CatalogAcked bool              `json:"catalog_acked"`
+	DockerReady  bool              `json:"docker_ready"`
+	Draining     bool              `json:"draining"`
+}
+
+type catalogEntry struct {
+	Name      string              `json:"name"`
+	Version   string              `json:"version"`
+	Available bool                `json:"available"`
+	Docker    *config.DockerImage `json:"docker,omitempty"`
+	Commands  []string            `json:"commands"`
+}
+
+func newAdminServer(relay *cogRelay) *adminServer {
+	return &adminServer{
+		relay: relay,
+	}
+}
+
+// Run starts listening on the configured address and serves
+// requests in a goroutine
+func (as *adminServer) Run() error {
+	listener, err := net.Listen("tcp", as.relay.config.AdminListen)
+	if err != nil {
+		return err
+	}
+	as.listener = listener
+	go func() {
+		http.Serve(listener, as.handler())
+	}()
+	log.Infof("Admin API listening on %s.", listener.Addr())
+	return nil
+}
+
+// Halt stops accepting admin requests
+func (as *adminServer) Halt() {
+	if as.listener != nil {
+		as.listener.Close()
+	}
+}
+
+func (as *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", as.get(as.healthz))
+	mux.HandleFunc("/readyz", as.get(as.readyz))
+	mux.HandleFunc("/catalog", as.get(as.catalog))
+	mux.HandleFunc("/executions", as.get(as.executions))
+	mux.HandleFunc("/envcache", as.get(as.envCache))
+	mux.HandleFunc("/config", as.get(as.config))
+	mux.HandleFunc("/metrics", as.get(metrics.Handler()))
+	return mux
+}
+
+func (as *adminServer) get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func (as *adminServer) healthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (as *adminServer) readyz(w http.ResponseWriter, req *http.Request) {
+	r := as.relay
+	state := readiness{
+		BusConnected: r.conn != nil && r.conn.IsConnected(),
+		CatalogAcked: r.catalog.Acked(),
+		DockerReady:  r.config.DockerEnabled() == false || r.dockerEngine != nil,
+		Draining:     r.queue.Draining(),
+	}
+	if outage := r.outage(); outage != nil {
+		state.BusConnected = false
+		state.BusOutage = outage.Error()
+	}
+	conn := r.conn
+	if r.manager != nil {
+		conn = r.manager.Conn()
+	}
+	if reporter, ok := conn.(bus.ActiveEndpointReporter); ok {
+		state.BusEndpoint = reporter.ActiveEndpoint()
+	}
+	if reporter, ok := conn.(bus.BackoffReporter); ok {
+		backoff := reporter.BackoffState()
+		state.BusBackoff = &backoff
+	}
+	state.Ready = state.BusConnected && state.CatalogAcked && state.DockerReady && !state.Draining
+	status := http.StatusOK
+	if state.Ready == false {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, state)
+}
+
+func (as *adminServer) catalog(w http.ResponseWriter, req *http.Request) {
+	entries := []catalogEntry{}
+	for _, bundle := range as.relay.catalog.Bundles() {
+		entry := catalogEntry{
+			Name:      bundle.Name,
+			Version:   bundle.Version,
+			Available: bundle.IsAvailable(),
+			Docker:    bundle.Docker,
+			Commands:  []string{},
+		}
+		for name := range bundle.Commands {
+			entry.Commands = append(entry.Commands, name)
+		}
+		sort.Strings(entry.Commands)
+		entries = append(entries, entry)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (as *adminServer) executions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, as.relay.registry.Snapshot())
+}
+
+func (as *adminServer) envCache(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, as.relay.engines.CachedEnvironments())
+}
+
+func (as *adminServer) config(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, as.relay.config.Redacted())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		log.Errorf("Encoding admin API response failed: %s.", err)
+		status = http.StatusInternalServerError
+		data = []byte(`{"error": "internal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
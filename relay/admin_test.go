@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/operable/go-relay/relay/bundle"
+	"github.com/operable/go-relay/relay/bus"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/engines"
+	"github.com/operable/go-relay/relay/worker"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type stubConnection struct {
+	connected bool
+}
+
+func (sc *stubConnection) Connect(options bus.ConnectionOptions) error                   { return nil }
+func (sc *stubConnection) Disconnect() error                                             { return nil }
+func (sc *stubConnection) Publish(topic string, payload []byte) error                    { return nil }
+func (sc *stubConnection) Subscribe(topic string, handler bus.SubscriptionHandler) error { return nil }
+func (sc *stubConnection) Unsubscribe(topic string) error                                { return nil }
+func (sc *stubConnection) IsConnected() bool                                             { return sc.connected }
+
+func newAdminTestRelay() *cogRelay {
+	relayConfig := &config.Config{
+		ParsedEnginesEnabled: []string{config.NativeEngine},
+		Cog:                  &config.CogInfo{Token: "sekrit"},
+		Execution:            &config.ExecutionInfo{},
+	}
+	return &cogRelay{
+		config:   relayConfig,
+		conn:     &stubConnection{connected: true},
+		catalog:  bundle.NewCatalog(),
+		engines:  engines.NewEngines(relayConfig),
+		queue:    worker.NewScheduler(1, 0, worker.ConfiguredPolicy),
+		registry: worker.NewRegistry(),
+	}
+}
+
+func adminGet(t *testing.T, r *cogRelay, path string) (int, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", path, nil)
+	newAdminServer(r).handler().ServeHTTP(recorder, request)
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, body
+}
+
+func TestAdminReadiness(t *testing.T) {
+	r := newAdminTestRelay()
+	if status, body := adminGet(t, r, "/readyz"); status != http.StatusServiceUnavailable || body["catalog_acked"] != false {
+		t.Errorf("Expected relay without acked announcement to be unready: %d %v", status, body)
+	}
+	r.catalog.EpochAcked(0)
+	if status, body := adminGet(t, r, "/readyz"); status != http.StatusOK {
+		t.Errorf("Expected relay to be ready: %d %v", status, body)
+	}
+	r.queue.Drain()
+	if status, _ := adminGet(t, r, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected draining relay to be unready: %d", status)
+	}
+}
+
+func TestAdminReadinessDuringOutage(t *testing.T) {
+	r := newAdminTestRelay()
+	r.catalog.EpochAcked(0)
+	r.handleBusEvents(r.conn, bus.DisconnectedEvent, bus.EventInfo{Cause: errors.New("connection reset")})
+	status, body := adminGet(t, r, "/readyz")
+	if status != http.StatusServiceUnavailable || body["bus_connected"] != false || body["bus_outage"] != "connection reset" {
+		t.Errorf("Expected relay to be unready while the bus is down: %d %v", status, body)
+	}
+	r.busRestored()
+	if status, body := adminGet(t, r, "/readyz"); status != http.StatusOK {
+		t.Errorf("Expected relay to be ready once the bus is restored: %d %v", status, body)
+	}
+}
+
+func TestAdminConfigRedacted(t *testing.T) {
+	_, body := adminGet(t, newAdminTestRelay(), "/config")
+	cog := body["cog"].(map[string]interface{})
+	if cog["token"] == "sekrit" {
+		t.Error("Expected cog/token to be redacted")
+	}
+}
@@ -18,6 +18,7 @@ import (
 type Announcer interface {
 	SendAnnouncement()
 	SetSubscriptions() error
+	Pause()
 	Run() error
 	Halt()
 }
@@ -49,8 +50,10 @@ type relayAnnouncer struct {
 	stateLock           sync.Mutex
 	control             chan relayAnnouncerCommand
 	receiptFor          string
+	sentAt              time.Time
 	announceTimer       *time.Timer
 	announcementPending bool
+	paused              bool
 }
 
 // NewAnnouncer creates a new Announcer
@@ -80,10 +83,27 @@ func (ra *relayAnnouncer) Run() error {
 	return nil
 }
 
+// Halt stops the announcer and disconnects it from the bus
 func (ra *relayAnnouncer) Halt() {
 	ra.control <- relayAnnouncerStopCommand
 }
 
+// Pause stops announcing, including retries, until the next
+// SendAnnouncement. Used while the bus is down, when receipts can't
+// arrive.
+func (ra *relayAnnouncer) Pause() {
+	ra.stateLock.Lock()
+	defer ra.stateLock.Unlock()
+	ra.paused = true
+	ra.announcementPending = false
+	if ra.announceTimer != nil {
+		ra.announceTimer.Stop()
+	}
+	if ra.state == relayAnnouncerReceiptWaitingState {
+		ra.state = relayAnnouncerWaitingState
+	}
+}
+
 func (ra *relayAnnouncer) SendAnnouncement() {
 	ra.control <- relayAnnouncerAnnounceCommand
 	log.Debug("Called relayAnnouncer.SendAnnouncement()")
@@ -110,6 +130,7 @@ func (ra *relayAnnouncer) cogReceipt(conn bus.Connection, topic string, payload
 	} else {
 		epoch, _ := strconv.ParseUint(ra.receiptFor, 10, 64)
 		ra.catalog.EpochAcked(epoch)
+		announcementSeconds.Observe(time.Now().Sub(ra.sentAt).Seconds())
 		ra.receiptFor = ""
 		if receipt.Status != "success" {
 			log.Warnf("Cog returned unsuccessful status for bundle announcement %s: %s.", receipt.ID, receipt.Status)
@@ -124,28 +145,43 @@ func (ra *relayAnnouncer) cogReceipt(conn bus.Connection, topic string, payload
 }
 
 func (ra *relayAnnouncer) loop() {
-	for ra.state != relayAnnouncerStoppedState {
+	for {
 		switch <-ra.control {
 		case relayAnnouncerStopCommand:
+			ra.stateLock.Lock()
 			ra.state = relayAnnouncerStoppedState
-			ra.announceTimer.Stop()
+			if ra.announceTimer != nil {
+				ra.announceTimer.Stop()
+			}
+			ra.stateLock.Unlock()
+			ra.conn.Disconnect()
+			return
 		case relayAnnouncerAnnounceCommand:
 			ra.stateLock.Lock()
+			ra.paused = false
 			if ra.state == relayAnnouncerReceiptWaitingState {
 				ra.announcementPending = true
 				ra.stateLock.Unlock()
 			} else {
+				// Arm the retry timer before sending so a fast receipt
+				// always has a timer to stop
+				if ra.announceTimer == nil {
+					ra.announceTimer = time.AfterFunc(reannounceInterval2, ra.retryAnnouncement)
+				} else {
+					ra.announceTimer.Reset(reannounceInterval2)
+				}
 				ra.stateLock.Unlock()
 				ra.sendAnnouncement(true)
-				ra.announceTimer = time.AfterFunc(reannounceInterval2, func() {
-					log.Debugf("Retrying announcement %s.", ra.receiptFor)
-					ra.sendAnnouncement(false)
-				})
 			}
 		}
 	}
 }
 
+func (ra *relayAnnouncer) retryAnnouncement() {
+	log.Debug("Retrying bundle announcement.")
+	ra.sendAnnouncement(false)
+}
+
 func (ra *relayAnnouncer) sendAnnouncement(skipTimer bool) {
 	ra.stateLock.Lock()
 	defer ra.stateLock.Unlock()
@@ -154,6 +190,10 @@ func (ra *relayAnnouncer) sendAnnouncement(skipTimer bool) {
 	announcement := messages.NewBundleAnnouncementExtended(ra.id, getBundles(ra.catalog), ra.receiptTopic, announcementID)
 	raw, _ := json.Marshal(announcement)
 	for {
+		if ra.paused {
+			log.Debug("Bundle announcements paused")
+			return
+		}
 		log.Debug("Publishing bundle announcement to bot/relays/discover")
 		if err := ra.conn.Publish("bot/relays/discover", raw); err != nil {
 			ra.stateLock.Unlock()
@@ -166,6 +206,9 @@ func (ra *relayAnnouncer) sendAnnouncement(skipTimer bool) {
 			break
 		}
 	}
+	if ra.receiptFor != announcementID {
+		ra.sentAt = time.Now()
+	}
 	ra.receiptFor = announcementID
 	ra.state = relayAnnouncerReceiptWaitingState
 	if skipTimer == false {
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, maxSize int64) (*Logger, string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := path.Join(dir, "audit.jsonl")
+	logger, err := NewLogger(logPath, maxSize, 3, []string{"password", "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger, logPath
+}
+
+func testRecord(invocationID string) *Record {
+	return &Record{
+		Timestamp:    time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC),
+		RelayID:      "relay-1",
+		InvocationID: invocationID,
+		Bundle:       "ec2",
+		Command:      "instance-list",
+		Args:         []interface{}{"region=us-east-1", "token=abc123"},
+		Options:      map[string]interface{}{"db_password": "hunter2", "verbose": true},
+		Status:       "ok",
+	}
+}
+
+func TestChainAndVerify(t *testing.T) {
+	logger, logPath := newTestLogger(t, 1024*1024)
+	defer os.RemoveAll(path.Dir(logPath))
+	for _, id := range []string{"i1", "i2", "i3"} {
+		if err := logger.Write(testRecord(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Close()
+	if count, err := Verify(logPath); err != nil || count != 3 {
+		t.Errorf("Expected 3 verified records: %d %v", count, err)
+	}
+	data, _ := ioutil.ReadFile(logPath)
+	if bytes.Contains(data, []byte("hunter2")) || bytes.Contains(data, []byte("abc123")) {
+		t.Error("Expected secrets to be redacted")
+	}
+	if bytes.Contains(data, []byte("region=us-east-1")) == false {
+		t.Error("Expected unredacted args to be kept")
+	}
+	// Reopening continues the chain
+	logger, _ = NewLogger(logPath, 1024*1024, 3, nil)
+	logger.Write(testRecord("i4"))
+	logger.Close()
+	if count, err := Verify(logPath); err != nil || count != 4 {
+		t.Errorf("Expected 4 verified records: %d %v", count, err)
+	}
+}
+
+func TestTamperDetected(t *testing.T) {
+	logger, logPath := newTestLogger(t, 1024*1024)
+	defer os.RemoveAll(path.Dir(logPath))
+	for _, id := range []string{"i1", "i2", "i3"} {
+		logger.Write(testRecord(id))
+	}
+	logger.Close()
+	data, _ := ioutil.ReadFile(logPath)
+	lines := strings.Split(string(data), "\n")
+	edited := strings.Replace(string(data), `"status":"ok"`, `"status":"error"`, 1)
+	ioutil.WriteFile(logPath, []byte(edited), 0600)
+	if _, err := Verify(logPath); err == nil || strings.Contains(err.Error(), ":1:") == false {
+		t.Errorf("Expected modified first record to fail verification: %v", err)
+	}
+	removed := lines[0] + "\n" + lines[2] + "\n"
+	ioutil.WriteFile(logPath, []byte(removed), 0600)
+	if _, err := Verify(logPath); err == nil || strings.Contains(err.Error(), "Chain broken") == false {
+		t.Errorf("Expected removed record to break the chain: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	logger, logPath := newTestLogger(t, 600)
+	defer os.RemoveAll(path.Dir(logPath))
+	for _, id := range []string{"i1", "i2", "i3", "i4"} {
+		if err := logger.Write(testRecord(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Close()
+	if _, err := os.Stat(logPath + ".1"); err != nil {
+		t.Fatalf("Expected audit log to rotate: %s", err)
+	}
+	if count, err := Verify(logPath); err != nil || count != 4 {
+		t.Errorf("Expected chain to span rotated files: %d %v", count, err)
+	}
+}
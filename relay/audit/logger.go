@@ -0,0 +1,146 @@
+package audit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Logger appends hash-chained records to an audit file, rotating it
+// once it grows past a size limit. Rotated files are renamed to
+// path.1, path.2 and so on, with path.1 the most recent.
+type Logger struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxFiles   int
+	redactKeys []string
+	file       *os.File
+	size       int64
+	lastHash   string
+}
+
+// NewLogger opens the audit file at path, creating it if needed. The
+// hash chain continues from the last record already in the file.
+func NewLogger(path string, maxSize int64, maxFiles int, redactKeys []string) (*Logger, error) {
+	al := &Logger{
+		path:       path,
+		maxSize:    maxSize,
+		maxFiles:   maxFiles,
+		redactKeys: redactKeys,
+	}
+	lastHash, err := lastHashIn(path)
+	if err != nil {
+		return nil, err
+	}
+	if lastHash == "" {
+		// The current file may have just been rotated
+		if lastHash, err = lastHashIn(rotatedPath(path, 1)); err != nil {
+			return nil, err
+		}
+	}
+	al.lastHash = lastHash
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Write redacts record, chains it to the previous record and appends
+// it to the audit file
+func (al *Logger) Write(record *Record) error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	record.Redact(al.redactKeys)
+	record.PrevHash = al.lastHash
+	line, hash, err := record.encode()
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		return err
+	}
+	al.lastHash = hash
+	return nil
+}
+
+// Close closes the audit file
+func (al *Logger) Close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.file.Close()
+}
+
+func (al *Logger) open() error {
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+func (al *Logger) rotate() error {
+	if err := al.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(rotatedPath(al.path, al.maxFiles))
+	for i := al.maxFiles - 1; i > 0; i-- {
+		os.Rename(rotatedPath(al.path, i), rotatedPath(al.path, i+1))
+	}
+	if err := os.Rename(al.path, rotatedPath(al.path, 1)); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// lastHashIn returns the hash of the last record in path or "" if
+// the file is missing or empty
+func lastHashIn(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if last == nil {
+		return "", nil
+	}
+	_, hash, err := decodeLine(last)
+	if err != nil {
+		return "", fmt.Errorf("Last record in %s is damaged: %s", path, err)
+	}
+	return hash, nil
+}
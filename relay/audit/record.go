@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces the values of redacted args and options
+const redactedValue = "********"
+
+// hashField is the JSON key of the hash appended to every line
+const hashField = `,"hash":"`
+
+var errorMissingHash = errors.New("Record has no trailing hash")
+
+// Record describes one command execution. Records are written one per
+// line; each line ends with a hash covering the record, including the
+// previous record's hash.
+type Record struct {
+	Timestamp     time.Time              `json:"timestamp"`
+	RelayID       string                 `json:"relay_id"`
+	PipelineID    string                 `json:"pipeline_id"`
+	InvocationID  string                 `json:"invocation_id"`
+	CogUser       string                 `json:"cog_user"`
+	ChatHandle    string                 `json:"chat_handle"`
+	Room          string                 `json:"room"`
+	Bundle        string                 `json:"bundle"`
+	BundleVersion string                 `json:"bundle_version"`
+	Command       string                 `json:"command"`
+	Args          []interface{}          `json:"args"`
+	Options       map[string]interface{} `json:"options"`
+	Engine        string                 `json:"engine"`
+	Image         string                 `json:"image,omitempty"`
+	ImageDigest   string                 `json:"image_digest,omitempty"`
+	Status        string                 `json:"status"`
+	ExitCode      *int                   `json:"exit_code,omitempty"`
+	Duration      int64                  `json:"duration_ms"`
+	PrevHash      string                 `json:"prev_hash"`
+}
+
+// Redact replaces the values of options, and of "key=value" args,
+// whose keys contain any of keys. Matching is case-insensitive.
+func (r *Record) Redact(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	options := make(map[string]interface{}, len(r.Options))
+	for name, value := range r.Options {
+		if matchesKey(name, keys) {
+			value = redactedValue
+		}
+		options[name] = value
+	}
+	r.Options = options
+	args := make([]interface{}, len(r.Args))
+	for i, arg := range r.Args {
+		if text, ok := arg.(string); ok {
+			if parts := strings.SplitN(text, "=", 2); len(parts) == 2 && matchesKey(parts[0], keys) {
+				arg = fmt.Sprintf("%s=%s", parts[0], redactedValue)
+			}
+		}
+		args[i] = arg
+	}
+	r.Args = args
+}
+
+// encode returns the record's line, without the trailing newline,
+// and its hash
+func (r *Record) encode() ([]byte, string, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashBody(body)
+	var line bytes.Buffer
+	line.Write(body[:len(body)-1])
+	line.WriteString(hashField)
+	line.WriteString(hash)
+	line.WriteString(`"}`)
+	return line.Bytes(), hash, nil
+}
+
+// decodeLine splits a line into its record and hash and checks the
+// hash matches the record's contents
+func decodeLine(line []byte) (*Record, string, error) {
+	index := bytes.LastIndex(line, []byte(hashField))
+	if index < 0 || bytes.HasSuffix(line, []byte(`"}`)) == false {
+		return nil, "", errorMissingHash
+	}
+	hash := string(line[index+len(hashField) : len(line)-2])
+	body := append(append([]byte{}, line[:index]...), '}')
+	if hashBody(body) != hash {
+		return nil, hash, fmt.Errorf("Hash mismatch; record was modified")
+	}
+	record := &Record{}
+	if err := json.Unmarshal(body, record); err != nil {
+		return nil, hash, err
+	}
+	return record, hash, nil
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func matchesKey(name string, keys []string) bool {
+	name = strings.ToLower(name)
+	for _, key := range keys {
+		if key != "" && strings.Contains(name, strings.ToLower(key)) {
+			return true
+		}
+	}
+	return false
+}
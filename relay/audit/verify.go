@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// maxLineSize bounds a single audit record
+const maxLineSize = 16 * 1024 * 1024
+
+// Verify checks the hash chain of the audit file at path, starting
+// with its oldest rotated file. Returns the number of records checked
+// and an error describing the first broken record, if any. The first
+// record checked is trusted to follow whatever preceded it, since
+// older files may have been rotated away.
+func Verify(path string) (int, error) {
+	files := []string{}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedPath(path, i)}, files...)
+	}
+	files = append(files, path)
+	count := 0
+	prevHash := ""
+	first := true
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return count, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			record, hash, err := decodeLine(scanner.Bytes())
+			if err != nil {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: %s", name, line, err)
+			}
+			if first == false && record.PrevHash != prevHash {
+				file.Close()
+				return count, fmt.Errorf("%s:%d: Chain broken; previous hash is %s but record refers to %s",
+					name, line, prevHash, record.PrevHash)
+			}
+			first = false
+			prevHash = hash
+			count++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return count, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return count, nil
+}
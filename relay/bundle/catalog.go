@@ -11,6 +11,7 @@ import (
 type Catalog struct {
 	lock      sync.RWMutex
 	lastAcked uint64
+	acked     bool
 	epoch     uint64
 	bundles   map[string]*config.Bundle
 }
@@ -125,15 +126,45 @@ func (bc *Catalog) CurrentEpoch() uint64 {
 	return bc.epoch
 }
 
+// UnackedEpochs returns how many epochs the catalog has moved on
+// since Cog last acked an announcement
+func (bc *Catalog) UnackedEpochs() uint64 {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.epoch - bc.lastAcked
+}
+
 // EpochAcked updates the catalog's state to reflect the latest
 // acked epoch
 func (bc *Catalog) EpochAcked(acked uint64) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 	if acked > bc.epoch {
 		log.Warnf("Ignored bundle catalog epoch ack from the future. Current bundle catalog epoch is %d; acked epoch is %d.",
 			bc.epoch, acked)
 		return
 	}
 	bc.lastAcked = acked
+	bc.acked = true
+}
+
+// Acked returns true once Cog has acked at least one bundle
+// announcement
+func (bc *Catalog) Acked() bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.acked
+}
+
+// Bundles returns a snapshot of the stored config.Bundle instances
+func (bc *Catalog) Bundles() []*config.Bundle {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	bundles := []*config.Bundle{}
+	for _, bundle := range bc.bundles {
+		bundles = append(bundles, bundle)
+	}
+	return bundles
 }
 
 // MarkReady updates the catalog entry to indicate the bundle is
@@ -97,3 +97,15 @@ func TestCatalogRemove(t *testing.T) {
 		t.Errorf("Expected Find for bundle %s to fail", barBundle10.Name)
 	}
 }
+
+func TestCatalogAcked(t *testing.T) {
+	bc := NewCatalog()
+	bc.Replace([]*config.Bundle{&bundle12})
+	if bc.Acked() {
+		t.Error("Expected new catalog to be unacked")
+	}
+	bc.EpochAcked(bc.CurrentEpoch())
+	if bc.Acked() == false || bc.IsChanged() {
+		t.Error("Expected catalog to be acked")
+	}
+}
@@ -1,50 +1,146 @@
 package bus
 
 import (
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"math/rand"
+	"sync"
 	"time"
 )
 
-// intervalTable is the schedule of backoff intervals in seconds
-var intervalTable = []int{5, 5, 5, 15, 15, 15,
-	30, 30, 30, 60, 60, 60, 90}
-var intervals = byte(len(intervalTable) - 1)
+// Backoff strategies
+const (
+	ExponentialBackoff = "exponential"
+	LinearBackoff      = "linear"
+)
+
+// ErrorBackoffExhausted is returned by Backoff.Wait once the maximum
+// number of attempts has been made
+var ErrorBackoffExhausted = errors.New("Gave up connecting to message bus after reaching the maximum number of attempts")
+
+// BackoffOptions configure a Backoff. Zero values select exponential
+// backoff from 5 seconds up to 90 seconds with no jitter and no
+// attempt limit. Jitter is a percentage of each interval.
+type BackoffOptions struct {
+	Strategy    string
+	Base        time.Duration
+	Cap         time.Duration
+	Jitter      int
+	MaxAttempts int
+}
+
+// BackoffState describes a Backoff for health checks
+type BackoffState struct {
+	Attempts    int     `json:"attempts"`
+	MaxAttempts int     `json:"max_attempts,omitempty"`
+	Waiting     bool    `json:"waiting"`
+	LastWait    float64 `json:"last_wait_seconds"`
+	Exhausted   bool    `json:"exhausted"`
+}
+
+// BackoffReporter is implemented by connections which can report
+// their reconnect backoff state
+type BackoffReporter interface {
+	BackoffState() BackoffState
+}
 
-// Backoff implements a basic increasing backoff strategy
-// with a small amount of random jitter
+// Backoff implements an increasing backoff strategy with random
+// jitter and an optional limit on attempts
 type Backoff struct {
-	interval byte
+	options BackoffOptions
+	lock    sync.Mutex
+	random  *rand.Rand
+	state   BackoffState
 }
 
 // NewBackoff returns a freshly initialized Backoff
-func NewBackoff() *Backoff {
+func NewBackoff(options BackoffOptions) *Backoff {
+	if options.Strategy == "" {
+		options.Strategy = ExponentialBackoff
+	}
+	if options.Base <= 0 {
+		options.Base = time.Duration(5) * time.Second
+	}
+	if options.Cap <= 0 {
+		options.Cap = time.Duration(90) * time.Second
+	}
 	return &Backoff{
-		interval: 0,
+		options: options,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		state:   BackoffState{MaxAttempts: options.MaxAttempts},
 	}
 }
 
-// Wait calculates the next backoff interval, sleeps
-// for that amount and returns.
-func (b *Backoff) Wait() {
+// Wait calculates the next backoff interval, sleeps for that amount
+// and returns. Returns ErrorBackoffExhausted without sleeping once
+// MaxAttempts waits have been made since the last Reset.
+func (b *Backoff) Wait() error {
+	b.lock.Lock()
+	if b.options.MaxAttempts > 0 && b.state.Attempts >= b.options.MaxAttempts {
+		b.state.Exhausted = true
+		b.lock.Unlock()
+		return ErrorBackoffExhausted
+	}
+	b.state.Attempts++
 	interval := b.nextInterval()
-	log.Infof("Waiting %d seconds before reconnecting.", interval/time.Second)
+	b.state.Waiting = true
+	b.state.LastWait = interval.Seconds()
+	b.lock.Unlock()
+	log.Infof("Waiting %v before reconnecting.", interval)
+	backoffWaits.Inc()
+	backoffSeconds.Add(interval.Seconds())
 	time.Sleep(interval)
+	b.lock.Lock()
+	b.state.Waiting = false
+	b.lock.Unlock()
+	return nil
 }
 
 // Reset restarts wait interval escalation
 func (b *Backoff) Reset() {
-	b.interval = byte(0)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.state = BackoffState{MaxAttempts: b.options.MaxAttempts}
 }
 
+// State returns a snapshot of the backoff's progress
+func (b *Backoff) State() BackoffState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// nextInterval must be called with the lock held
 func (b *Backoff) nextInterval() time.Duration {
-	if b.interval < intervals {
-		b.interval++
+	interval := b.options.Cap
+	attempt := b.state.Attempts
+	switch b.options.Strategy {
+	case LinearBackoff:
+		if attempt < int(b.options.Cap/b.options.Base) {
+			interval = b.options.Base * time.Duration(attempt)
+		}
+	default:
+		interval = b.options.Base
+		for i := 1; i < attempt && interval < b.options.Cap; i++ {
+			interval *= 2
+		}
+		if interval > b.options.Cap {
+			interval = b.options.Cap
+		}
 	}
-	return time.Duration(intervalTable[b.interval]+b.jitter()) * time.Second
+	if b.options.Jitter > 0 {
+		spread := int64(interval) * int64(b.options.Jitter) / 100
+		if spread > 0 {
+			interval += time.Duration(b.random.Int63n(2*spread+1) - spread)
+		}
+	}
+	return interval
 }
 
-func (b *Backoff) jitter() int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(4)
+// giveUp reports a connection which has stopped reconnecting
+func giveUp(options ConnectionOptions, err error) {
+	log.Errorf("Message bus connection lost for good: %s.", err)
+	if options.OnGiveUp != nil {
+		options.OnGiveUp(err)
+	}
 }
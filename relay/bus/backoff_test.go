@@ -0,0 +1,51 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffStrategies(t *testing.T) {
+	exponential := NewBackoff(BackoffOptions{Base: time.Second, Cap: 10 * time.Second})
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, want := range expected {
+		exponential.state.Attempts = i + 1
+		if interval := exponential.nextInterval(); interval != want*time.Second {
+			t.Errorf("Exponential attempt %d: expected %v, got %v", i+1, want*time.Second, interval)
+		}
+	}
+	linear := NewBackoff(BackoffOptions{Strategy: LinearBackoff, Base: time.Second, Cap: 3 * time.Second})
+	expected = []time.Duration{1, 2, 3, 3}
+	for i, want := range expected {
+		linear.state.Attempts = i + 1
+		if interval := linear.nextInterval(); interval != want*time.Second {
+			t.Errorf("Linear attempt %d: expected %v, got %v", i+1, want*time.Second, interval)
+		}
+	}
+	jittered := NewBackoff(BackoffOptions{Base: 10 * time.Second, Cap: 10 * time.Second, Jitter: 20})
+	for i := 0; i < 100; i++ {
+		jittered.state.Attempts = 1
+		if interval := jittered.nextInterval(); interval < 8*time.Second || interval > 12*time.Second {
+			t.Fatalf("Jittered interval out of range: %v", interval)
+		}
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	backoff := NewBackoff(BackoffOptions{Base: time.Millisecond, Cap: time.Millisecond, MaxAttempts: 2})
+	for i := 0; i < 2; i++ {
+		if err := backoff.Wait(); err != nil {
+			t.Fatalf("Unexpected error on attempt %d: %s", i+1, err)
+		}
+	}
+	if err := backoff.Wait(); err != ErrorBackoffExhausted {
+		t.Errorf("Expected backoff to give up: %v", err)
+	}
+	if state := backoff.State(); state.Exhausted == false || state.Attempts != 2 {
+		t.Errorf("Unexpected backoff state: %+v", state)
+	}
+	backoff.Reset()
+	if state := backoff.State(); state.Exhausted || state.Attempts != 0 {
+		t.Errorf("Expected Reset() to clear state: %+v", state)
+	}
+}
@@ -2,6 +2,7 @@ package bus
 
 import (
 	"errors"
+	"time"
 )
 
 // MessagePublisher sends messages on the message bus
@@ -10,21 +11,51 @@ type MessagePublisher interface {
 }
 
 // Event describes different events which can happen over the
-// life of a connection. Currently only BusConnection is supported.
+// life of a connection
 type Event int
 
 const (
 	// ConnectedEvent indicates a working bus connection has been
 	// established
 	ConnectedEvent Event = iota
+	// DisconnectedEvent indicates a working bus connection was lost
+	DisconnectedEvent
+	// ReconnectingEvent is sent before each attempt to re-establish
+	// a lost connection
+	ReconnectingEvent
+	// SubscriptionFailedEvent indicates a subscription couldn't be
+	// made
+	SubscriptionFailedEvent
 )
 
+var eventNames = []string{"connected", "disconnected", "reconnecting", "subscription_failed"}
+
+func (e Event) String() string {
+	if int(e) < len(eventNames) {
+		return eventNames[e]
+	}
+	return "unknown"
+}
+
+// EventInfo describes the circumstances of an Event
+type EventInfo struct {
+	// Cause is the error behind the event. It is nil for
+	// ConnectedEvent.
+	Cause error
+	// Attempt counts connection attempts since the connection was
+	// lost, including the one being reported. It is zero for events
+	// which don't follow a connection attempt.
+	Attempt int
+	// Topic is the topic a SubscriptionFailedEvent refers to
+	Topic string
+}
+
 // SubscriptionHandler is called when a message is received on its
 // corresponding topic subscription
 type SubscriptionHandler func(conn Connection, topic string, message []byte)
 
 // EventHandler is called when a bus event occurs.
-type EventHandler func(conn Connection, event Event)
+type EventHandler func(conn Connection, event Event, info EventInfo)
 
 // DisconnectMessage is sent when the connection is broken
 type DisconnectMessage struct {
@@ -34,15 +65,31 @@ type DisconnectMessage struct {
 
 // ConnectionOptions describe how to configure a bus.Connection
 type ConnectionOptions struct {
-	Userid        string
-	Password      string
-	Host          string
-	Port          int
-	SSLEnabled    bool
-	SSLCertPath   string
-	EventsHandler EventHandler
-	AutoReconnect bool
-	OnDisconnect  *DisconnectMessage
+	Transport         string
+	Userid            string
+	Password          string
+	Host              string
+	Port              int
+	Endpoints         []Endpoint
+	Failover          string
+	FailbackInterval  time.Duration
+	Backoff           BackoffOptions
+	OnGiveUp          func(err error)
+	Codecs            []Codec
+	SSLEnabled        bool
+	SSLCertPath       string
+	SSLInsecure       bool
+	SSLClientCertPath string
+	SSLClientKeyPath  string
+	SSLServerName     string
+	SSLMinVersion     uint16
+	SSLCipherSuites   []uint16
+	SSLReloadInterval time.Duration
+	WebSocket         bool
+	WebSocketPath     string
+	ProxyURL          string
+	EventsHandler     EventHandler
+	OnDisconnect      *DisconnectMessage
 }
 
 // Connection is the high-level message bus interface
@@ -51,6 +98,18 @@ type Connection interface {
 	Disconnect() error
 	Publish(topic string, payload []byte) error
 	Subscribe(topic string, handler SubscriptionHandler) error
+	Unsubscribe(topic string) error
+	IsConnected() bool
 }
 
 var errorBadTLSCert = errors.New("Bad TLS certificate")
+var errorNotConnected = errors.New("Not connected to message bus")
+var errorConnectionClosed = errors.New("Connection closed")
+
+// notify reports an event to the connection's EventsHandler
+func notify(options ConnectionOptions, conn Connection, event Event, info EventInfo) {
+	busEvents.Inc(event.String())
+	if options.EventsHandler != nil {
+		options.EventsHandler(conn, event, info)
+	}
+}
@@ -0,0 +1,98 @@
+package bus
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+const encryptedFrameVersion = 1
+
+var errorBadEncryptionKey = errors.New("Encryption keys must be 32 bytes long")
+var errorUnencrypted = errors.New("Message is not encrypted")
+var errorUndecryptable = errors.New("Message can't be decrypted with the current or previous key")
+
+// EncryptionCodec encrypts frames with AES-256-GCM. Frames are laid out
+// as a version byte, a 4 byte key fingerprint, the nonce and the sealed
+// payload. The topic is authenticated alongside the payload so a frame
+// can't be replayed onto another topic.
+type EncryptionCodec struct {
+	current  *encryptionKey
+	previous *encryptionKey
+}
+
+type encryptionKey struct {
+	fingerprint []byte
+	aead        cipher.AEAD
+}
+
+// NewEncryptionCodec returns a codec encrypting with current and
+// decrypting with either current or previous, allowing keys to be
+// rotated without dropping messages. previous may be nil.
+func NewEncryptionCodec(current []byte, previous []byte) (*EncryptionCodec, error) {
+	codec := &EncryptionCodec{}
+	var err error
+	if codec.current, err = newEncryptionKey(current); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if codec.previous, err = newEncryptionKey(previous); err != nil {
+			return nil, err
+		}
+	}
+	return codec, nil
+}
+
+func newEncryptionKey(key []byte) (*encryptionKey, error) {
+	if len(key) != 32 {
+		return nil, errorBadEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &encryptionKey{
+		fingerprint: sum[:4],
+		aead:        aead,
+	}, nil
+}
+
+// Encode is required by the bus.Codec interface
+func (ec *EncryptionCodec) Encode(topic string, frame []byte) ([]byte, error) {
+	aead := ec.current.aead
+	header := append([]byte{encryptedFrameVersion}, ec.current.fingerprint...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, frame, []byte(strings.Trim(topic, "/"))), nil
+}
+
+// Decode is required by the bus.Codec interface
+func (ec *EncryptionCodec) Decode(topic string, frame []byte) ([]byte, error) {
+	nonceSize := ec.current.aead.NonceSize()
+	if len(frame) < 5+nonceSize || frame[0] != encryptedFrameVersion {
+		messagesRejected.Inc("unencrypted")
+		return nil, errorUnencrypted
+	}
+	fingerprint, nonce, sealed := frame[1:5], frame[5:5+nonceSize], frame[5+nonceSize:]
+	for _, key := range []*encryptionKey{ec.current, ec.previous} {
+		if key == nil || string(key.fingerprint) != string(fingerprint) {
+			continue
+		}
+		if payload, err := key.aead.Open(nil, nonce, sealed, []byte(strings.Trim(topic, "/"))); err == nil {
+			return payload, nil
+		}
+	}
+	messagesRejected.Inc("undecryptable")
+	return nil, errorUndecryptable
+}
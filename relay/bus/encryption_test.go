@@ -0,0 +1,65 @@
+package bus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	codec, err := NewEncryptionCodec(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, _ := codec.Encode("/bot/relays/foo/exec", []byte(`{"service_token":"abc"}`))
+	if bytes.Contains(frame, []byte("service_token")) {
+		t.Errorf("Expected payload to be encrypted: %q", frame)
+	}
+	payload, err := codec.Decode("bot/relays/foo/exec", frame)
+	if err != nil || string(payload) != `{"service_token":"abc"}` {
+		t.Errorf("Expected encrypted frame to decrypt: %q %v", payload, err)
+	}
+	if _, err := codec.Decode("bot/relays/bar/exec", frame); err != errorUndecryptable {
+		t.Errorf("Expected frame moved to another topic to be rejected: %v", err)
+	}
+	frame[len(frame)-1] ^= 0xff
+	if _, err := codec.Decode("bot/relays/foo/exec", frame); err != errorUndecryptable {
+		t.Errorf("Expected tampered frame to be rejected: %v", err)
+	}
+	if _, err := codec.Decode("bot/relays/foo/exec", []byte(`{"id":1}`)); err != errorUnencrypted {
+		t.Errorf("Expected plaintext frame to be rejected: %v", err)
+	}
+	if _, err := NewEncryptionCodec([]byte("short"), nil); err != errorBadEncryptionKey {
+		t.Errorf("Expected short key to be rejected: %v", err)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	newKey := bytes.Repeat([]byte("n"), 32)
+	before, _ := NewEncryptionCodec(oldKey, nil)
+	after, _ := NewEncryptionCodec(newKey, oldKey)
+	frame, _ := before.Encode("bot/relays/foo/exec", []byte("hello"))
+	if payload, err := after.Decode("bot/relays/foo/exec", frame); err != nil || string(payload) != "hello" {
+		t.Errorf("Expected frame sealed with previous key to decrypt: %q %v", payload, err)
+	}
+	frame, _ = after.Encode("bot/relays/foo/exec", []byte("hello"))
+	if _, err := before.Decode("bot/relays/foo/exec", frame); err != errorUndecryptable {
+		t.Errorf("Expected frame sealed with unknown key to be rejected: %v", err)
+	}
+}
+
+func TestEncryptThenSign(t *testing.T) {
+	encryption, _ := NewEncryptionCodec(bytes.Repeat([]byte("k"), 32), nil)
+	signing := NewHMACCodec("relay-1", map[string][]byte{"relay-1": []byte("sekrit")}, time.Minute, 2*time.Hour, false)
+	codecs := []Codec{encryption, signing}
+	frame, err := encodeFrame(codecs, "bot/relays/foo/exec", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := decodeFrame(codecs, "bot/relays/foo/exec", frame)
+	if err != nil || string(payload) != "hello" {
+		t.Errorf("Expected frame to survive the codec chain: %q %v", payload, err)
+	}
+}
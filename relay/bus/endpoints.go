@@ -0,0 +1,60 @@
+package bus
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+)
+
+// Failover strategies for choosing among broker endpoints
+const (
+	OrderedFailover = "ordered"
+	RandomFailover  = "random"
+)
+
+// Endpoint is the address of one message bus broker
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// ActiveEndpointReporter is implemented by connections which can say
+// which broker they're connected to
+type ActiveEndpointReporter interface {
+	ActiveEndpoint() string
+}
+
+// endpoints returns the brokers to try. Without an explicit list the
+// single Host and Port are used.
+func (options ConnectionOptions) endpoints() []Endpoint {
+	if len(options.Endpoints) > 0 {
+		return options.Endpoints
+	}
+	return []Endpoint{{Host: options.Host, Port: options.Port}}
+}
+
+// forEndpoint returns a copy of options aimed at endpoint
+func (options ConnectionOptions) forEndpoint(endpoint Endpoint) ConnectionOptions {
+	options.Host = endpoint.Host
+	options.Port = endpoint.Port
+	return options
+}
+
+// endpointOrder returns the order endpoints are tried in for one round
+// of connection attempts. Ordered failover always starts with the
+// primary, the first endpoint, so relays return to it once it's
+// healthy. Random failover spreads relays across all endpoints.
+func endpointOrder(endpoints []Endpoint, strategy string) []Endpoint {
+	if strategy != RandomFailover {
+		return endpoints
+	}
+	shuffled := make([]Endpoint, len(endpoints))
+	for i, j := range rand.Perm(len(endpoints)) {
+		shuffled[i] = endpoints[j]
+	}
+	return shuffled
+}
@@ -0,0 +1,48 @@
+package bus
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEndpointOrder(t *testing.T) {
+	endpoints := []Endpoint{{"a", 1883}, {"b", 1883}, {"c", 1883}}
+	ordered := endpointOrder(endpoints, OrderedFailover)
+	if ordered[0] != endpoints[0] || ordered[2] != endpoints[2] {
+		t.Errorf("Expected ordered failover to keep configured order: %v", ordered)
+	}
+	shuffled := endpointOrder(endpoints, RandomFailover)
+	seen := map[Endpoint]bool{}
+	for _, endpoint := range shuffled {
+		seen[endpoint] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected random failover to try every endpoint once: %v", shuffled)
+	}
+	options := ConnectionOptions{Host: "cog", Port: 1883}
+	if single := options.endpoints(); len(single) != 1 || single[0].String() != "cog:1883" {
+		t.Errorf("Expected host and port without endpoints: %v", single)
+	}
+}
+
+func TestNATSFailover(t *testing.T) {
+	server := newNATSTestServer(t)
+	defer server.close()
+	// Grab a port nothing is listening on for the dead primary
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := dead.Addr().(*net.TCPAddr).Port
+	dead.Close()
+	options := server.options("relay")
+	options.Endpoints = []Endpoint{{"127.0.0.1", deadPort}, {"127.0.0.1", options.Port}}
+	conn := &NATSConnection{}
+	if err := conn.Connect(options); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	if active := conn.ActiveEndpoint(); active != options.Endpoints[1].String() {
+		t.Errorf("Expected failover to second endpoint: %s", active)
+	}
+}
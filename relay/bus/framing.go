@@ -0,0 +1,61 @@
+package bus
+
+import (
+	"github.com/golang/snappy"
+)
+
+// Codec transforms framed payloads on their way to and from the bus.
+// Codecs run in order when publishing and in reverse order when
+// receiving.
+type Codec interface {
+	Encode(topic string, frame []byte) ([]byte, error)
+	Decode(topic string, frame []byte) ([]byte, error)
+}
+
+// WillCodec is implemented by codecs which encode last will messages
+// differently. A will is encoded when the connection is made but only
+// published by the broker once the connection is lost, which may be
+// much later.
+type WillCodec interface {
+	EncodeWill(topic string, frame []byte) ([]byte, error)
+}
+
+// encodeFrame compresses a payload for the wire and runs it through
+// codecs. Every transport frames payloads the same way so Cog can
+// decode them regardless of transport.
+func encodeFrame(codecs []Codec, topic string, payload []byte) ([]byte, error) {
+	return encode(codecs, topic, payload, false)
+}
+
+// encodeWill is encodeFrame for last will messages registered with the
+// broker
+func encodeWill(codecs []Codec, topic string, payload []byte) ([]byte, error) {
+	return encode(codecs, topic, payload, true)
+}
+
+func encode(codecs []Codec, topic string, payload []byte, will bool) ([]byte, error) {
+	frame := snappy.Encode(nil, payload)
+	for _, codec := range codecs {
+		var err error
+		if willCodec, ok := codec.(WillCodec); ok && will {
+			frame, err = willCodec.EncodeWill(topic, frame)
+		} else {
+			frame, err = codec.Encode(topic, frame)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+// decodeFrame reverses encodeFrame
+func decodeFrame(codecs []Codec, topic string, frame []byte) ([]byte, error) {
+	for i := len(codecs) - 1; i >= 0; i-- {
+		var err error
+		if frame, err = codecs[i].Decode(topic, frame); err != nil {
+			return nil, err
+		}
+	}
+	return snappy.Decode(nil, frame)
+}
@@ -0,0 +1,240 @@
+package bus
+
+import (
+	"sort"
+	"sync"
+)
+
+// ConnectionManager multiplexes several Relay subsystems over one
+// Connection. Each subsystem uses the Connection returned by Owner.
+// Subscriptions are tracked by owner, replayed whenever the shared
+// connection is re-established and dropped when their owner
+// disconnects. Bus events are reported to every owner.
+type ConnectionManager struct {
+	conn   Connection
+	lock   sync.Mutex
+	owners map[string]*ownerConnection
+	subs   map[string]map[string]SubscriptionHandler
+}
+
+// NewConnectionManager returns a manager sharing conn, which must not
+// be connected yet
+func NewConnectionManager(conn Connection) *ConnectionManager {
+	return &ConnectionManager{
+		conn:   conn,
+		owners: make(map[string]*ownerConnection),
+		subs:   make(map[string]map[string]SubscriptionHandler),
+	}
+}
+
+// Connect establishes the shared connection. Events are reported to
+// owners rather than to options.EventsHandler.
+func (cm *ConnectionManager) Connect(options ConnectionOptions) error {
+	options.EventsHandler = cm.handleEvents
+	return cm.conn.Connect(options)
+}
+
+// Disconnect closes the shared connection and forgets every owner
+func (cm *ConnectionManager) Disconnect() error {
+	cm.lock.Lock()
+	cm.owners = make(map[string]*ownerConnection)
+	cm.subs = make(map[string]map[string]SubscriptionHandler)
+	cm.lock.Unlock()
+	return cm.conn.Disconnect()
+}
+
+// Conn returns the shared connection
+func (cm *ConnectionManager) Conn() Connection {
+	return cm.conn
+}
+
+// Owner returns the Connection used by the named subsystem. Calling
+// its Connect registers the owner's EventsHandler and its Disconnect
+// releases the owner's subscriptions; neither affects the shared
+// connection.
+func (cm *ConnectionManager) Owner(name string) Connection {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.ownerConnection(name)
+}
+
+// Subscriptions returns the topics subscribed to by owner, sorted
+func (cm *ConnectionManager) Subscriptions(owner string) []string {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	topics := []string{}
+	for topic, handlers := range cm.subs {
+		if _, ok := handlers[owner]; ok {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Release drops owner's subscriptions and event handler. Topics no
+// other owner needs are unsubscribed from the shared connection.
+func (cm *ConnectionManager) Release(owner string) {
+	cm.lock.Lock()
+	delete(cm.owners, owner)
+	topics := []string{}
+	for topic, handlers := range cm.subs {
+		if _, ok := handlers[owner]; ok {
+			delete(handlers, owner)
+			if len(handlers) == 0 {
+				delete(cm.subs, topic)
+				topics = append(topics, topic)
+			}
+		}
+	}
+	cm.lock.Unlock()
+	for _, topic := range topics {
+		cm.conn.Unsubscribe(topic)
+	}
+}
+
+func (cm *ConnectionManager) subscribe(owner string, topic string, handler SubscriptionHandler) error {
+	cm.lock.Lock()
+	handlers := cm.subs[topic]
+	if handlers == nil {
+		handlers = make(map[string]SubscriptionHandler)
+		cm.subs[topic] = handlers
+	}
+	handlers[owner] = handler
+	cm.lock.Unlock()
+	// Replayed once the connection is established
+	if cm.conn.IsConnected() == false {
+		return nil
+	}
+	return cm.conn.Subscribe(topic, cm.dispatcher(topic))
+}
+
+func (cm *ConnectionManager) unsubscribe(owner string, topic string) error {
+	cm.lock.Lock()
+	handlers := cm.subs[topic]
+	delete(handlers, owner)
+	remaining := len(handlers)
+	if remaining == 0 {
+		delete(cm.subs, topic)
+	}
+	cm.lock.Unlock()
+	if remaining > 0 {
+		return nil
+	}
+	return cm.conn.Unsubscribe(topic)
+}
+
+// dispatcher returns the handler subscribed to topic on the shared
+// connection. It passes messages to every owner subscribed to topic.
+func (cm *ConnectionManager) dispatcher(topic string) SubscriptionHandler {
+	return func(conn Connection, messageTopic string, payload []byte) {
+		cm.lock.Lock()
+		conns := []Connection{}
+		handlers := []SubscriptionHandler{}
+		for owner, handler := range cm.subs[topic] {
+			if handler != nil {
+				conns = append(conns, cm.ownerConnection(owner))
+				handlers = append(handlers, handler)
+			}
+		}
+		cm.lock.Unlock()
+		for i, handler := range handlers {
+			handler(conns[i], messageTopic, payload)
+		}
+	}
+}
+
+// handleEvents replays subscriptions each time the shared connection
+// is established, before owners hear about it, then passes the event
+// on to every owner
+func (cm *ConnectionManager) handleEvents(conn Connection, event Event, info EventInfo) {
+	if event == ConnectedEvent {
+		cm.replay()
+	}
+	cm.lock.Lock()
+	owners := []*ownerConnection{}
+	for _, owner := range cm.owners {
+		owners = append(owners, owner)
+	}
+	cm.lock.Unlock()
+	for _, owner := range owners {
+		owner.events(owner, event, info)
+	}
+}
+
+func (cm *ConnectionManager) replay() {
+	cm.lock.Lock()
+	topics := []string{}
+	for topic := range cm.subs {
+		topics = append(topics, topic)
+	}
+	cm.lock.Unlock()
+	sort.Strings(topics)
+	for _, topic := range topics {
+		// Failures are reported as SubscriptionFailedEvents
+		cm.conn.Subscribe(topic, cm.dispatcher(topic))
+	}
+}
+
+// ownerConnection returns the registered connection for owner, or a
+// new one if owner never connected. Called with the lock held.
+func (cm *ConnectionManager) ownerConnection(owner string) *ownerConnection {
+	if oc := cm.owners[owner]; oc != nil {
+		return oc
+	}
+	return &ownerConnection{
+		name:    owner,
+		manager: cm,
+	}
+}
+
+// ownerConnection is one subsystem's view of a ConnectionManager
+type ownerConnection struct {
+	name    string
+	manager *ConnectionManager
+	events  EventHandler
+}
+
+// Connect is required by the bus.Connection interface. The owner's
+// EventsHandler is told straight away if the shared connection is
+// already established.
+func (oc *ownerConnection) Connect(options ConnectionOptions) error {
+	if options.EventsHandler == nil {
+		return nil
+	}
+	oc.events = options.EventsHandler
+	oc.manager.lock.Lock()
+	oc.manager.owners[oc.name] = oc
+	oc.manager.lock.Unlock()
+	if oc.manager.conn.IsConnected() {
+		oc.events(oc, ConnectedEvent, EventInfo{})
+	}
+	return nil
+}
+
+// Disconnect is required by the bus.Connection interface. It releases
+// the owner's subscriptions.
+func (oc *ownerConnection) Disconnect() error {
+	oc.manager.Release(oc.name)
+	return nil
+}
+
+// Publish is required by the bus.Connection interface
+func (oc *ownerConnection) Publish(topic string, payload []byte) error {
+	return oc.manager.conn.Publish(topic, payload)
+}
+
+// Subscribe is required by the bus.Connection interface
+func (oc *ownerConnection) Subscribe(topic string, handler SubscriptionHandler) error {
+	return oc.manager.subscribe(oc.name, topic, handler)
+}
+
+// Unsubscribe is required by the bus.Connection interface
+func (oc *ownerConnection) Unsubscribe(topic string) error {
+	return oc.manager.unsubscribe(oc.name, topic)
+}
+
+// IsConnected is required by the bus.Connection interface
+func (oc *ownerConnection) IsConnected() bool {
+	return oc.manager.conn.IsConnected()
+}
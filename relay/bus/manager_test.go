@@ -0,0 +1,108 @@
+package bus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestManagerSharesConnection(t *testing.T) {
+	broker := NewMemoryBroker()
+	cog := broker.NewConnection()
+	cog.Connect(ConnectionOptions{Userid: "cog"})
+	manager := NewConnectionManager(broker.NewConnection())
+	relay := manager.Owner("relay")
+	updater := manager.Owner("updater")
+	events := []string{}
+	relay.Connect(ConnectionOptions{
+		EventsHandler: func(conn Connection, event Event, info EventInfo) {
+			events = append(events, "relay "+event.String())
+		},
+	})
+	if err := manager.Connect(ConnectionOptions{Userid: "relay"}); err != nil {
+		t.Fatal(err)
+	}
+	updater.Connect(ConnectionOptions{
+		EventsHandler: func(conn Connection, event Event, info EventInfo) {
+			events = append(events, "updater "+event.String())
+		},
+	})
+	got := make(chan string, 2)
+	relay.Subscribe("bot/relays/foo/#", func(conn Connection, topic string, payload []byte) {
+		if conn != relay {
+			t.Errorf("Expected handler to be passed its owner's connection")
+		}
+		got <- "relay " + topic
+	})
+	updater.Subscribe("bot/relays/foo/#", func(conn Connection, topic string, payload []byte) {
+		got <- "updater " + topic
+	})
+	if len(broker.Connections()) != 2 {
+		t.Errorf("Expected owners to share one connection: %d", len(broker.Connections()))
+	}
+	cog.Publish("bot/relays/foo/dynconfigs", []byte("{}"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+	expected := []string{"relay connected", "updater connected"}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected connection events: %v", events)
+	}
+}
+
+func TestManagerReplaysSubscriptions(t *testing.T) {
+	broker := NewMemoryBroker()
+	cog := broker.NewConnection()
+	cog.Connect(ConnectionOptions{Userid: "cog"})
+	conn := broker.NewConnection()
+	manager := NewConnectionManager(conn)
+	manager.Connect(ConnectionOptions{Userid: "relay"})
+	manager.Owner("relay").Subscribe("bot/relays/foo/directives", nil)
+	manager.Owner("announcer").Subscribe("bot/relays/foo/announcer", nil)
+	// Simulate a transport which loses subscriptions with the connection
+	conn.Drop()
+	conn.Unsubscribe("bot/relays/foo/directives")
+	conn.Unsubscribe("bot/relays/foo/announcer")
+	conn.Reconnect()
+	cog.Publish("bot/relays/foo/directives", []byte("{}"))
+	cog.Publish("bot/relays/foo/announcer", []byte("{}"))
+	if _, err := conn.WaitForMessages("bot/relays/foo/#", 2, time.Second); err != nil {
+		t.Errorf("Expected subscriptions to be replayed after reconnecting: %v", err)
+	}
+}
+
+func TestManagerRelease(t *testing.T) {
+	broker := NewMemoryBroker()
+	cog := broker.NewConnection()
+	cog.Connect(ConnectionOptions{Userid: "cog"})
+	conn := broker.NewConnection()
+	manager := NewConnectionManager(conn)
+	manager.Connect(ConnectionOptions{Userid: "relay"})
+	relay := manager.Owner("relay")
+	updater := manager.Owner("updater")
+	relay.Subscribe("bot/relays/foo/directives", nil)
+	updater.Subscribe("bot/relays/foo/directives", nil)
+	updater.Subscribe("bot/relays/foo/dynconfigs", nil)
+	updater.Disconnect()
+	if topics := manager.Subscriptions("updater"); len(topics) != 0 {
+		t.Errorf("Expected released owner to have no subscriptions: %v", topics)
+	}
+	if topics := manager.Subscriptions("relay"); fmt.Sprint(topics) != "[bot/relays/foo/directives]" {
+		t.Errorf("Expected other owners to keep their subscriptions: %v", topics)
+	}
+	if relay.IsConnected() == false {
+		t.Errorf("Expected releasing an owner to leave the shared connection up")
+	}
+	cog.Publish("bot/relays/foo/dynconfigs", []byte("{}"))
+	cog.Publish("bot/relays/foo/directives", []byte("{}"))
+	if _, err := conn.WaitForMessages("bot/relays/foo/directives", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if received := conn.Received("bot/relays/foo/dynconfigs"); len(received) != 0 {
+		t.Errorf("Expected released topic to be unsubscribed: %v", received)
+	}
+}
@@ -0,0 +1,387 @@
+package bus
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errorMemoryTimeout = errors.New("Timed out waiting for messages")
+var errorConnectionLost = errors.New("Connection lost")
+
+// MemoryBroker routes messages between MemoryConnections in the same
+// process. It stands in for Cog's broker in tests and when Relay
+// components are embedded in another program.
+type MemoryBroker struct {
+	lock  sync.Mutex
+	conns []*MemoryConnection
+}
+
+// MemoryMessage is a message delivered to a MemoryConnection
+type MemoryMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// NewMemoryBroker returns a broker with no connections
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// NewConnection returns a new, unconnected connection to the broker
+func (mb *MemoryBroker) NewConnection() *MemoryConnection {
+	mc := &MemoryConnection{
+		broker: mb,
+		subs:   make(map[string]SubscriptionHandler),
+	}
+	mc.cond = sync.NewCond(&mc.lock)
+	return mc
+}
+
+// Transport returns a TransportFactory creating connections to the
+// broker, for use with RegisterTransport
+func (mb *MemoryBroker) Transport() TransportFactory {
+	return func() Connection {
+		return mb.NewConnection()
+	}
+}
+
+// Connections returns the connections attached to the broker, oldest
+// first. Dropped connections are included until they're disconnected.
+func (mb *MemoryBroker) Connections() []*MemoryConnection {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return append([]*MemoryConnection{}, mb.conns...)
+}
+
+// Connection returns the attached connection using clientID, or nil
+func (mb *MemoryBroker) Connection(clientID string) *MemoryConnection {
+	for _, mc := range mb.Connections() {
+		if mc.ClientID() == clientID {
+			return mc
+		}
+	}
+	return nil
+}
+
+func (mb *MemoryBroker) attach(mc *MemoryConnection) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	for _, conn := range mb.conns {
+		if conn == mc {
+			return
+		}
+	}
+	mb.conns = append(mb.conns, mc)
+}
+
+func (mb *MemoryBroker) detach(mc *MemoryConnection) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	for i, conn := range mb.conns {
+		if conn == mc {
+			mb.conns = append(mb.conns[:i], mb.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (mb *MemoryBroker) route(topic string, frame []byte) {
+	for _, mc := range mb.Connections() {
+		mc.enqueue(topic, frame)
+	}
+}
+
+// MemoryConnection is an in-process implementation of bus.Connection.
+// Topics are matched with MQTT semantics, including the '+' and '#'
+// wildcards. Messages are framed and run through codecs like any other
+// transport and are delivered in order on a goroutine per connection.
+// Subscriptions survive Drop and Reconnect.
+type MemoryConnection struct {
+	broker    *MemoryBroker
+	options   ConnectionOptions
+	lock      sync.Mutex
+	cond      *sync.Cond
+	subs      map[string]SubscriptionHandler
+	pending   []MemoryMessage
+	received  []MemoryMessage
+	will      *MemoryMessage
+	subErr    error
+	connected bool
+	running   bool
+	gen       int
+}
+
+// Connect is required by the bus.Connection interface
+func (mc *MemoryConnection) Connect(options ConnectionOptions) error {
+	var will *MemoryMessage
+	if options.OnDisconnect != nil {
+		frame, err := encodeWill(options.Codecs, options.OnDisconnect.Topic, []byte(options.OnDisconnect.Body))
+		if err != nil {
+			return err
+		}
+		will = &MemoryMessage{
+			Topic:   options.OnDisconnect.Topic,
+			Payload: frame,
+		}
+	}
+	mc.lock.Lock()
+	mc.options = options
+	mc.will = will
+	mc.connected = true
+	if mc.running == false {
+		mc.running = true
+		mc.gen++
+		go mc.deliver(mc.gen)
+	}
+	mc.lock.Unlock()
+	mc.broker.attach(mc)
+	notify(options, mc, ConnectedEvent, EventInfo{Attempt: 1})
+	return nil
+}
+
+// Disconnect is required by the bus.Connection interface. The last
+// will isn't published.
+func (mc *MemoryConnection) Disconnect() error {
+	mc.broker.detach(mc)
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.connected = false
+	mc.running = false
+	mc.pending = nil
+	mc.cond.Broadcast()
+	return nil
+}
+
+// Publish is required by the bus.Connection interface
+func (mc *MemoryConnection) Publish(topic string, payload []byte) error {
+	mc.lock.Lock()
+	connected := mc.connected
+	codecs := mc.options.Codecs
+	mc.lock.Unlock()
+	if connected == false {
+		return errorNotConnected
+	}
+	frame, err := encodeFrame(codecs, topic, payload)
+	if err != nil {
+		return err
+	}
+	mc.broker.route(topic, frame)
+	return nil
+}
+
+// Subscribe is required by the bus.Connection interface. Subscribing
+// to a topic twice replaces its handler. handler may be nil when only
+// Received and WaitForMessages are used.
+func (mc *MemoryConnection) Subscribe(topic string, handler SubscriptionHandler) error {
+	mc.lock.Lock()
+	err := mc.subErr
+	if err == nil {
+		mc.subs[topic] = handler
+	}
+	options := mc.options
+	mc.lock.Unlock()
+	if err != nil {
+		notify(options, mc, SubscriptionFailedEvent, EventInfo{Cause: err, Topic: topic})
+	}
+	return err
+}
+
+// FailSubscriptions makes Subscribe fail with err until it's called
+// again with nil
+func (mc *MemoryConnection) FailSubscriptions(err error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.subErr = err
+}
+
+// Unsubscribe is required by the bus.Connection interface
+func (mc *MemoryConnection) Unsubscribe(topic string) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	delete(mc.subs, topic)
+	return nil
+}
+
+// IsConnected is required by the bus.Connection interface
+func (mc *MemoryConnection) IsConnected() bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.connected
+}
+
+// ClientID returns the user id the connection was opened with
+func (mc *MemoryConnection) ClientID() string {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.options.Userid
+}
+
+// Drop simulates the connection to the broker being lost. The broker
+// publishes the last will, if any, a DisconnectedEvent is reported and
+// the connection stays down until Reconnect is called.
+func (mc *MemoryConnection) Drop() {
+	mc.lock.Lock()
+	if mc.connected == false {
+		mc.lock.Unlock()
+		return
+	}
+	mc.connected = false
+	mc.pending = nil
+	will := mc.will
+	options := mc.options
+	mc.lock.Unlock()
+	if will != nil {
+		mc.broker.route(will.Topic, will.Payload)
+	}
+	notify(options, mc, DisconnectedEvent, EventInfo{Cause: errorConnectionLost})
+}
+
+// Reconnect re-establishes a dropped connection, reporting the
+// ReconnectingEvent and ConnectedEvent a transport reports after
+// reconnecting on its own
+func (mc *MemoryConnection) Reconnect() error {
+	mc.lock.Lock()
+	if mc.running == false {
+		mc.lock.Unlock()
+		return errorConnectionClosed
+	}
+	options := mc.options
+	mc.lock.Unlock()
+	notify(options, mc, ReconnectingEvent, EventInfo{Cause: errorConnectionLost, Attempt: 1})
+	mc.lock.Lock()
+	mc.connected = true
+	mc.lock.Unlock()
+	notify(options, mc, ConnectedEvent, EventInfo{Attempt: 1})
+	return nil
+}
+
+// Received returns the messages delivered to the connection on topics
+// matching filter. Messages are only included once their handlers
+// have returned.
+func (mc *MemoryConnection) Received(filter string) []MemoryMessage {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.matching(filter)
+}
+
+// WaitForMessages waits until at least count messages matching filter
+// have been delivered and returns them
+func (mc *MemoryConnection) WaitForMessages(filter string, count int, timeout time.Duration) ([]MemoryMessage, error) {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		mc.lock.Lock()
+		mc.cond.Broadcast()
+		mc.lock.Unlock()
+	})
+	defer timer.Stop()
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	for {
+		messages := mc.matching(filter)
+		if len(messages) >= count {
+			return messages, nil
+		}
+		if time.Now().Before(deadline) == false {
+			return messages, errorMemoryTimeout
+		}
+		mc.cond.Wait()
+	}
+}
+
+// ClearReceived forgets previously delivered messages
+func (mc *MemoryConnection) ClearReceived() {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.received = nil
+}
+
+func (mc *MemoryConnection) matching(filter string) []MemoryMessage {
+	messages := []MemoryMessage{}
+	for _, message := range mc.received {
+		if TopicMatches(filter, message.Topic) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (mc *MemoryConnection) enqueue(topic string, frame []byte) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if mc.connected == false {
+		return
+	}
+	for filter := range mc.subs {
+		if TopicMatches(filter, topic) {
+			mc.pending = append(mc.pending, MemoryMessage{
+				Topic:   topic,
+				Payload: frame,
+			})
+			mc.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// deliver runs until the connection is disconnected. gen stops a
+// goroutine outliving a Disconnect followed by a new Connect.
+func (mc *MemoryConnection) deliver(gen int) {
+	mc.lock.Lock()
+	for {
+		for mc.running && mc.gen == gen && len(mc.pending) == 0 {
+			mc.cond.Wait()
+		}
+		if mc.running == false || mc.gen != gen {
+			mc.lock.Unlock()
+			return
+		}
+		message := mc.pending[0]
+		mc.pending = mc.pending[1:]
+		codecs := mc.options.Codecs
+		mc.lock.Unlock()
+		payload, err := decodeFrame(codecs, message.Topic, message.Payload)
+		mc.lock.Lock()
+		if err != nil {
+			log.Errorf("Dropping in-memory message on %s: %s", message.Topic, err)
+			continue
+		}
+		message.Payload = payload
+		handlers := []SubscriptionHandler{}
+		for filter, handler := range mc.subs {
+			if handler != nil && TopicMatches(filter, message.Topic) {
+				handlers = append(handlers, handler)
+			}
+		}
+		mc.lock.Unlock()
+		for _, handler := range handlers {
+			handler(mc, message.Topic, message.Payload)
+		}
+		mc.lock.Lock()
+		// Recorded once handled so waiters see the handlers' effects
+		mc.received = append(mc.received, message)
+		mc.cond.Broadcast()
+	}
+}
+
+// TopicMatches returns true if topic matches the MQTT topic filter.
+// '+' matches any one level and a trailing '#' matches any number of
+// levels, including none.
+func TopicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
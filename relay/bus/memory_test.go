@@ -0,0 +1,129 @@
+package bus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"bot/relays/discover", "bot/relays/discover", true},
+		{"bot/relays/discover", "bot/relays/info", false},
+		{"bot/relays/+/directives", "bot/relays/abc/directives", true},
+		{"bot/relays/+/directives", "bot/relays/abc/def/directives", false},
+		{"/bot/commands/abc/#", "/bot/commands/abc/foo/bar", true},
+		{"/bot/commands/abc/#", "/bot/commands/abc", true},
+		{"/bot/commands/abc/#", "bot/commands/abc/foo", false},
+		{"#", "anything/at/all", true},
+		{"bot/+", "bot", false},
+	}
+	for _, c := range cases {
+		if TopicMatches(c.filter, c.topic) != c.matches {
+			t.Errorf("Expected TopicMatches(%q, %q) to be %t", c.filter, c.topic, c.matches)
+		}
+	}
+}
+
+func TestMemoryPublishSubscribe(t *testing.T) {
+	broker := NewMemoryBroker()
+	relay := broker.NewConnection()
+	cog := broker.NewConnection()
+	relay.Connect(ConnectionOptions{Userid: "relay"})
+	cog.Connect(ConnectionOptions{Userid: "cog"})
+	got := make(chan string, 1)
+	relay.Subscribe("/bot/commands/relay/#", func(conn Connection, topic string, payload []byte) {
+		got <- topic + " " + string(payload)
+	})
+	cog.Publish("/bot/commands/relay/echo/echo", []byte("hello"))
+	select {
+	case message := <-got:
+		if message != "/bot/commands/relay/echo/echo hello" {
+			t.Errorf("Unexpected message: %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+	if broker.Connection("cog") != cog {
+		t.Errorf("Expected broker to find connection by client id")
+	}
+	relay.Unsubscribe("/bot/commands/relay/#")
+	cog.Publish("/bot/commands/relay/echo/echo", []byte("ignored"))
+	cog.Subscribe("bot/relays/discover", nil)
+	relay.Publish("bot/relays/discover", []byte("announce"))
+	if _, err := cog.WaitForMessages("bot/relays/discover", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.Received("#")) != 1 {
+		t.Errorf("Expected unsubscribed message to be dropped: %v", relay.Received("#"))
+	}
+}
+
+func TestMemoryWillAndReconnect(t *testing.T) {
+	broker := NewMemoryBroker()
+	relay := broker.NewConnection()
+	cog := broker.NewConnection()
+	cog.Connect(ConnectionOptions{Userid: "cog"})
+	cog.Subscribe("bot/relays/discover", nil)
+	events := []Event{}
+	relay.Connect(ConnectionOptions{
+		Userid: "relay",
+		OnDisconnect: &DisconnectMessage{
+			Topic: "bot/relays/discover",
+			Body:  "offline",
+		},
+		EventsHandler: func(conn Connection, event Event, info EventInfo) {
+			events = append(events, event)
+		},
+	})
+	relay.Drop()
+	messages, err := cog.WaitForMessages("bot/relays/discover", 1, time.Second)
+	if err != nil || bytes.Equal(messages[0].Payload, []byte("offline")) == false {
+		t.Errorf("Expected will to be published when connection dropped: %v %v", messages, err)
+	}
+	if relay.IsConnected() || relay.Publish("foo", []byte("bar")) != errorNotConnected {
+		t.Errorf("Expected dropped connection to refuse publishes")
+	}
+	relay.Reconnect()
+	expected := []Event{ConnectedEvent, DisconnectedEvent, ReconnectingEvent, ConnectedEvent}
+	if relay.IsConnected() == false || fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected connection events: %v", events)
+	}
+	relay.Disconnect()
+	if err := relay.Reconnect(); err != errorConnectionClosed {
+		t.Errorf("Expected disconnected connection to refuse reconnecting: %v", err)
+	}
+	if _, err := cog.WaitForMessages("bot/relays/discover", 2, 50*time.Millisecond); err != errorMemoryTimeout {
+		t.Errorf("Expected clean disconnect not to publish will: %v", err)
+	}
+}
+
+func TestMemorySubscriptionFailed(t *testing.T) {
+	var failed EventInfo
+	conn := NewMemoryBroker().NewConnection()
+	conn.Connect(ConnectionOptions{
+		EventsHandler: func(conn Connection, event Event, info EventInfo) {
+			if event == SubscriptionFailedEvent {
+				failed = info
+			}
+		},
+	})
+	denied := errors.New("not authorized")
+	conn.FailSubscriptions(denied)
+	if err := conn.Subscribe("bot/relays/discover", nil); err != denied {
+		t.Errorf("Expected subscription to fail: %v", err)
+	}
+	if failed.Cause != denied || failed.Topic != "bot/relays/discover" {
+		t.Errorf("Expected SubscriptionFailedEvent for topic: %+v", failed)
+	}
+	conn.FailSubscriptions(nil)
+	if err := conn.Subscribe("bot/relays/discover", nil); err != nil {
+		t.Errorf("Expected subscription to succeed: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package bus
+
+import (
+	"github.com/operable/go-relay/relay/metrics"
+)
+
+var reconnects = metrics.NewCounter("relay_bus_reconnects_total",
+	"Successful reconnections to the message bus.")
+var busEvents = metrics.NewCounter("relay_bus_events_total",
+	"Message bus connection events, by event.", "event")
+var backoffWaits = metrics.NewCounter("relay_bus_backoff_waits_total",
+	"Backoff waits between message bus connection attempts.")
+var backoffSeconds = metrics.NewCounter("relay_bus_backoff_wait_seconds_total",
+	"Total time spent in backoff waits.")
+var failovers = metrics.NewCounter("relay_bus_failovers_total",
+	"Moves of the message bus connection to a different broker endpoint.")
+var outboxMessages = metrics.NewCounter("relay_outbox_messages_total",
+	"Messages held, flushed, expired or dropped by the outbox.", "result")
+var messagesRejected = metrics.NewCounter("relay_bus_messages_rejected_total",
+	"Received messages dropped for failing signature, replay or decryption checks.", "reason")
@@ -2,67 +2,78 @@ package bus
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/golang/snappy"
-	"io/ioutil"
+	"net/url"
+	"sync"
 	"time"
 )
 
 // MQTTConnection is a MQTT-specific implementation of
-// bus.Connection
+// bus.Connection. It reconnects on its own rather than leaving it to
+// the MQTT client so it can fail over between broker endpoints.
 type MQTTConnection struct {
-	options ConnectionOptions
-	conn    *mqtt.Client
-	backoff *Backoff
+	options      ConnectionOptions
+	clientTLS    *clientTLS
+	backoff      *Backoff
+	lock         sync.Mutex
+	conn         *mqtt.Client
+	tunnel       *mqttTunnel
+	active       Endpoint
+	failback     *time.Timer
+	reconnecting bool
+	closed       bool
 }
 
 // Connect is required by the bus.Connection interface
 func (mqc *MQTTConnection) Connect(options ConnectionOptions) error {
-	mqttOpts := mqc.buildMQTTOptions(options)
-	if err := configureSSL(options, mqttOpts); err != nil {
+	mqc.options = options
+	clientTLS, err := configureSSL(options)
+	if err != nil {
 		return err
 	}
-	if options.OnDisconnect != nil {
-		compressed := snappy.Encode(nil, []byte(options.OnDisconnect.Body))
-		mqttOpts.SetWill(options.OnDisconnect.Topic, string(compressed), 1, false)
-	}
-	if options.EventsHandler != nil && options.AutoReconnect == true {
-		mqttOpts.OnConnect = func(c *mqtt.Client) {
-			mqc.conn = c
-			mqc.options.EventsHandler(mqc, ConnectedEvent)
-		}
-	}
-	mqc.backoff = NewBackoff()
-	mqc.conn = mqtt.NewClient(mqttOpts)
-	for {
-		if token := mqc.conn.Connect(); token.Wait() && token.Error() != nil {
-			log.Errorf("Error connecting to %s: %s", brokerURL(options), token.Error())
-			mqc.backoff.Wait()
-		} else {
-			mqc.backoff.Reset()
-			break
-		}
+	mqc.clientTLS = clientTLS
+	if _, err := brokerProxy(options); err != nil {
+		return err
 	}
-	mqc.options = options
-	if mqc.options.EventsHandler != nil && mqc.options.AutoReconnect != true {
-		mqc.options.EventsHandler(mqc, ConnectedEvent)
+	mqc.backoff = NewBackoff(options.Backoff)
+	attempt, err := mqc.connectUntilDone(nil)
+	if err != nil {
+		return err
 	}
+	notify(mqc.options, mqc, ConnectedEvent, EventInfo{Attempt: attempt})
 	return nil
 }
 
 // Disconnect is required by the bus.Connection interface
 func (mqc *MQTTConnection) Disconnect() error {
-	mqc.conn.Disconnect(1000)
+	mqc.lock.Lock()
+	defer mqc.lock.Unlock()
+	mqc.closed = true
+	if mqc.failback != nil {
+		mqc.failback.Stop()
+	}
+	if mqc.conn != nil {
+		mqc.conn.Disconnect(1000)
+	}
+	if mqc.tunnel != nil {
+		return mqc.tunnel.Close()
+	}
 	return nil
 }
 
 // Publish is required by the bus.Connection interface
 func (mqc *MQTTConnection) Publish(topic string, payload []byte) error {
-	compressed := snappy.Encode(nil, payload)
-	token := mqc.conn.Publish(topic, 1, false, compressed)
+	frame, err := encodeFrame(mqc.options.Codecs, topic, payload)
+	if err != nil {
+		return err
+	}
+	client := mqc.client()
+	if client == nil || client.IsConnected() == false {
+		return errorNotConnected
+	}
+	token := client.Publish(topic, 1, false, frame)
 	token.Wait()
 	return token.Error()
 }
@@ -70,84 +81,290 @@ func (mqc *MQTTConnection) Publish(topic string, payload []byte) error {
 // Subscribe is required by the bus.Connection interface
 func (mqc *MQTTConnection) Subscribe(topic string, handler SubscriptionHandler) error {
 	mqttHandler := func(client *mqtt.Client, message mqtt.Message) {
-		compressed := message.Payload()
-		payload, err := snappy.Decode(nil, compressed)
+		payload, err := decodeFrame(mqc.options.Codecs, message.Topic(), message.Payload())
 		if err != nil {
-			log.Errorf("Decompressing MQTT payload failed: %s", err)
+			log.Errorf("Dropping MQTT message on %s: %s", message.Topic(), err)
 			return
 		}
 		handler(mqc, message.Topic(), payload)
 	}
-	token := mqc.conn.Subscribe(topic, 1, mqttHandler)
+	client := mqc.client()
+	if client == nil {
+		return errorNotConnected
+	}
+	token := client.Subscribe(topic, 1, mqttHandler)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		notify(mqc.options, mqc, SubscriptionFailedEvent, EventInfo{Cause: err, Topic: topic})
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe is required by the bus.Connection interface
+func (mqc *MQTTConnection) Unsubscribe(topic string) error {
+	client := mqc.client()
+	if client == nil {
+		return errorNotConnected
+	}
+	token := client.Unsubscribe(topic)
 	token.Wait()
 	return token.Error()
 }
 
-func (mqc *MQTTConnection) disconnected(client *mqtt.Client, err error) {
-	log.Errorf("MQTT connection failed: %s.", err)
+// IsConnected is required by the bus.Connection interface
+func (mqc *MQTTConnection) IsConnected() bool {
+	client := mqc.client()
+	return client != nil && client.IsConnected()
+}
+
+// ActiveEndpoint returns the broker the connection is using
+func (mqc *MQTTConnection) ActiveEndpoint() string {
+	mqc.lock.Lock()
+	defer mqc.lock.Unlock()
+	if mqc.conn == nil {
+		return ""
+	}
+	return mqc.active.String()
+}
+
+// BackoffState is required by the bus.BackoffReporter interface
+func (mqc *MQTTConnection) BackoffState() BackoffState {
+	return mqc.backoff.State()
+}
+
+func (mqc *MQTTConnection) client() *mqtt.Client {
+	mqc.lock.Lock()
+	defer mqc.lock.Unlock()
+	return mqc.conn
+}
+
+func (mqc *MQTTConnection) isClosed() bool {
+	mqc.lock.Lock()
+	defer mqc.lock.Unlock()
+	return mqc.closed
+}
+
+// connectUntilDone tries each endpoint in turn, backing off after
+// every full round of failures, until one accepts the connection or
+// the backoff gives up. lost is the error which broke the previous
+// connection, if any; each attempt to replace it is reported with a
+// ReconnectingEvent. Returns the number of attempts made, or
+// errorConnectionClosed if Disconnect is called first.
+func (mqc *MQTTConnection) connectUntilDone(lost error) (int, error) {
+	attempt := 0
+	cause := lost
 	for {
-		if token := mqc.conn.Connect(); token.Wait() && token.Error() != nil {
-			log.Errorf("Error connecting to %s: %s", brokerURL(mqc.options), token.Error())
-			mqc.backoff.Wait()
-		} else {
-			mqc.backoff.Reset()
-			break
+		for _, endpoint := range endpointOrder(mqc.options.endpoints(), mqc.options.Failover) {
+			if mqc.isClosed() {
+				return attempt, errorConnectionClosed
+			}
+			attempt++
+			if lost != nil {
+				notify(mqc.options, mqc, ReconnectingEvent, EventInfo{Cause: cause, Attempt: attempt})
+			}
+			client, tunnel, err := mqc.connectTo(endpoint)
+			if err == nil {
+				mqc.backoff.Reset()
+				if err := mqc.attach(client, tunnel, endpoint); err != nil {
+					return attempt, err
+				}
+				return attempt, nil
+			}
+			cause = err
+			log.Errorf("Error connecting to %s: %s", brokerURL(mqc.options.forEndpoint(endpoint)), err)
+		}
+		if err := mqc.backoff.Wait(); err != nil {
+			return attempt, err
+		}
+	}
+}
+
+// connectTo opens a new client connection to endpoint. The last will
+// is registered with each connection so it's held by whichever broker
+// the relay lands on.
+func (mqc *MQTTConnection) connectTo(endpoint Endpoint) (*mqtt.Client, *mqttTunnel, error) {
+	options := mqc.options.forEndpoint(endpoint)
+	mqttOpts := mqc.buildMQTTOptions(options)
+	var tlsConfig *tls.Config
+	if mqc.clientTLS != nil {
+		tlsConfig = mqc.clientTLS.Config()
+		if options.SSLServerName == "" {
+			tlsConfig.ServerName = endpoint.Host
 		}
+		mqttOpts.SetTLSConfig(tlsConfig)
 	}
-	if mqc.options.EventsHandler != nil {
-		mqc.options.EventsHandler(mqc, ConnectedEvent)
+	tunnel, err := configureProxy(options, mqttOpts, tlsConfig)
+	if err != nil {
+		return nil, nil, err
 	}
+	if options.OnDisconnect != nil {
+		// Codecs stamp the will when it's registered, not when the
+		// broker publishes it
+		will, err := encodeWill(options.Codecs, options.OnDisconnect.Topic, []byte(options.OnDisconnect.Body))
+		if err != nil {
+			if tunnel != nil {
+				tunnel.Close()
+			}
+			return nil, nil, err
+		}
+		mqttOpts.SetWill(options.OnDisconnect.Topic, string(will), 1, false)
+	}
+	client := mqtt.NewClient(mqttOpts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		return nil, nil, token.Error()
+	}
+	return client, tunnel, nil
+}
+
+// attach makes client the live connection. Connections to anything
+// but the primary endpoint under ordered failover schedule a check
+// for the primary's return. If Disconnect has been called client is
+// closed instead and errorConnectionClosed is returned.
+func (mqc *MQTTConnection) attach(client *mqtt.Client, tunnel *mqttTunnel, endpoint Endpoint) error {
+	mqc.lock.Lock()
+	defer mqc.lock.Unlock()
+	return mqc.attachLocked(client, tunnel, endpoint)
+}
+
+func (mqc *MQTTConnection) attachLocked(client *mqtt.Client, tunnel *mqttTunnel, endpoint Endpoint) error {
+	if mqc.closed {
+		client.Disconnect(250)
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		return errorConnectionClosed
+	}
+	if mqc.tunnel != nil {
+		mqc.tunnel.Close()
+	}
+	mqc.conn = client
+	mqc.tunnel = tunnel
+	mqc.active = endpoint
+	log.Infof("Connected to message bus at %s.", brokerURL(mqc.options.forEndpoint(endpoint)))
+	primary := mqc.options.endpoints()[0]
+	if mqc.options.Failover != RandomFailover && endpoint != primary && mqc.options.FailbackInterval > 0 {
+		mqc.failback = time.AfterFunc(mqc.options.FailbackInterval, mqc.tryFailback)
+	}
+	return nil
+}
+
+// tryFailback moves the connection back to the primary endpoint if
+// the primary accepts a new connection. The old connection is closed
+// cleanly so its broker doesn't publish the last will.
+func (mqc *MQTTConnection) tryFailback() {
+	primary := mqc.options.endpoints()[0]
+	client, tunnel, err := mqc.connectTo(primary)
+	mqc.lock.Lock()
+	if mqc.closed || mqc.reconnecting || mqc.active == primary {
+		mqc.lock.Unlock()
+		if client != nil {
+			client.Disconnect(250)
+			if tunnel != nil {
+				tunnel.Close()
+			}
+		}
+		return
+	}
+	if err != nil {
+		log.Infof("Primary message bus endpoint %s still unavailable: %s.", primary, err)
+		mqc.failback = time.AfterFunc(mqc.options.FailbackInterval, mqc.tryFailback)
+		mqc.lock.Unlock()
+		return
+	}
+	old, oldTunnel := mqc.conn, mqc.tunnel
+	mqc.tunnel = nil
+	mqc.attachLocked(client, tunnel, primary)
+	mqc.lock.Unlock()
+	old.Disconnect(250)
+	if oldTunnel != nil {
+		oldTunnel.Close()
+	}
+	failovers.Inc()
+	notify(mqc.options, mqc, ConnectedEvent, EventInfo{})
+}
+
+func (mqc *MQTTConnection) disconnected(client *mqtt.Client, err error) {
+	mqc.lock.Lock()
+	if mqc.closed || client != mqc.conn {
+		mqc.lock.Unlock()
+		return
+	}
+	previous := mqc.active
+	mqc.reconnecting = true
+	if mqc.failback != nil {
+		mqc.failback.Stop()
+	}
+	mqc.lock.Unlock()
+	log.Errorf("MQTT connection to %s failed: %s.", previous, err)
+	notify(mqc.options, mqc, DisconnectedEvent, EventInfo{Cause: err})
+	attempt, err := mqc.connectUntilDone(err)
+	mqc.lock.Lock()
+	mqc.reconnecting = false
+	mqc.lock.Unlock()
+	if err != nil {
+		if err != errorConnectionClosed {
+			giveUp(mqc.options, err)
+		}
+		return
+	}
+	mqc.lock.Lock()
+	moved := mqc.active != previous
+	mqc.lock.Unlock()
+	reconnects.Inc()
+	if moved {
+		failovers.Inc()
+	}
+	notify(mqc.options, mqc, ConnectedEvent, EventInfo{Attempt: attempt})
 }
 
 func (mqc *MQTTConnection) buildMQTTOptions(options ConnectionOptions) *mqtt.ClientOptions {
 	clientID := fmt.Sprintf("%x", time.Now().UTC().UnixNano())
 	mqttOpts := mqtt.NewClientOptions()
-	mqttOpts.SetAutoReconnect(options.AutoReconnect)
+	mqttOpts.SetAutoReconnect(false)
 	mqttOpts.SetKeepAlive(time.Duration(60) * time.Second)
 	mqttOpts.SetPingTimeout(time.Duration(15) * time.Second)
 	mqttOpts.SetUsername(options.Userid)
 	mqttOpts.SetPassword(options.Password)
 	mqttOpts.SetClientID(clientID)
 	mqttOpts.SetCleanSession(true)
-	brokerURL := brokerURL(options)
-	mqttOpts.AddBroker(brokerURL)
-	if !options.AutoReconnect {
-		mqttOpts.SetConnectionLostHandler(mqc.disconnected)
-	}
+	mqttOpts.SetConnectionLostHandler(mqc.disconnected)
 	return mqttOpts
 }
 
-func configureSSL(options ConnectionOptions, mqttOpts *mqtt.ClientOptions) error {
+func configureSSL(options ConnectionOptions) (*clientTLS, error) {
 	if !options.SSLEnabled {
-		return nil
+		return nil, nil
 	}
 	log.Info("SSL enabled on MQTT connection to Cog")
-	if options.SSLCertPath == "" {
-		log.Warn("TLS certificate verification disabled.")
-		mqttOpts.TLSConfig = tls.Config{
-			InsecureSkipVerify: true,
-		}
-	} else {
-		buf, err := ioutil.ReadFile(options.SSLCertPath)
-		if err != nil {
-			log.Errorf("Error reading TLS certificate file %s: %s.",
-				options.SSLCertPath, err)
-			return err
-		}
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM(buf)
-		if !ok {
-			log.Errorf("Failed to parse TLS certificate file %s.",
-				options.SSLCertPath)
-			return errorBadTLSCert
-		}
-		log.Info("TLS certificate verification enabled.")
-		mqttOpts.TLSConfig = tls.Config{
-			InsecureSkipVerify: false,
-			RootCAs:            roots,
-		}
+	return newClientTLS(options)
+}
+
+// configureProxy points the client at the broker, directly or through
+// a tunnel when an HTTP proxy is in play
+func configureProxy(options ConnectionOptions, mqttOpts *mqtt.ClientOptions, tlsConfig *tls.Config) (*mqttTunnel, error) {
+	proxy, err := brokerProxy(options)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if proxy == nil {
+		mqttOpts.AddBroker(brokerURL(options))
+		return nil, nil
+	}
+	broker, err := url.Parse(brokerURL(options))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Connecting to %s via proxy %s.", broker, proxy.Host)
+	tunnel, err := newMQTTTunnel(broker, proxy, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	mqttOpts.AddBroker(tunnel.URL())
+	return tunnel, nil
 }
 
 func brokerURL(options ConnectionOptions) string {
@@ -155,5 +372,12 @@ func brokerURL(options ConnectionOptions) string {
 	if options.SSLEnabled {
 		prefix = "ssl"
 	}
+	if options.WebSocket {
+		prefix = "ws"
+		if options.SSLEnabled {
+			prefix = "wss"
+		}
+		return fmt.Sprintf("%s://%s:%d%s", prefix, options.Host, options.Port, options.WebSocketPath)
+	}
 	return fmt.Sprintf("%s://%s:%d", prefix, options.Host, options.Port)
 }
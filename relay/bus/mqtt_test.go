@@ -0,0 +1,144 @@
+package bus
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// deadEndpoint returns an endpoint nothing is listening on
+func deadEndpoint(t *testing.T) Endpoint {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return Endpoint{"127.0.0.1", listener.Addr().(*net.TCPAddr).Port}
+}
+
+// startMQTTBroker accepts MQTT connections and acks their CONNECT
+// packet. Anything sent afterwards is ignored.
+func startMQTTBroker(t *testing.T) (Endpoint, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reader := bufio.NewReader(conn)
+				if _, err := reader.ReadByte(); err != nil {
+					return
+				}
+				length, multiplier := 0, 1
+				for {
+					digit, err := reader.ReadByte()
+					if err != nil {
+						return
+					}
+					length += int(digit&127) * multiplier
+					multiplier *= 128
+					if digit&128 == 0 {
+						break
+					}
+				}
+				if _, err := io.CopyN(ioutil.Discard, reader, int64(length)); err != nil {
+					return
+				}
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				io.Copy(ioutil.Discard, reader)
+			}()
+		}
+	}()
+	return Endpoint{"127.0.0.1", listener.Addr().(*net.TCPAddr).Port}, listener
+}
+
+func TestMQTTPublishBeforeConnect(t *testing.T) {
+	conn := &MQTTConnection{}
+	if err := conn.Publish("bot/relays/foo/exec", []byte("hello")); err != errorNotConnected {
+		t.Errorf("Expected publishing before connecting to fail: %v", err)
+	}
+	if err := conn.Subscribe("bot/relays/foo/exec", nil); err != errorNotConnected {
+		t.Errorf("Expected subscribing before connecting to fail: %v", err)
+	}
+}
+
+func TestMQTTDisconnectWhileReconnecting(t *testing.T) {
+	events := make(chan Event, 16)
+	gaveUp := make(chan error, 1)
+	options := ConnectionOptions{
+		Endpoints: []Endpoint{deadEndpoint(t)},
+		Backoff: BackoffOptions{
+			Base: time.Duration(10) * time.Millisecond,
+			Cap:  time.Duration(10) * time.Millisecond,
+		},
+		EventsHandler: func(conn Connection, event Event, info EventInfo) {
+			select {
+			case events <- event:
+			default:
+			}
+		},
+		OnGiveUp: func(err error) {
+			gaveUp <- err
+		},
+	}
+	conn := &MQTTConnection{
+		options: options,
+		backoff: NewBackoff(options.Backoff),
+	}
+	done := make(chan bool)
+	go func() {
+		conn.disconnected(nil, errors.New("connection reset"))
+		close(done)
+	}()
+	for event := range events {
+		if event == ReconnectingEvent {
+			break
+		}
+	}
+	conn.Disconnect()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(2) * time.Second):
+		t.Fatal("Expected Disconnect to stop reconnecting")
+	}
+	select {
+	case err := <-gaveUp:
+		t.Errorf("Expected Disconnect not to be reported as giving up: %v", err)
+	default:
+	}
+}
+
+func TestMQTTAttachAfterDisconnect(t *testing.T) {
+	broker, listener := startMQTTBroker(t)
+	defer listener.Close()
+	conn := &MQTTConnection{
+		options: ConnectionOptions{
+			Endpoints:        []Endpoint{deadEndpoint(t), broker},
+			Failover:         OrderedFailover,
+			FailbackInterval: time.Minute,
+		},
+	}
+	client, tunnel, err := conn.connectTo(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	if err := conn.attach(client, tunnel, broker); err != errorConnectionClosed {
+		t.Errorf("Expected attaching to a closed connection to fail: %v", err)
+	}
+	if conn.IsConnected() || client.IsConnected() {
+		t.Errorf("Expected client connected after Disconnect to be closed")
+	}
+	if conn.failback != nil {
+		t.Errorf("Expected no failback to be scheduled on a closed connection")
+	}
+}
@@ -0,0 +1,517 @@
+package bus
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsKeepAlive is how often the client pings the server. Two
+// unanswered pings drop the connection.
+var natsKeepAlive = time.Duration(60) * time.Second
+
+// natsConnectTimeout bounds dialing and the protocol handshake
+var natsConnectTimeout = time.Duration(15) * time.Second
+
+var errorNATSRequiresTLS = errors.New("NATS server requires TLS; set cog/enable_ssl")
+var errorBadNATSTopic = errors.New("Topic can't be mapped to a NATS subject")
+var errorNATSPayloadTooLarge = errors.New("Message is larger than the NATS server's max_payload")
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+type natsSubscription struct {
+	sid     string
+	topic   string
+	handler SubscriptionHandler
+}
+
+// NATSConnection is a NATS-specific implementation of bus.Connection
+// which speaks the NATS client protocol directly. Topics are mapped to
+// subjects with NATSSubject. NATS has no last will, so OnDisconnect is
+// published when a lost connection is re-established; a Relay which
+// never comes back relies on Cog noticing it has gone quiet.
+type NATSConnection struct {
+	options   ConnectionOptions
+	clientTLS *clientTLS
+	backoff   *Backoff
+	lock      sync.Mutex
+	conn      net.Conn
+	writer    *bufio.Writer
+	subs      map[string]*natsSubscription
+	nextSID   int
+	pings     int
+	info      natsInfo
+	active    Endpoint
+	connected bool
+	closed    bool
+}
+
+// NATSSubject maps an MQTT style topic to a NATS subject. Levels are
+// separated by '.', the MQTT wildcards '+' and '#' become '*' and '>'
+// and a leading slash becomes a "/" token, so /bot/commands/abc/#
+// maps to /.bot.commands.abc.>. Topics with empty levels, levels
+// containing '.' or whitespace, or literal '*' and '>' levels have
+// no NATS equivalent and are rejected.
+func NATSSubject(topic string) (string, error) {
+	prefix := []string{}
+	if strings.HasPrefix(topic, "/") {
+		prefix = append(prefix, "/")
+		topic = topic[1:]
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch {
+		case level == "+":
+			levels[i] = "*"
+		case level == "#":
+			levels[i] = ">"
+		case level == "", level == "*", level == ">", strings.ContainsAny(level, ". \t\r\n"):
+			return "", errorBadNATSTopic
+		}
+	}
+	return strings.Join(append(prefix, levels...), "."), nil
+}
+
+// MQTTTopic maps a NATS subject produced by NATSSubject back to its
+// MQTT style topic
+func MQTTTopic(subject string) string {
+	tokens := strings.Split(subject, ".")
+	prefix := ""
+	if tokens[0] == "/" {
+		prefix = "/"
+		tokens = tokens[1:]
+	}
+	for i, token := range tokens {
+		switch token {
+		case "*":
+			tokens[i] = "+"
+		case ">":
+			tokens[i] = "#"
+		}
+	}
+	return prefix + strings.Join(tokens, "/")
+}
+
+// Connect is required by the bus.Connection interface
+func (nc *NATSConnection) Connect(options ConnectionOptions) error {
+	nc.options = options
+	nc.subs = make(map[string]*natsSubscription)
+	nc.backoff = NewBackoff(options.Backoff)
+	if options.SSLEnabled {
+		log.Info("SSL enabled on NATS connection to Cog")
+		clientTLS, err := newClientTLS(options)
+		if err != nil {
+			return err
+		}
+		nc.clientTLS = clientTLS
+	}
+	attempt, err := nc.connectUntilDone(nil)
+	if err != nil {
+		return err
+	}
+	notify(options, nc, ConnectedEvent, EventInfo{Attempt: attempt})
+	return nil
+}
+
+// Disconnect is required by the bus.Connection interface
+func (nc *NATSConnection) Disconnect() error {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	nc.closed = true
+	nc.connected = false
+	if nc.conn != nil {
+		nc.writer.Flush()
+		return nc.conn.Close()
+	}
+	return nil
+}
+
+// Publish is required by the bus.Connection interface
+func (nc *NATSConnection) Publish(topic string, payload []byte) error {
+	subject, err := NATSSubject(topic)
+	if err != nil {
+		return err
+	}
+	frame, err := encodeFrame(nc.options.Codecs, topic, payload)
+	if err != nil {
+		return err
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if nc.connected == false {
+		return errorNotConnected
+	}
+	// The server drops connections which publish more than this
+	if nc.info.MaxPayload > 0 && len(frame) > nc.info.MaxPayload {
+		return errorNATSPayloadTooLarge
+	}
+	fmt.Fprintf(nc.writer, "PUB %s %d\r\n", subject, len(frame))
+	nc.writer.Write(frame)
+	nc.writer.WriteString("\r\n")
+	return nc.writer.Flush()
+}
+
+// Subscribe is required by the bus.Connection interface. Subscribing
+// to a topic twice replaces its handler.
+func (nc *NATSConnection) Subscribe(topic string, handler SubscriptionHandler) error {
+	err := nc.subscribe(topic, handler)
+	if err != nil {
+		notify(nc.options, nc, SubscriptionFailedEvent, EventInfo{Cause: err, Topic: topic})
+	}
+	return err
+}
+
+func (nc *NATSConnection) subscribe(topic string, handler SubscriptionHandler) error {
+	subject, err := NATSSubject(topic)
+	if err != nil {
+		return err
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	for _, sub := range nc.subs {
+		if sub.topic == topic {
+			sub.handler = handler
+			return nil
+		}
+	}
+	nc.nextSID++
+	sub := &natsSubscription{
+		sid:     strconv.Itoa(nc.nextSID),
+		topic:   topic,
+		handler: handler,
+	}
+	nc.subs[sub.sid] = sub
+	if nc.connected == false {
+		return nil
+	}
+	fmt.Fprintf(nc.writer, "SUB %s %s\r\n", subject, sub.sid)
+	return nc.writer.Flush()
+}
+
+// Unsubscribe is required by the bus.Connection interface
+func (nc *NATSConnection) Unsubscribe(topic string) error {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	for sid, sub := range nc.subs {
+		if sub.topic == topic {
+			delete(nc.subs, sid)
+			if nc.connected == false {
+				return nil
+			}
+			fmt.Fprintf(nc.writer, "UNSUB %s\r\n", sid)
+			return nc.writer.Flush()
+		}
+	}
+	return nil
+}
+
+// IsConnected is required by the bus.Connection interface
+func (nc *NATSConnection) IsConnected() bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	return nc.connected
+}
+
+// ActiveEndpoint returns the server the connection is using
+func (nc *NATSConnection) ActiveEndpoint() string {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if nc.connected == false {
+		return ""
+	}
+	return nc.active.String()
+}
+
+// BackoffState is required by the bus.BackoffReporter interface
+func (nc *NATSConnection) BackoffState() BackoffState {
+	return nc.backoff.State()
+}
+
+// connectUntilDone tries each endpoint in turn, backing off after
+// every full round of failures, until it connects, Disconnect is
+// called or the backoff gives up. lost is the error which broke the
+// previous connection, if any; each attempt to replace it is reported
+// with a ReconnectingEvent. Returns the number of attempts made.
+func (nc *NATSConnection) connectUntilDone(lost error) (int, error) {
+	attempt := 0
+	cause := lost
+	for {
+		for _, endpoint := range endpointOrder(nc.options.endpoints(), nc.options.Failover) {
+			if nc.isClosed() {
+				return attempt, errorConnectionClosed
+			}
+			attempt++
+			if lost != nil {
+				notify(nc.options, nc, ReconnectingEvent, EventInfo{Cause: cause, Attempt: attempt})
+			}
+			conn, reader, info, err := nc.dial(endpoint)
+			if err == nil {
+				nc.backoff.Reset()
+				if err := nc.attach(conn, reader, endpoint, info); err != nil {
+					return attempt, err
+				}
+				return attempt, nil
+			}
+			cause = err
+			log.Errorf("Error connecting to %s: %s", endpoint, err)
+		}
+		if err := nc.backoff.Wait(); err != nil {
+			return attempt, err
+		}
+	}
+}
+
+// dial opens a connection and completes the NATS handshake. Returns
+// the server's INFO.
+func (nc *NATSConnection) dial(endpoint Endpoint) (net.Conn, *bufio.Reader, natsInfo, error) {
+	info := natsInfo{}
+	conn, err := net.DialTimeout("tcp", endpoint.String(), natsConnectTimeout)
+	if err != nil {
+		return nil, nil, info, err
+	}
+	conn.SetDeadline(time.Now().Add(natsConnectTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, info, err
+	}
+	if strings.HasPrefix(line, "INFO ") == false {
+		conn.Close()
+		return nil, nil, info, fmt.Errorf("Unexpected NATS greeting: %s", strings.TrimSpace(line))
+	}
+	json.Unmarshal([]byte(line[5:]), &info)
+	if nc.options.SSLEnabled {
+		tlsConfig := nc.clientTLS.Config()
+		if nc.options.SSLServerName == "" {
+			tlsConfig.ServerName = endpoint.Host
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, info, err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	} else if info.TLSRequired {
+		conn.Close()
+		return nil, nil, info, errorNATSRequiresTLS
+	}
+	connect, _ := json.Marshal(natsConnect{
+		User:     nc.options.Userid,
+		Pass:     nc.options.Password,
+		Name:     nc.options.Userid,
+		Lang:     "go",
+		Version:  "1",
+		Protocol: 1,
+	})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return nil, nil, info, err
+	}
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, info, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, nil, info, fmt.Errorf("NATS server rejected connection: %s", strings.TrimSpace(line[4:]))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, info, nil
+}
+
+// attach makes conn the live connection, restores subscriptions and
+// starts its reader and keepalive goroutines
+func (nc *NATSConnection) attach(conn net.Conn, reader *bufio.Reader, endpoint Endpoint, info natsInfo) error {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if nc.closed {
+		conn.Close()
+		return errorConnectionClosed
+	}
+	log.Infof("Connected to NATS at %s.", endpoint)
+	nc.conn = conn
+	nc.info = info
+	nc.active = endpoint
+	nc.writer = bufio.NewWriter(conn)
+	nc.pings = 0
+	nc.connected = true
+	for sid, sub := range nc.subs {
+		// Topics were mapped successfully when they were subscribed to
+		subject, _ := NATSSubject(sub.topic)
+		fmt.Fprintf(nc.writer, "SUB %s %s\r\n", subject, sid)
+	}
+	nc.writer.Flush()
+	go nc.readLoop(conn, reader)
+	go nc.pingLoop(conn)
+	return nil
+}
+
+func (nc *NATSConnection) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			nc.connectionLost(conn, err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line[4:])
+			if len(fields) != 3 && len(fields) != 4 {
+				nc.connectionLost(conn, fmt.Errorf("Malformed NATS message header: %s", line))
+				return
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				nc.connectionLost(conn, fmt.Errorf("Malformed NATS message header: %s", line))
+				return
+			}
+			frame := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				nc.connectionLost(conn, err)
+				return
+			}
+			nc.deliver(fields[1], fields[0], frame[:size])
+		case line == "PING":
+			nc.lock.Lock()
+			if nc.conn == conn {
+				nc.writer.WriteString("PONG\r\n")
+				nc.writer.Flush()
+			}
+			nc.lock.Unlock()
+		case line == "PONG":
+			nc.lock.Lock()
+			nc.pings = 0
+			nc.lock.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			message := strings.Trim(strings.TrimSpace(line[4:]), "'")
+			log.Errorf("NATS server error: %s", message)
+			if subject := natsDeniedSubject(message); subject != "" {
+				notify(nc.options, nc, SubscriptionFailedEvent, EventInfo{
+					Cause: errors.New(message),
+					Topic: MQTTTopic(subject),
+				})
+			}
+		}
+	}
+}
+
+func (nc *NATSConnection) deliver(sid string, subject string, frame []byte) {
+	nc.lock.Lock()
+	sub := nc.subs[sid]
+	nc.lock.Unlock()
+	if sub == nil {
+		return
+	}
+	topic := MQTTTopic(subject)
+	payload, err := decodeFrame(nc.options.Codecs, topic, frame)
+	if err != nil {
+		log.Errorf("Dropping NATS message on %s: %s", topic, err)
+		return
+	}
+	sub.handler(nc, topic, payload)
+}
+
+func (nc *NATSConnection) pingLoop(conn net.Conn) {
+	ticker := time.NewTicker(natsKeepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		nc.lock.Lock()
+		if nc.conn != conn || nc.closed {
+			nc.lock.Unlock()
+			return
+		}
+		if nc.pings >= 2 {
+			nc.lock.Unlock()
+			// Unblocks readLoop, which reconnects
+			conn.Close()
+			return
+		}
+		nc.pings++
+		nc.writer.WriteString("PING\r\n")
+		nc.writer.Flush()
+		nc.lock.Unlock()
+	}
+}
+
+// connectionLost reconnects after the live connection fails, then
+// publishes the last will and reports a ConnectedEvent
+func (nc *NATSConnection) connectionLost(conn net.Conn, err error) {
+	nc.lock.Lock()
+	if nc.closed || nc.conn != conn {
+		nc.lock.Unlock()
+		return
+	}
+	nc.connected = false
+	conn.Close()
+	nc.lock.Unlock()
+	log.Errorf("NATS connection failed: %s.", err)
+	notify(nc.options, nc, DisconnectedEvent, EventInfo{Cause: err})
+	attempt, err := nc.connectUntilDone(err)
+	if err != nil {
+		if err != errorConnectionClosed {
+			giveUp(nc.options, err)
+		}
+		return
+	}
+	reconnects.Inc()
+	if will := nc.options.OnDisconnect; will != nil {
+		if err := nc.Publish(will.Topic, []byte(will.Body)); err != nil {
+			log.Errorf("Publishing last will after reconnecting failed: %s.", err)
+		}
+	}
+	notify(nc.options, nc, ConnectedEvent, EventInfo{Attempt: attempt})
+}
+
+// natsDeniedSubject returns the subject named by a server's
+// subscription permissions violation, or "" for any other error
+func natsDeniedSubject(message string) string {
+	const prefix = "Permissions Violation for Subscription to "
+	if strings.HasPrefix(message, prefix) == false {
+		return ""
+	}
+	fields := strings.Fields(message[len(prefix):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], "\"")
+}
+
+func (nc *NATSConnection) isClosed() bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	return nc.closed
+}
@@ -0,0 +1,422 @@
+package bus
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsTestServer speaks just enough of the NATS server protocol to
+// route messages between test clients
+type natsTestServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	clients  map[net.Conn]map[string]string
+}
+
+func newNATSTestServer(t *testing.T) *natsTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &natsTestServer{
+		listener: listener,
+		clients:  make(map[net.Conn]map[string]string),
+	}
+	go server.accept()
+	return server
+}
+
+func (s *natsTestServer) options(userid string) ConnectionOptions {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return ConnectionOptions{
+		Transport: NATSTransport,
+		Userid:    userid,
+		Host:      "127.0.0.1",
+		Port:      addr.Port,
+	}
+}
+
+func (s *natsTestServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.clients[conn] = make(map[string]string)
+		s.lock.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *natsTestServer) serve(conn net.Conn) {
+	defer s.drop(conn)
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			s.write(conn, "PONG\r\n")
+		case "SUB":
+			s.lock.Lock()
+			s.clients[conn][fields[2]] = fields[1]
+			s.lock.Unlock()
+		case "UNSUB":
+			s.lock.Lock()
+			delete(s.clients[conn], fields[1])
+			s.lock.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			s.route(fields[1], payload[:size])
+		}
+	}
+}
+
+func (s *natsTestServer) route(subject string, payload []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn, subs := range s.clients {
+		for sid, pattern := range subs {
+			if natsSubjectMatches(pattern, subject) {
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+			}
+		}
+	}
+}
+
+func (s *natsTestServer) write(conn net.Conn, data string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conn.Write([]byte(data))
+}
+
+func (s *natsTestServer) drop(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, conn)
+	conn.Close()
+}
+
+func (s *natsTestServer) close() {
+	s.listener.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.clients {
+		conn.Close()
+	}
+}
+
+func natsSubjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+type receivedMessage struct {
+	topic   string
+	payload string
+}
+
+func collect(messages chan receivedMessage) SubscriptionHandler {
+	return func(conn Connection, topic string, payload []byte) {
+		messages <- receivedMessage{topic: topic, payload: string(payload)}
+	}
+}
+
+func expectMessage(t *testing.T, messages chan receivedMessage, topic string, payload string) {
+	select {
+	case msg := <-messages:
+		if msg.topic != topic || msg.payload != payload {
+			t.Errorf("Unexpected message on %s: %s", msg.topic, msg.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for message on %s", topic)
+	}
+}
+
+func TestNATSSubject(t *testing.T) {
+	if subject, _ := NATSSubject("/bot/commands/abc/#"); subject != "/.bot.commands.abc.>" {
+		t.Errorf("Unexpected subject for command topic: %s", subject)
+	}
+	if subject, _ := NATSSubject("bot/relays/+/announcer"); subject != "bot.relays.*.announcer" {
+		t.Errorf("Unexpected subject for single level wildcard: %s", subject)
+	}
+	if topic := MQTTTopic("bot.commands.abc.ec2.list"); topic != "bot/commands/abc/ec2/list" {
+		t.Errorf("Unexpected topic for subject: %s", topic)
+	}
+}
+
+func TestNATSSubjectRoundTrip(t *testing.T) {
+	topics := []string{
+		"/bot/commands/abc/#",
+		"/bot/pipelines/abc/reply",
+		"bot/relays/+/announcer",
+		"bot/relays/abc/directives",
+		"/+/x",
+		"#",
+	}
+	for _, topic := range topics {
+		subject, err := NATSSubject(topic)
+		if err != nil {
+			t.Errorf("Unexpected error mapping %s: %s", topic, err)
+			continue
+		}
+		if roundTrip := MQTTTopic(subject); roundTrip != topic {
+			t.Errorf("Expected %s to survive mapping through %s: %s", topic, subject, roundTrip)
+		}
+	}
+	for _, topic := range []string{"bot/ec2.list", "bot/relays/", "bot//relays", "/", "bot/*", "bot/>", "bot/a b"} {
+		if _, err := NATSSubject(topic); err != errorBadNATSTopic {
+			t.Errorf("Expected %q to be rejected: %v", topic, err)
+		}
+	}
+}
+
+func TestNATSPublishSubscribe(t *testing.T) {
+	server := newNATSTestServer(t)
+	defer server.close()
+	conn, err := NewConnection(NATSTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Connect(server.options("relay")); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	if conn.IsConnected() == false {
+		t.Error("Expected connection to be connected")
+	}
+	messages := make(chan receivedMessage, 4)
+	if err := conn.Subscribe("/bot/commands/abc/#", collect(messages)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*NATSConnection).flushPing(t)
+	if err := conn.Publish("/bot/commands/abc/ec2/list", []byte("{\"id\":1}")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, messages, "/bot/commands/abc/ec2/list", "{\"id\":1}")
+	if err := conn.Unsubscribe("/bot/commands/abc/#"); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*NATSConnection).flushPing(t)
+	conn.Publish("/bot/commands/abc/ec2/list", []byte("dropped"))
+	select {
+	case msg := <-messages:
+		t.Errorf("Unexpected message after unsubscribing: %s", msg.payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNATSWillOnReconnect(t *testing.T) {
+	server := newNATSTestServer(t)
+	defer server.close()
+	observer := &NATSConnection{}
+	if err := observer.Connect(server.options("observer")); err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Disconnect()
+	wills := make(chan receivedMessage, 4)
+	observer.Subscribe("bot/relays/discover", collect(wills))
+	observer.flushPing(t)
+
+	events := make(chan Event, 8)
+	options := server.options("relay")
+	options.OnDisconnect = &DisconnectMessage{
+		Topic: "bot/relays/discover",
+		Body:  "offline",
+	}
+	options.EventsHandler = func(conn Connection, event Event, info EventInfo) {
+		events <- event
+	}
+	relay := &NATSConnection{}
+	if err := relay.Connect(options); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Disconnect()
+	waitForEvent(t, events, ConnectedEvent)
+	commands := make(chan receivedMessage, 4)
+	relay.Subscribe("bot/commands/relay/#", collect(commands))
+	relay.flushPing(t)
+
+	// Sever only the relay's connection so the observer stays subscribed
+	relay.lock.Lock()
+	relay.conn.Close()
+	relay.lock.Unlock()
+	seen := waitForEvent(t, events, ConnectedEvent)
+	if len(seen) != 3 || seen[0] != DisconnectedEvent || seen[1] != ReconnectingEvent {
+		t.Errorf("Unexpected events while reconnecting: %v", seen)
+	}
+	expectMessage(t, wills, "bot/relays/discover", "offline")
+	relay.flushPing(t)
+	if err := observer.Publish("bot/commands/relay/ping", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, commands, "bot/commands/relay/ping", "hello")
+}
+
+// waitForEvent returns the events received up to and including want
+func waitForEvent(t *testing.T, events chan Event, want Event) []Event {
+	seen := []Event{}
+	for {
+		select {
+		case event := <-events:
+			seen = append(seen, event)
+			if event == want {
+				return seen
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s event: %v", want, seen)
+		}
+	}
+}
+
+// flushPing round trips a PING so earlier commands have been processed
+// by the server
+// startNATSServer runs a real NATS server with config on a free port.
+// Tests using it are skipped unless nats-server or gnatsd is on PATH.
+func startNATSServer(t *testing.T, config string) (ConnectionOptions, func()) {
+	binary := ""
+	for _, name := range []string{"nats-server", "gnatsd"} {
+		if found, err := exec.LookPath(name); err == nil {
+			binary = found
+			break
+		}
+	}
+	if binary == "" {
+		t.Skip("nats-server or gnatsd not found on PATH")
+	}
+	dir, err := ioutil.TempDir("", "nats-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := path.Join(dir, "nats.conf")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := exec.Command(binary, "-c", configPath, "-a", "127.0.0.1", "-p", strconv.Itoa(port))
+	if err := server.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		server.Process.Kill()
+		server.Wait()
+		os.RemoveAll(dir)
+	}
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			conn.Close()
+			return ConnectionOptions{
+				Transport: NATSTransport,
+				Host:      "127.0.0.1",
+				Port:      port,
+				Backoff: BackoffOptions{
+					Base:        time.Duration(10) * time.Millisecond,
+					MaxAttempts: 1,
+				},
+			}, stop
+		}
+		time.Sleep(time.Duration(50) * time.Millisecond)
+	}
+	stop()
+	t.Fatal("Timed out waiting for NATS server to start")
+	return ConnectionOptions{}, nil
+}
+
+func TestNATSRealServer(t *testing.T) {
+	options, stop := startNATSServer(t, "max_payload: 1024\nauthorization {\n  user: relay\n  password: sekrit\n}\n")
+	defer stop()
+	options.Userid = "relay"
+	options.Password = "wrong"
+	if err := new(NATSConnection).Connect(options); err == nil {
+		t.Error("Expected server to reject bad credentials")
+	}
+	options.Password = "sekrit"
+	conn := &NATSConnection{}
+	if err := conn.Connect(options); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	messages := make(chan receivedMessage, 4)
+	if err := conn.Subscribe("/bot/commands/abc/#", collect(messages)); err != nil {
+		t.Fatal(err)
+	}
+	conn.flushPing(t)
+	if err := conn.Publish("/bot/commands/abc/ec2/list", []byte("{\"id\":1}")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, messages, "/bot/commands/abc/ec2/list", "{\"id\":1}")
+	// Random so compression can't bring it under the limit
+	large := make([]byte, 2048)
+	rand.Read(large)
+	if err := conn.Publish("/bot/commands/abc/ec2/list", large); err != errorNATSPayloadTooLarge {
+		t.Errorf("Expected publish over max_payload to be refused: %v", err)
+	}
+	// A server which saw the oversized message would have disconnected
+	conn.flushPing(t)
+	if err := conn.Publish("/bot/commands/abc/ec2/list", []byte("{\"id\":2}")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, messages, "/bot/commands/abc/ec2/list", "{\"id\":2}")
+}
+
+func (nc *NATSConnection) flushPing(t *testing.T) {
+	nc.lock.Lock()
+	nc.pings++
+	nc.writer.WriteString("PING\r\n")
+	nc.writer.Flush()
+	nc.lock.Unlock()
+	for i := 0; i < 500; i++ {
+		nc.lock.Lock()
+		pending := nc.pings
+		nc.lock.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for PONG")
+}
@@ -0,0 +1,332 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+var errorOutboxFull = errors.New("Outbox is full")
+
+// outboxRetryBase and outboxRetryCap bound the delay before retrying
+// a flush which failed while the connection was up
+var outboxRetryBase = time.Second
+var outboxRetryCap = time.Duration(30) * time.Second
+
+type outboxEntry struct {
+	Topic   string    `json:"topic"`
+	Payload []byte    `json:"payload"`
+	Queued  time.Time `json:"queued"`
+}
+
+// outboxRemoval records messages removed from the front of the outbox
+type outboxRemoval struct {
+	Removed int `json:"removed"`
+}
+
+// outboxRecord is one line of the outbox file, either a held message
+// or a removal
+type outboxRecord struct {
+	Topic   string    `json:"topic"`
+	Payload []byte    `json:"payload"`
+	Queued  time.Time `json:"queued"`
+	Removed int       `json:"removed"`
+}
+
+// Outbox is a MessagePublisher which holds messages that couldn't be
+// published. Held messages are flushed when the connection is
+// re-established, or after a backoff if publishing failed while the
+// connection was up. Messages are flushed in the order they were
+// published; ones older than the TTL are dropped. When a path is set
+// the outbox is persisted to disk so it survives a restart. The file
+// is appended to as messages are held and removed and is rewritten
+// once it holds twice capacity records.
+type Outbox struct {
+	conn       Connection
+	capacity   int
+	ttl        time.Duration
+	path       string
+	lock       sync.Mutex
+	entries    []outboxEntry
+	flushing   bool
+	file       *os.File
+	records    int
+	retry      *time.Timer
+	retryDelay time.Duration
+	closed     bool
+}
+
+// NewOutbox returns an Outbox publishing on conn. Messages left in
+// the file at path by a previous run are loaded.
+func NewOutbox(conn Connection, capacity int, ttl time.Duration, path string) (*Outbox, error) {
+	outbox := &Outbox{
+		conn:     conn,
+		capacity: capacity,
+		ttl:      ttl,
+		path:     path,
+	}
+	if path != "" {
+		if err := outbox.load(); err != nil {
+			return nil, err
+		}
+		if len(outbox.entries) > 0 {
+			log.Infof("Loaded %d unsent messages from %s.", len(outbox.entries), path)
+		}
+		outbox.compact()
+	}
+	return outbox, nil
+}
+
+// Publish is required by the bus.MessagePublisher interface. Messages
+// queue behind any already held so they're delivered in order.
+// Returns an error only when the message had to be dropped.
+func (o *Outbox) Publish(topic string, payload []byte) error {
+	o.lock.Lock()
+	held := len(o.entries) > 0
+	o.lock.Unlock()
+	if held == false && o.conn.IsConnected() {
+		if err := o.conn.Publish(topic, payload); err == nil {
+			return nil
+		}
+	}
+	if err := o.hold(topic, payload); err != nil {
+		return err
+	}
+	// Reconnecting flushes the outbox; a live connection needs a retry
+	if o.conn.IsConnected() {
+		o.scheduleRetry()
+	}
+	return nil
+}
+
+// Len returns the number of held messages
+func (o *Outbox) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.entries)
+}
+
+// Close stops retrying and closes the outbox file. Held messages stay
+// on disk for the next run.
+func (o *Outbox) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = true
+	if o.retry != nil {
+		o.retry.Stop()
+		o.retry = nil
+	}
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+// Flush publishes held messages in order, dropping expired ones. It
+// stops at the first failure, leaving the rest for the next call or,
+// if the connection is still up, for a retry after a backoff.
+func (o *Outbox) Flush() {
+	o.lock.Lock()
+	if o.flushing {
+		o.lock.Unlock()
+		return
+	}
+	o.flushing = true
+	o.lock.Unlock()
+	defer func() {
+		o.lock.Lock()
+		o.flushing = false
+		o.lock.Unlock()
+	}()
+	flushed := 0
+	for {
+		o.lock.Lock()
+		o.dropExpired(time.Now())
+		if len(o.entries) == 0 {
+			o.lock.Unlock()
+			break
+		}
+		entry := o.entries[0]
+		o.lock.Unlock()
+		if err := o.conn.Publish(entry.Topic, entry.Payload); err != nil {
+			log.Errorf("Flushing outbox stopped with %d messages left: %s.", o.Len(), err)
+			if o.conn.IsConnected() {
+				o.scheduleRetry()
+			}
+			return
+		}
+		o.lock.Lock()
+		o.entries = o.entries[1:]
+		o.removed(1)
+		o.lock.Unlock()
+		outboxMessages.Inc("flushed")
+		flushed++
+	}
+	o.lock.Lock()
+	o.retryDelay = 0
+	o.lock.Unlock()
+	if flushed > 0 {
+		log.Infof("Flushed %d held messages from outbox.", flushed)
+	}
+}
+
+func (o *Outbox) hold(topic string, payload []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.dropExpired(time.Now())
+	if len(o.entries) >= o.capacity {
+		outboxMessages.Inc("dropped")
+		log.Errorf("Dropping message to %s: outbox holds %d messages.", topic, len(o.entries))
+		return errorOutboxFull
+	}
+	entry := outboxEntry{
+		Topic:   topic,
+		Payload: payload,
+		Queued:  time.Now(),
+	}
+	o.entries = append(o.entries, entry)
+	o.appendRecord(entry)
+	outboxMessages.Inc("held")
+	return nil
+}
+
+// scheduleRetry flushes the outbox after a delay which doubles with
+// each retry, up to outboxRetryCap, until a flush succeeds
+func (o *Outbox) scheduleRetry() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.retry != nil || o.closed {
+		return
+	}
+	if o.retryDelay == 0 {
+		o.retryDelay = outboxRetryBase
+	} else if o.retryDelay *= 2; o.retryDelay > outboxRetryCap {
+		o.retryDelay = outboxRetryCap
+	}
+	log.Infof("Retrying outbox flush in %v.", o.retryDelay)
+	o.retry = time.AfterFunc(o.retryDelay, func() {
+		o.lock.Lock()
+		o.retry = nil
+		o.lock.Unlock()
+		o.Flush()
+	})
+}
+
+// dropExpired must be called with the lock held
+func (o *Outbox) dropExpired(now time.Time) {
+	expired := 0
+	for expired < len(o.entries) && now.Sub(o.entries[expired].Queued) > o.ttl {
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	log.Warnf("Dropping %d outbox messages older than %v.", expired, o.ttl)
+	o.entries = o.entries[expired:]
+	outboxMessages.Add(float64(expired), "expired")
+	o.removed(expired)
+}
+
+// removed records that count messages were taken from the front of the
+// outbox. Must be called with the lock held.
+func (o *Outbox) removed(count int) {
+	o.appendRecord(outboxRemoval{Removed: count})
+	if o.records >= 2*o.capacity {
+		o.compact()
+	}
+}
+
+// appendRecord adds a line to the outbox file. Must be called with the
+// lock held.
+func (o *Outbox) appendRecord(record interface{}) {
+	if o.path == "" || o.closed {
+		return
+	}
+	if o.file == nil {
+		file, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Errorf("Persisting outbox failed: %s.", err)
+			return
+		}
+		o.file = file
+	}
+	// Encode writes each record with a single write
+	if err := json.NewEncoder(o.file).Encode(record); err != nil {
+		log.Errorf("Persisting outbox failed: %s.", err)
+		return
+	}
+	o.records++
+}
+
+// compact rewrites the outbox file with just the held messages. Must
+// be called with the lock held.
+func (o *Outbox) compact() {
+	if o.path == "" || o.closed {
+		return
+	}
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	tmpPath := o.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("Persisting outbox failed: %s.", err)
+		return
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range o.entries {
+		encoder.Encode(entry)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		log.Errorf("Persisting outbox failed: %s.", err)
+		return
+	}
+	file.Close()
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		log.Errorf("Persisting outbox failed: %s.", err)
+		return
+	}
+	o.records = len(o.entries)
+}
+
+func (o *Outbox) load() error {
+	file, err := os.Open(o.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		record := outboxRecord{}
+		if err := decoder.Decode(&record); err != nil {
+			log.Errorf("Ignoring corrupt outbox file %s after %d messages: %s.", o.path, len(o.entries), err)
+			break
+		}
+		if record.Removed > 0 {
+			if record.Removed > len(o.entries) {
+				record.Removed = len(o.entries)
+			}
+			o.entries = o.entries[record.Removed:]
+			continue
+		}
+		o.entries = append(o.entries, outboxEntry{
+			Topic:   record.Topic,
+			Payload: record.Payload,
+			Queued:  record.Queued,
+		})
+	}
+	if len(o.entries) > o.capacity {
+		o.entries = o.entries[len(o.entries)-o.capacity:]
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package bus
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyConnection records publishes and fails them while down or
+// while failures are pending
+type flakyConnection struct {
+	lock      sync.Mutex
+	down      bool
+	failures  int
+	published []string
+}
+
+func (fc *flakyConnection) Connect(options ConnectionOptions) error                   { return nil }
+func (fc *flakyConnection) Disconnect() error                                         { return nil }
+func (fc *flakyConnection) Subscribe(topic string, handler SubscriptionHandler) error { return nil }
+func (fc *flakyConnection) Unsubscribe(topic string) error                            { return nil }
+
+func (fc *flakyConnection) IsConnected() bool {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return !fc.down
+}
+
+func (fc *flakyConnection) Publish(topic string, payload []byte) error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.down {
+		return errors.New("down")
+	}
+	if fc.failures > 0 {
+		fc.failures--
+		return errors.New("publish failed")
+	}
+	fc.published = append(fc.published, string(payload))
+	return nil
+}
+
+func (fc *flakyConnection) sent() []string {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return append([]string{}, fc.published...)
+}
+
+func TestOutboxFlushesInOrder(t *testing.T) {
+	conn := &flakyConnection{down: true}
+	outbox, _ := NewOutbox(conn, 2, time.Minute, "")
+	outbox.Publish("reply", []byte("1"))
+	outbox.Publish("reply", []byte("2"))
+	if err := outbox.Publish("reply", []byte("3")); err != errorOutboxFull {
+		t.Errorf("Expected full outbox to refuse message: %v", err)
+	}
+	conn.down = false
+	// Held messages go first even once the connection is back
+	outbox.Publish("reply", []byte("3"))
+	outbox.Flush()
+	outbox.Publish("reply", []byte("4"))
+	if len(conn.published) != 3 || conn.published[0] != "1" || conn.published[1] != "2" || conn.published[2] != "4" {
+		t.Errorf("Unexpected publish order: %v", conn.published)
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("Expected empty outbox after flush: %d", outbox.Len())
+	}
+}
+
+func TestOutboxDropsExpired(t *testing.T) {
+	conn := &flakyConnection{down: true}
+	outbox, _ := NewOutbox(conn, 10, time.Minute, "")
+	outbox.Publish("reply", []byte("stale"))
+	outbox.entries[0].Queued = time.Now().Add(-2 * time.Minute)
+	outbox.Publish("reply", []byte("fresh"))
+	conn.down = false
+	outbox.Flush()
+	if len(conn.published) != 1 || conn.published[0] != "fresh" {
+		t.Errorf("Expected stale reply to be dropped: %v", conn.published)
+	}
+}
+
+func TestOutboxPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outboxPath := path.Join(dir, "outbox")
+	conn := &flakyConnection{down: true}
+	outbox, err := NewOutbox(conn, 10, time.Minute, outboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Publish("reply", []byte("survivor"))
+	reloaded, err := NewOutbox(conn, 10, time.Minute, outboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.down = false
+	reloaded.Flush()
+	if len(conn.published) != 1 || conn.published[0] != "survivor" {
+		t.Errorf("Expected persisted reply to be flushed: %v", conn.published)
+	}
+	reloaded, _ = NewOutbox(conn, 10, time.Minute, outboxPath)
+	if reloaded.Len() != 0 {
+		t.Errorf("Expected flushed replies to be removed from disk: %d", reloaded.Len())
+	}
+}
+
+func TestOutboxRetriesWhileConnected(t *testing.T) {
+	defer func(base time.Duration) { outboxRetryBase = base }(outboxRetryBase)
+	outboxRetryBase = time.Duration(10) * time.Millisecond
+	// Publishing fails three times on a connection which stays up
+	conn := &flakyConnection{failures: 3}
+	outbox, _ := NewOutbox(conn, 10, time.Minute, "")
+	defer outbox.Close()
+	outbox.Publish("reply", []byte("1"))
+	outbox.Publish("reply", []byte("2"))
+	for i := 0; i < 200 && outbox.Len() > 0; i++ {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	if published := conn.sent(); strings.Join(published, ",") != "1,2" {
+		t.Errorf("Expected held replies to be retried without a reconnect: %v", published)
+	}
+}
+
+func TestOutboxAppendsAndCompacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outboxPath := path.Join(dir, "outbox")
+	conn := &flakyConnection{down: true}
+	outbox, err := NewOutbox(conn, 3, time.Minute, outboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Publish("reply", []byte("1"))
+	outbox.Publish("reply", []byte("2"))
+	conn.down = false
+	outbox.Flush()
+	conn.down = true
+	outbox.Publish("reply", []byte("3"))
+	outbox.Publish("reply", []byte("4"))
+	// Four held and two removed
+	if lines := outboxLines(t, outboxPath); lines != 6 {
+		t.Errorf("Expected records to be appended: %d lines", lines)
+	}
+	conn.down = false
+	outbox.Flush()
+	// Passing twice capacity records rewrote the file with "4" held,
+	// then "4" was removed
+	if lines := outboxLines(t, outboxPath); lines != 2 {
+		t.Errorf("Expected outbox file to be compacted: %d lines", lines)
+	}
+	outbox.Close()
+	reloaded, _ := NewOutbox(conn, 3, time.Minute, outboxPath)
+	defer reloaded.Close()
+	if reloaded.Len() != 0 {
+		t.Errorf("Expected removals to be replayed on load: %d", reloaded.Len())
+	}
+	if published := conn.sent(); strings.Join(published, ",") != "1,2,3,4" {
+		t.Errorf("Unexpected publish order: %v", published)
+	}
+}
+
+func outboxLines(t *testing.T, outboxPath string) int {
+	buf, err := ioutil.ReadFile(outboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(buf), "\n")
+}
@@ -0,0 +1,221 @@
+package bus
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyDialTimeout bounds connecting to the proxy, the CONNECT
+// exchange and any TLS or WebSocket handshake with the broker
+var proxyDialTimeout = time.Duration(15) * time.Second
+
+var errorBadProxyScheme = errors.New("Proxy URL scheme must be http or https")
+
+// brokerProxy returns the HTTP proxy used to reach the broker, or nil
+// for a direct connection. An explicit ProxyURL always applies. Without
+// one, WebSocket connections honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func brokerProxy(options ConnectionOptions) (*url.URL, error) {
+	if options.ProxyURL != "" {
+		proxy, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.Scheme != "http" && proxy.Scheme != "https" {
+			return nil, errorBadProxyScheme
+		}
+		return proxy, nil
+	}
+	if options.WebSocket == false {
+		return nil, nil
+	}
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(options.Host, fmt.Sprintf("%d", options.Port)),
+	}
+	if options.SSLEnabled {
+		target.Scheme = "https"
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: target})
+}
+
+// mqttTunnel carries MQTT client connections to the broker through an
+// HTTP CONNECT proxy. The vendored MQTT client can't be handed a
+// custom dialer, so it connects to the tunnel's loopback listener
+// instead; the tunnel adds TLS and WebSocket framing as the broker
+// URL requires.
+type mqttTunnel struct {
+	listener  net.Listener
+	broker    *url.URL
+	proxy     *url.URL
+	tlsConfig *tls.Config
+}
+
+func newMQTTTunnel(broker *url.URL, proxy *url.URL, tlsConfig *tls.Config) (*mqttTunnel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &mqttTunnel{
+		listener:  listener,
+		broker:    broker,
+		proxy:     proxy,
+		tlsConfig: tlsConfig,
+	}
+	go tunnel.accept()
+	return tunnel, nil
+}
+
+// URL returns the broker URL the MQTT client should connect to
+func (t *mqttTunnel) URL() string {
+	return fmt.Sprintf("tcp://%s", t.listener.Addr())
+}
+
+// Close stops accepting new client connections
+func (t *mqttTunnel) Close() error {
+	return t.listener.Close()
+}
+
+func (t *mqttTunnel) accept() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(local)
+	}
+}
+
+func (t *mqttTunnel) forward(local net.Conn) {
+	remote, err := t.dial()
+	if err != nil {
+		log.Errorf("Error connecting to %s via proxy %s: %s", t.broker, t.proxy.Host, err)
+		local.Close()
+		return
+	}
+	go func() {
+		io.Copy(remote, local)
+		remote.Close()
+	}()
+	io.Copy(local, remote)
+	local.Close()
+}
+
+func (t *mqttTunnel) dial() (io.ReadWriteCloser, error) {
+	conn, err := dialProxy(t.proxy, t.broker.Host)
+	if err != nil {
+		return nil, err
+	}
+	if t.broker.Scheme == "ssl" || t.broker.Scheme == "wss" {
+		tlsConn := tls.Client(conn, t.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(proxyDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if t.broker.Scheme != "ws" && t.broker.Scheme != "wss" {
+		return conn, nil
+	}
+	config, err := websocket.NewConfig(t.broker.String(), "ws://localhost")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config.Protocol = []string{"mqtt"}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialProxy opens a tunnel to addr through an HTTP CONNECT proxy
+func dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	hostname, port := splitHostPort(proxy.Host)
+	if port == "" {
+		port = "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(hostname, port)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: hostname})
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy refused CONNECT to %s: %s", addr, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes read ahead while parsing the proxy's
+// response before reading from the connection again
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
+
+// splitHostPort splits a URL's host into its hostname and port. port
+// is empty if host doesn't include one; brackets are removed from IPv6
+// hostnames.
+func splitHostPort(host string) (string, string) {
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return hostname, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+}
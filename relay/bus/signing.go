@@ -0,0 +1,227 @@
+package bus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms
+const (
+	HMACSigning    = "hmac-sha256"
+	Ed25519Signing = "ed25519"
+)
+
+var errorUnsigned = errors.New("Message is not signed")
+var errorBadSignature = errors.New("Message signature is invalid")
+var errorUnknownKey = errors.New("Message is signed with an unknown key")
+var errorStaleMessage = errors.New("Message timestamp is outside the replay window")
+var errorReplayedMessage = errors.New("Message nonce has already been seen")
+
+// signedEnvelope wraps a signed frame. The signature covers the
+// algorithm, key ID, topic, timestamp, nonce, will flag and body.
+type signedEnvelope struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Timestamp int64  `json:"ts"`
+	Nonce     string `json:"nonce"`
+	Will      bool   `json:"will,omitempty"`
+	Body      []byte `json:"body"`
+	Signature []byte `json:"sig"`
+}
+
+// SigningCodec signs every published frame and verifies received
+// ones before they reach a handler. Messages must carry a timestamp
+// within the replay window and a nonce not seen inside it. Last wills
+// are signed when the connection is made and may be published long
+// after, so they're accepted until they're older than the will max
+// age, and their nonces are remembered for as long.
+type SigningCodec struct {
+	algorithm     string
+	keyID         string
+	hmacKeys      map[string][]byte
+	privateKey    ed25519.PrivateKey
+	publicKeys    map[string]ed25519.PublicKey
+	window        time.Duration
+	willMaxAge    time.Duration
+	allowUnsigned bool
+	lock          sync.Mutex
+	nonces        map[string]time.Time
+	lastPrune     time.Time
+	now           func() time.Time
+}
+
+// NewHMACCodec returns a codec signing with keys[keyID] and verifying
+// against whichever key a message names
+func NewHMACCodec(keyID string, keys map[string][]byte, window time.Duration, willMaxAge time.Duration,
+	allowUnsigned bool) *SigningCodec {
+	return &SigningCodec{
+		algorithm:     HMACSigning,
+		keyID:         keyID,
+		hmacKeys:      keys,
+		window:        window,
+		willMaxAge:    willMaxAge,
+		allowUnsigned: allowUnsigned,
+		nonces:        make(map[string]time.Time),
+		now:           time.Now,
+	}
+}
+
+// NewEd25519Codec returns a codec signing with privateKey and
+// verifying against publicKeys, indexed by key ID
+func NewEd25519Codec(keyID string, privateKey ed25519.PrivateKey, publicKeys map[string]ed25519.PublicKey,
+	window time.Duration, willMaxAge time.Duration, allowUnsigned bool) *SigningCodec {
+	return &SigningCodec{
+		algorithm:     Ed25519Signing,
+		keyID:         keyID,
+		privateKey:    privateKey,
+		publicKeys:    publicKeys,
+		window:        window,
+		willMaxAge:    willMaxAge,
+		allowUnsigned: allowUnsigned,
+		nonces:        make(map[string]time.Time),
+		now:           time.Now,
+	}
+}
+
+// Encode is required by the bus.Codec interface
+func (sc *SigningCodec) Encode(topic string, frame []byte) ([]byte, error) {
+	return sc.encode(topic, frame, false)
+}
+
+// EncodeWill is required by the bus.WillCodec interface
+func (sc *SigningCodec) EncodeWill(topic string, frame []byte) ([]byte, error) {
+	return sc.encode(topic, frame, true)
+}
+
+func (sc *SigningCodec) encode(topic string, frame []byte, will bool) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope := signedEnvelope{
+		Algorithm: sc.algorithm,
+		KeyID:     sc.keyID,
+		Timestamp: sc.now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		Will:      will,
+		Body:      frame,
+	}
+	message := envelope.signedBytes(topic)
+	switch sc.algorithm {
+	case HMACSigning:
+		mac := hmac.New(sha256.New, sc.hmacKeys[sc.keyID])
+		mac.Write(message)
+		envelope.Signature = mac.Sum(nil)
+	case Ed25519Signing:
+		envelope.Signature = ed25519.Sign(sc.privateKey, message)
+	}
+	return json.Marshal(envelope)
+}
+
+// Decode is required by the bus.Codec interface
+func (sc *SigningCodec) Decode(topic string, frame []byte) ([]byte, error) {
+	envelope := signedEnvelope{}
+	if err := json.Unmarshal(frame, &envelope); err != nil || len(envelope.Signature) == 0 {
+		if sc.allowUnsigned {
+			return frame, nil
+		}
+		return nil, sc.reject("unsigned", errorUnsigned)
+	}
+	if envelope.Algorithm != sc.algorithm {
+		return nil, sc.reject("bad_signature", errorBadSignature)
+	}
+	message := envelope.signedBytes(topic)
+	switch sc.algorithm {
+	case HMACSigning:
+		key, ok := sc.hmacKeys[envelope.KeyID]
+		if !ok {
+			return nil, sc.reject("unknown_key", errorUnknownKey)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(message)
+		if hmac.Equal(mac.Sum(nil), envelope.Signature) == false {
+			return nil, sc.reject("bad_signature", errorBadSignature)
+		}
+	case Ed25519Signing:
+		key, ok := sc.publicKeys[envelope.KeyID]
+		if !ok {
+			return nil, sc.reject("unknown_key", errorUnknownKey)
+		}
+		if ed25519.Verify(key, message, envelope.Signature) == false {
+			return nil, sc.reject("bad_signature", errorBadSignature)
+		}
+	}
+	if err := sc.checkReplay(envelope, sc.now()); err != nil {
+		return nil, err
+	}
+	return envelope.Body, nil
+}
+
+// checkReplay rejects stale timestamps and nonces seen while their
+// message could still be accepted. Wills may be up to the will max age
+// old but not from the future. Only messages with valid signatures get
+// this far, so the nonce cache can't be filled by forgeries.
+func (sc *SigningCodec) checkReplay(envelope signedEnvelope, now time.Time) error {
+	sent := time.Unix(envelope.Timestamp, 0)
+	maxAge := sc.window
+	if envelope.Will {
+		maxAge = sc.willMaxAge
+	}
+	if now.Sub(sent) > maxAge || sent.Sub(now) > sc.window {
+		return sc.reject("stale", errorStaleMessage)
+	}
+	// Nonces are remembered until their message is too old to pass
+	// the check above
+	expires := now.Add(2 * sc.window)
+	if ageExpires := sent.Add(maxAge); ageExpires.After(expires) {
+		expires = ageExpires
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if now.Sub(sc.lastPrune) > sc.window {
+		for nonce, nonceExpires := range sc.nonces {
+			if now.After(nonceExpires) {
+				delete(sc.nonces, nonce)
+			}
+		}
+		sc.lastPrune = now
+	}
+	key := envelope.KeyID + "/" + envelope.Nonce
+	if _, seen := sc.nonces[key]; seen {
+		return sc.reject("replayed", errorReplayedMessage)
+	}
+	sc.nonces[key] = expires
+	return nil
+}
+
+func (sc *SigningCodec) reject(reason string, err error) error {
+	messagesRejected.Inc(reason)
+	return err
+}
+
+// signedBytes returns the bytes covered by the signature. Topics are
+// compared without leading or trailing slashes so signatures don't
+// depend on how a transport spells the topic. Wills add a "will"
+// field, so the flag can't be set on an ordinary message.
+func (envelope signedEnvelope) signedBytes(topic string) []byte {
+	fields := []string{
+		envelope.Algorithm,
+		envelope.KeyID,
+		strings.Trim(topic, "/"),
+		strconv.FormatInt(envelope.Timestamp, 10),
+		envelope.Nonce,
+	}
+	if envelope.Will {
+		fields = append(fields, "will")
+	}
+	return append([]byte(strings.Join(fields, "\x00")+"\x00"), envelope.Body...)
+}
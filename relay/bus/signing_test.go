@@ -0,0 +1,145 @@
+package bus
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func newTestHMACCodec(allowUnsigned bool) *SigningCodec {
+	keys := map[string][]byte{"relay-1": []byte("sekrit")}
+	return NewHMACCodec("relay-1", keys, time.Minute, 2*time.Hour, allowUnsigned)
+}
+
+func TestHMACSigning(t *testing.T) {
+	sender := newTestHMACCodec(false)
+	receiver := newTestHMACCodec(false)
+	frame, err := sender.Encode("/bot/relays/foo/exec", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := receiver.Decode("bot/relays/foo/exec", frame)
+	if err != nil || string(body) != "hello" {
+		t.Errorf("Expected signed frame to verify: %q %v", body, err)
+	}
+	if _, err := receiver.Decode("bot/relays/foo/exec", frame); err != errorReplayedMessage {
+		t.Errorf("Expected replayed frame to be rejected: %v", err)
+	}
+	frame, _ = sender.Encode("bot/relays/foo/exec", []byte("hello"))
+	if _, err := receiver.Decode("bot/relays/bar/exec", frame); err != errorBadSignature {
+		t.Errorf("Expected frame moved to another topic to be rejected: %v", err)
+	}
+	envelope := signedEnvelope{}
+	json.Unmarshal(frame, &envelope)
+	envelope.Body = []byte("goodbye")
+	tampered, _ := json.Marshal(envelope)
+	if _, err := receiver.Decode("bot/relays/foo/exec", tampered); err != errorBadSignature {
+		t.Errorf("Expected tampered frame to be rejected: %v", err)
+	}
+	envelope.KeyID = "relay-2"
+	unknown, _ := json.Marshal(envelope)
+	if _, err := receiver.Decode("bot/relays/foo/exec", unknown); err != errorUnknownKey {
+		t.Errorf("Expected frame signed with unknown key to be rejected: %v", err)
+	}
+}
+
+func TestUnsignedMessages(t *testing.T) {
+	if _, err := newTestHMACCodec(false).Decode("foo", []byte(`{"id":1}`)); err != errorUnsigned {
+		t.Errorf("Expected unsigned frame to be rejected: %v", err)
+	}
+	body, err := newTestHMACCodec(true).Decode("foo", []byte(`{"id":1}`))
+	if err != nil || string(body) != `{"id":1}` {
+		t.Errorf("Expected unsigned frame to be allowed: %q %v", body, err)
+	}
+}
+
+func TestStaleMessages(t *testing.T) {
+	codec := newTestHMACCodec(false)
+	envelope := signedEnvelope{Timestamp: time.Now().Add(-2 * time.Minute).Unix(), Nonce: "abc"}
+	if err := codec.checkReplay(envelope, time.Now()); err != errorStaleMessage {
+		t.Errorf("Expected old timestamp to be rejected: %v", err)
+	}
+	envelope.Timestamp = time.Now().Add(2 * time.Minute).Unix()
+	if err := codec.checkReplay(envelope, time.Now()); err != errorStaleMessage {
+		t.Errorf("Expected future timestamp to be rejected: %v", err)
+	}
+}
+
+func TestOldWills(t *testing.T) {
+	sender := newTestHMACCodec(false)
+	receiver := newTestHMACCodec(false)
+	// Registered with the broker an hour before the connection dropped
+	sender.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	will, err := sender.EncodeWill("bot/relays/foo/announcer", []byte("offline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := receiver.Decode("bot/relays/foo/announcer", will)
+	if err != nil || string(body) != "offline" {
+		t.Errorf("Expected will older than the replay window to verify: %q %v", body, err)
+	}
+	if _, err := receiver.Decode("bot/relays/foo/announcer", will); err != errorReplayedMessage {
+		t.Errorf("Expected replayed will to be rejected: %v", err)
+	}
+	frame, _ := sender.Encode("bot/relays/foo/announcer", []byte("offline"))
+	if _, err := receiver.Decode("bot/relays/foo/announcer", frame); err != errorStaleMessage {
+		t.Errorf("Expected old message which isn't a will to be rejected: %v", err)
+	}
+	// Marking an ordinary message as a will breaks its signature
+	envelope := signedEnvelope{}
+	json.Unmarshal(frame, &envelope)
+	envelope.Will = true
+	forged, _ := json.Marshal(envelope)
+	if _, err := receiver.Decode("bot/relays/foo/announcer", forged); err != errorBadSignature {
+		t.Errorf("Expected message relabelled as a will to be rejected: %v", err)
+	}
+	sender.now = func() time.Time { return time.Now().Add(time.Hour) }
+	will, _ = sender.EncodeWill("bot/relays/foo/announcer", []byte("offline"))
+	if _, err := receiver.Decode("bot/relays/foo/announcer", will); err != errorStaleMessage {
+		t.Errorf("Expected will from the future to be rejected: %v", err)
+	}
+}
+
+func TestReplayedWills(t *testing.T) {
+	sender := newTestHMACCodec(false)
+	receiver := newTestHMACCodec(false)
+	start := time.Now()
+	sender.now = func() time.Time { return start.Add(-time.Hour) }
+	will, _ := sender.EncodeWill("bot/relays/foo/announcer", []byte("offline"))
+	receiver.now = func() time.Time { return start }
+	if _, err := receiver.Decode("bot/relays/foo/announcer", will); err != nil {
+		t.Fatal(err)
+	}
+	// Long enough for ordinary nonces to be pruned
+	receiver.now = func() time.Time { return start.Add(10 * time.Minute) }
+	sender.now = receiver.now
+	frame, _ := sender.Encode("bot/relays/foo/exec", []byte("hello"))
+	if _, err := receiver.Decode("bot/relays/foo/exec", frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decode("bot/relays/foo/announcer", will); err != errorReplayedMessage {
+		t.Errorf("Expected will replayed after the replay window to be rejected: %v", err)
+	}
+	receiver.now = func() time.Time { return start.Add(90 * time.Minute) }
+	if _, err := receiver.Decode("bot/relays/foo/announcer", will); err != errorStaleMessage {
+		t.Errorf("Expected will older than the will max age to be rejected: %v", err)
+	}
+}
+
+func TestEd25519Signing(t *testing.T) {
+	relayPublic, relayPrivate, _ := ed25519.GenerateKey(nil)
+	cogPublic, cogPrivate, _ := ed25519.GenerateKey(nil)
+	relay := NewEd25519Codec("relay-1", relayPrivate, map[string]ed25519.PublicKey{"cog-1": cogPublic},
+		time.Minute, 2*time.Hour, false)
+	cog := NewEd25519Codec("cog-1", cogPrivate, map[string]ed25519.PublicKey{"relay-1": relayPublic},
+		time.Minute, 2*time.Hour, false)
+	frame, _ := relay.Encode("bot/relays/discover", []byte("announce"))
+	body, err := cog.Decode("bot/relays/discover", frame)
+	if err != nil || string(body) != "announce" {
+		t.Errorf("Expected Ed25519 signed frame to verify: %q %v", body, err)
+	}
+	if _, err := relay.Decode("bot/relays/discover", frame); err != errorUnknownKey {
+		t.Errorf("Expected relay to reject its own key: %v", err)
+	}
+}
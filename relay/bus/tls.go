@@ -0,0 +1,189 @@
+package bus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// loadRootCAs returns the certificate pool used to verify Cog's TLS
+// certificate. Returns nil when no certificate path is set, which
+// selects the system pool.
+func loadRootCAs(options ConnectionOptions) (*x509.CertPool, error) {
+	if options.SSLCertPath == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(options.SSLCertPath)
+	if err != nil {
+		log.Errorf("Error reading TLS certificate file %s: %s.",
+			options.SSLCertPath, err)
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	ok := roots.AppendCertsFromPEM(buf)
+	if !ok {
+		log.Errorf("Failed to parse TLS certificate file %s.",
+			options.SSLCertPath)
+		return nil, errorBadTLSCert
+	}
+	return roots, nil
+}
+
+// clientTLS holds the TLS settings shared by every transport and by
+// the proxy tunnel. Each connection gets its own tls.Config from
+// Config so it presents the current client certificate.
+type clientTLS struct {
+	config *tls.Config
+	certs  *certReloader
+}
+
+// newClientTLS loads the TLS settings in options. Cog's certificate is
+// verified unless SSLInsecure is set.
+func newClientTLS(options ConnectionOptions) (*clientTLS, error) {
+	roots, err := loadRootCAs(options)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:   options.Host,
+		RootCAs:      roots,
+		MinVersion:   options.SSLMinVersion,
+		CipherSuites: options.SSLCipherSuites,
+	}
+	if options.SSLServerName != "" {
+		config.ServerName = options.SSLServerName
+	}
+	if options.SSLInsecure {
+		log.Warn("TLS certificate verification disabled.")
+		config.InsecureSkipVerify = true
+	} else if roots == nil {
+		log.Info("TLS certificate verification enabled using system roots.")
+	} else {
+		log.Info("TLS certificate verification enabled.")
+	}
+	ct := &clientTLS{config: config}
+	if options.SSLClientCertPath != "" {
+		reloader, err := newCertReloader(options.SSLClientCertPath, options.SSLClientKeyPath,
+			options.SSLReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		ct.certs = reloader
+		log.Info("TLS client certificate authentication enabled.")
+	}
+	return ct, nil
+}
+
+// Config returns the tls.Config for a new connection
+func (ct *clientTLS) Config() *tls.Config {
+	config := copyTLSConfig(ct.config)
+	if ct.certs != nil {
+		config.Certificates = []tls.Certificate{*ct.certs.Certificate()}
+	}
+	return config
+}
+
+// copyTLSConfig returns a copy of a config made by newClientTLS, for
+// settings which differ between connections. Only the fields
+// newClientTLS sets are copied; tls.Config.Clone needs Go 1.8.
+func copyTLSConfig(config *tls.Config) *tls.Config {
+	return &tls.Config{
+		ServerName:         config.ServerName,
+		RootCAs:            config.RootCAs,
+		MinVersion:         config.MinVersion,
+		CipherSuites:       config.CipherSuites,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		Certificates:       config.Certificates,
+	}
+}
+
+// certReloader serves a client certificate and picks up replacement
+// cert and key files. Files are checked at most once per interval,
+// when a connection is made, so rotated certificates take effect on
+// the next connection without a restart.
+type certReloader struct {
+	certPath  string
+	keyPath   string
+	interval  time.Duration
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	modified  time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certPath string, keyPath string, interval time.Duration) (*certReloader, error) {
+	reloader := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		interval: interval,
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Certificate returns the current client certificate
+func (cr *certReloader) Certificate() *tls.Certificate {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.interval > 0 && time.Since(cr.lastCheck) >= cr.interval {
+		if err := cr.reloadIfChanged(); err != nil {
+			// Keep presenting the last good certificate
+			log.Errorf("Reloading TLS client certificate failed: %s.", err)
+		}
+	}
+	return cr.cert
+}
+
+func (cr *certReloader) reloadIfChanged() error {
+	cr.lastCheck = time.Now()
+	modified, err := cr.modTime()
+	if err != nil {
+		return err
+	}
+	if modified.Equal(cr.modified) {
+		return nil
+	}
+	if err := cr.load(); err != nil {
+		return err
+	}
+	log.Infof("Reloaded TLS client certificate %s.", cr.certPath)
+	return nil
+}
+
+func (cr *certReloader) load() error {
+	modified, err := cr.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		log.Errorf("Error loading TLS client certificate %s: %s.", cr.certPath, err)
+		return err
+	}
+	cr.cert = &cert
+	cr.modified = modified
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// modTime returns the later of the cert and key modification times
+func (cr *certReloader) modTime() (time.Time, error) {
+	certInfo, err := os.Stat(cr.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
@@ -0,0 +1,118 @@
+package bus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and key for
+// commonName to dir
+func writeTestCert(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := path.Join(dir, "client.pem")
+	keyPath := path.Join(dir, "client.key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certPath, keyPath
+}
+
+func clientCommonName(t *testing.T, config *tls.Config) string {
+	if len(config.Certificates) != 1 {
+		t.Fatalf("Expected one client certificate: %d", len(config.Certificates))
+	}
+	parsed, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestTLSFailsClosed(t *testing.T) {
+	ct, err := newClientTLS(ConnectionOptions{Host: "cog", SSLEnabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := ct.Config(); config.InsecureSkipVerify || len(config.Certificates) != 0 {
+		t.Error("Expected verification against system roots without ssl_cert_path")
+	}
+	ct, err = newClientTLS(ConnectionOptions{Host: "cog", SSLEnabled: true,
+		SSLInsecure: true, SSLServerName: "broker.internal", SSLMinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ct.Config()
+	if config.InsecureSkipVerify == false {
+		t.Error("Expected ssl_insecure to disable verification")
+	}
+	if config.ServerName != "broker.internal" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Unexpected server name or minimum version: %s %d", config.ServerName, config.MinVersion)
+	}
+	copied := copyTLSConfig(config)
+	copied.ServerName = "other.internal"
+	if copied.InsecureSkipVerify == false || copied.MinVersion != config.MinVersion || config.ServerName != "broker.internal" {
+		t.Errorf("Expected an independent copy of the TLS settings: %s %d", config.ServerName, copied.MinVersion)
+	}
+}
+
+func TestClientCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCert(t, dir, "relay-1")
+	ct, err := newClientTLS(ConnectionOptions{
+		Host:              "cog",
+		SSLClientCertPath: certPath,
+		SSLClientKeyPath:  keyPath,
+		SSLReloadInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := clientCommonName(t, ct.Config()); name != "relay-1" {
+		t.Errorf("Unexpected client certificate: %s", name)
+	}
+	writeTestCert(t, dir, "relay-2")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	if name := clientCommonName(t, ct.Config()); name != "relay-2" {
+		t.Errorf("Expected rotated client certificate: %s", name)
+	}
+	// A broken replacement keeps the last good certificate
+	ioutil.WriteFile(keyPath, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyPath, later, later)
+	if name := clientCommonName(t, ct.Config()); name != "relay-2" {
+		t.Errorf("Expected last good client certificate: %s", name)
+	}
+}
@@ -0,0 +1,57 @@
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Available transports
+const (
+	MQTTTransport = "mqtt"
+	NATSTransport = "nats"
+)
+
+// TransportFactory returns a new, unconnected Connection
+type TransportFactory func() Connection
+
+var transportLock sync.Mutex
+var transports = map[string]TransportFactory{
+	MQTTTransport: func() Connection { return &MQTTConnection{} },
+	NATSTransport: func() Connection { return &NATSConnection{} },
+}
+
+// RegisterTransport makes a transport available to NewConnection.
+// Registering an existing name replaces it.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transports[name] = factory
+}
+
+// Transports returns the names of the registered transports
+func Transports() []string {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	names := []string{}
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewConnection returns a new, unconnected Connection for the named
+// transport. An empty name selects MQTT.
+func NewConnection(transport string) (Connection, error) {
+	if transport == "" {
+		transport = MQTTTransport
+	}
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	factory := transports[transport]
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown message bus transport '%s'", transport)
+	}
+	return factory(), nil
+}
@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/bus"
+	"github.com/operable/go-relay/relay/config"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+)
+
+// oidEd25519 identifies Ed25519 keys (RFC 8410)
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// pkcs8Key is a PKCS #8 private key. crypto/x509 only parses Ed25519
+// keys from Go 1.13, so they're decoded here.
+type pkcs8Key struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// pkixPublicKey is a PKIX (SubjectPublicKeyInfo) public key
+type pkixPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// newCodecs builds the message bus codec chain described by the
+// relay's config
+func newCodecs(relayConfig *config.Config) ([]bus.Codec, error) {
+	codecs := []bus.Codec{}
+	// Codecs encode in order, so payloads are encrypted before
+	// they're signed and signatures are checked before decrypting.
+	if relayConfig.Cog.EncryptionEnabled() {
+		encryption, err := bus.NewEncryptionCodec(relayConfig.Cog.EncryptionKeys())
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, encryption)
+		log.Info("Encrypting message bus payloads.")
+	}
+	signing := relayConfig.Signing
+	switch signing.Algorithm {
+	case config.HMACSigning:
+		keys := map[string][]byte{signing.KeyID: []byte(signing.Key)}
+		codecs = append(codecs, bus.NewHMACCodec(signing.KeyID, keys, signing.ReplayWindowDuration(),
+			signing.WillMaxAgeDuration(), signing.AllowUnsigned))
+	case config.Ed25519Signing:
+		privateKey, err := loadEd25519PrivateKey(signing.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys := map[string]ed25519.PublicKey{}
+		for keyID, path := range signing.PublicKeys {
+			publicKey, err := loadEd25519PublicKey(path)
+			if err != nil {
+				return nil, err
+			}
+			publicKeys[keyID] = publicKey
+		}
+		codecs = append(codecs, bus.NewEd25519Codec(signing.KeyID, privateKey, publicKeys,
+			signing.ReplayWindowDuration(), signing.WillMaxAgeDuration(), signing.AllowUnsigned))
+	}
+	if signing.Enabled() {
+		log.Infof("Signing message bus traffic with %s key %s.", signing.Algorithm, signing.KeyID)
+		if signing.AllowUnsigned {
+			log.Warn("Accepting unsigned messages from the message bus.")
+		}
+	}
+	return codecs, nil
+}
+
+func loadEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key := pkcs8Key{}
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, fmt.Errorf("Error parsing private key %s: %s", path, err)
+	}
+	if key.Algorithm.Algorithm.Equal(oidEd25519) == false {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	// The key is the seed, wrapped in an OCTET STRING
+	seed := []byte{}
+	if _, err := asn1.Unmarshal(key.PrivateKey, &seed); err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Error parsing private key %s: bad Ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func loadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key := pkixPublicKey{}
+	if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return nil, fmt.Errorf("Error parsing public key %s: %s", path, err)
+	}
+	if key.Algorithm.Algorithm.Equal(oidEd25519) == false {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	if len(key.PublicKey.Bytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Error parsing public key %s: bad Ed25519 key", path)
+	}
+	return ed25519.PublicKey(key.PublicKey.Bytes), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	return block, nil
+}
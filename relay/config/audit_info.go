@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+)
+
+var errorBadAuditRotation = errors.New("audit/max_size and audit/max_files must be greater than zero")
+
+// defaultRedactKeys are redacted from audit records unless
+// audit/redact_keys is set
+var defaultRedactKeys = []string{"password", "passwd", "secret", "token", "api_key"}
+
+// AuditInfo configures the local execution audit log
+type AuditInfo struct {
+	Path       string   `yaml:"path" env:"RELAY_AUDIT_PATH"`
+	MaxSize    int      `yaml:"max_size" env:"RELAY_AUDIT_MAX_SIZE" default:"10485760"`
+	MaxFiles   int      `yaml:"max_files" env:"RELAY_AUDIT_MAX_FILES" default:"5"`
+	RedactKeys []string `yaml:"redact_keys"`
+}
+
+// Enabled returns true when an audit log path is set
+func (audit *AuditInfo) Enabled() bool {
+	return audit.Path != ""
+}
+
+func (audit *AuditInfo) parse() {
+	if audit.RedactKeys == nil {
+		audit.RedactKeys = defaultRedactKeys
+	}
+}
+
+func (audit *AuditInfo) verify() error {
+	if audit.MaxSize <= 0 || audit.MaxFiles <= 0 {
+		return errorBadAuditRotation
+	}
+	return nil
+}
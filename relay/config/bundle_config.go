@@ -3,7 +3,9 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/asaskevich/govalidator"
+	"time"
 )
 
 // Bundle represents a command bundle's complete configuration
@@ -15,6 +17,10 @@ type Bundle struct {
 	Docker        *DockerImage               `json:"docker" valid:"-"`
 	Commands      map[string]*BundleCommand  `json:"commands" valid:"-"`
 	Templates     map[string]*BundleTemplate `json:"templates" valid:"-"`
+	Timeout       string                     `json:"timeout,omitempty" valid:"-"`
+	OutputVersion int                        `json:"output_version,omitempty" valid:"-"`
+	MaxConcurrent int                        `json:"max_concurrent,omitempty" valid:"-"`
+	Priority      string                     `json:"priority,omitempty" valid:"-"`
 	available     bool
 }
 
@@ -27,11 +33,14 @@ type DockerImage struct {
 
 // BundleCommand identifies a command within a bundle
 type BundleCommand struct {
-	Name       string
-	Executable string                          `json:"executable" valid:"required"`
-	Options    map[string]*BundleCommandOption `json:"options"`
-	Rules      []string                        `json:"rules"`
-	EnvVars    map[string]string               `json:"env_vars"`
+	Name          string
+	Executable    string                          `json:"executable" valid:"required"`
+	Options       map[string]*BundleCommandOption `json:"options"`
+	Rules         []string                        `json:"rules"`
+	EnvVars       map[string]string               `json:"env_vars"`
+	Timeout       string                          `json:"timeout,omitempty"`
+	Stream        bool                            `json:"stream,omitempty"`
+	MaxConcurrent int                             `json:"max_concurrent,omitempty"`
 }
 
 // BundleCommandOption is a description of a command's option
@@ -76,6 +85,32 @@ func (b *Bundle) NeedsRefresh() bool {
 	return !b.available
 }
 
+// CommandTimeout returns the execution timeout for the named
+// command. Command timeouts take precedence over bundle timeouts and
+// fallback is used when neither is set or parseable.
+func (b *Bundle) CommandTimeout(name string, fallback time.Duration) time.Duration {
+	if command := b.Commands[name]; command != nil && command.Timeout != "" {
+		if duration, err := time.ParseDuration(command.Timeout); err == nil {
+			return duration
+		}
+		log.Warnf("Ignoring bad timeout '%s' for command %s:%s.", command.Timeout, b.Name, name)
+	}
+	if b.Timeout != "" {
+		if duration, err := time.ParseDuration(b.Timeout); err == nil {
+			return duration
+		}
+		log.Warnf("Ignoring bad timeout '%s' for bundle %s.", b.Timeout, b.Name)
+	}
+	return fallback
+}
+
+// StreamsOutput returns true if the named command has opted in
+// to streaming its output back to Cog as it is produced
+func (b *Bundle) StreamsOutput(name string) bool {
+	command := b.Commands[name]
+	return command != nil && command.Stream
+}
+
 // PrettyImageName returns a prettified version of a Docker image
 // include repository, name, and tag
 func (di *DockerImage) PrettyImageName() string {
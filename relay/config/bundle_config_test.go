@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 const (
@@ -191,3 +192,26 @@ func checkNames(config *Bundle, t *testing.T) {
 	}
 
 }
+
+func TestCommandTimeout(t *testing.T) {
+	config, err := ParseBundleConfig([]byte(NonDockerBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := time.Duration(10) * time.Minute
+	if timeout := config.CommandTimeout("date", fallback); timeout != fallback {
+		t.Errorf("Expected fallback timeout: %v", timeout)
+	}
+	config.Timeout = "2m"
+	if timeout := config.CommandTimeout("date", fallback); timeout != time.Duration(2)*time.Minute {
+		t.Errorf("Expected bundle timeout of 2m: %v", timeout)
+	}
+	config.Commands["date"].Timeout = "30s"
+	if timeout := config.CommandTimeout("date", fallback); timeout != time.Duration(30)*time.Second {
+		t.Errorf("Expected command timeout of 30s: %v", timeout)
+	}
+	config.Commands["time"].Timeout = "bogus"
+	if timeout := config.CommandTimeout("time", fallback); timeout != time.Duration(2)*time.Minute {
+		t.Errorf("Expected bad command timeout to fall back to bundle timeout: %v", timeout)
+	}
+}
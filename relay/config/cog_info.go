@@ -1,24 +1,328 @@
 package config
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/operable/go-relay/relay/bus"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var errorBadTransport = errors.New("cog/transport must name a registered message bus transport")
+var errorBadWebSocketPath = errors.New("cog/websocket_path must start with '/'")
+var errorBadProxyURL = errors.New("cog/proxy_url must be an http:// or https:// URL")
+var errorIncompleteClientCert = errors.New("cog/ssl_client_cert_path and cog/ssl_client_key_path must be set together")
+var errorBadTLSVersion = errors.New("cog/ssl_min_version must be one of 1.0, 1.1 or 1.2, or 1.3 in builds using Go 1.12 or later")
+var errorBadSSLReloadInterval = errors.New("Error parsing cog/ssl_reload_interval")
+var errorBadFailover = errors.New("cog/failover must be 'ordered' or 'random'")
+var errorBadFailbackInterval = errors.New("Error parsing cog/failback_interval")
+var errorBadBackoffStrategy = errors.New("cog/backoff_strategy must be 'exponential' or 'linear'")
+var errorBadBackoffDuration = errors.New("cog/backoff_base and cog/backoff_cap must be positive durations with base no greater than cap")
+var errorBadBackoffLimits = errors.New("cog/backoff_jitter must be between 0 and 100 and cog/backoff_max_attempts can't be negative")
+var errorBadEncryptionKey = errors.New("cog/encryption_key and cog/encryption_previous_key must be base64 encoded 32 byte keys")
+var errorMissingEncryptionKey = errors.New("cog/encryption_previous_key requires setting cog/encryption_key")
+var errorMQTTOnlyOption = errors.New("cog/websocket and cog/proxy_url require the mqtt transport")
+
 // CogInfo contains information required to connect to an upstream Cog host
 type CogInfo struct {
 	Host            string `yaml:"host" env:"RELAY_COG_HOST" valid:"hostorip,required" default:"127.0.0.1"`
 	Port            int    `yaml:"port" env:"RELAY_COG_PORT" valid:"int64,required" default:"1883"`
-	Token           string `yaml:"token" env:"RELAY_COG_TOKEN" valid:"required"`
+	Endpoints       string `yaml:"endpoints" env:"RELAY_COG_ENDPOINTS" valid:"-"`
+	Failover        string `yaml:"failover" env:"RELAY_COG_FAILOVER" valid:"-" default:"ordered"`
+	Failback        string `yaml:"failback_interval" env:"RELAY_COG_FAILBACK_INTERVAL" valid:"-" default:"1m"`
+	Transport       string `yaml:"transport" env:"RELAY_COG_TRANSPORT" valid:"required" default:"mqtt"`
+	Token           string `yaml:"token" env:"RELAY_COG_TOKEN" valid:"required" secret:"true"`
 	SSLEnabled      bool   `yaml:"enable_ssl" env:"RELAY_COG_ENABLE_SSL" valid:"bool" default:"false"`
 	SSLCertPath     string `yaml:"ssl_cert_path" env:"RELAY_COG_SSL_CERT_PATH" valid:"-"`
+	SSLInsecure     bool   `yaml:"ssl_insecure" env:"RELAY_COG_SSL_INSECURE" valid:"bool" default:"false"`
+	SSLClientCert   string `yaml:"ssl_client_cert_path" env:"RELAY_COG_SSL_CLIENT_CERT_PATH" valid:"-"`
+	SSLClientKey    string `yaml:"ssl_client_key_path" env:"RELAY_COG_SSL_CLIENT_KEY_PATH" valid:"-"`
+	SSLServerName   string `yaml:"ssl_server_name" env:"RELAY_COG_SSL_SERVER_NAME" valid:"-"`
+	SSLMinVersion   string `yaml:"ssl_min_version" env:"RELAY_COG_SSL_MIN_VERSION" valid:"-" default:"1.2"`
+	SSLCiphers      string `yaml:"ssl_ciphers" env:"RELAY_COG_SSL_CIPHERS" valid:"-"`
+	SSLReload       string `yaml:"ssl_reload_interval" env:"RELAY_COG_SSL_RELOAD_INTERVAL" valid:"-" default:"5m"`
+	WebSocket       bool   `yaml:"websocket" env:"RELAY_COG_WEBSOCKET" valid:"bool" default:"false"`
+	WebSocketPath   string `yaml:"websocket_path" env:"RELAY_COG_WEBSOCKET_PATH" valid:"-" default:"/mqtt"`
+	ProxyURL        string `yaml:"proxy_url" env:"RELAY_COG_PROXY_URL" valid:"-" secret:"true"`
+	BackoffStrategy string `yaml:"backoff_strategy" env:"RELAY_COG_BACKOFF_STRATEGY" valid:"-" default:"exponential"`
+	BackoffBase     string `yaml:"backoff_base" env:"RELAY_COG_BACKOFF_BASE" valid:"-" default:"5s"`
+	BackoffCap      string `yaml:"backoff_cap" env:"RELAY_COG_BACKOFF_CAP" valid:"-" default:"90s"`
+	BackoffJitter   string `yaml:"backoff_jitter" env:"RELAY_COG_BACKOFF_JITTER" valid:"-" default:"20"`
+	BackoffAttempts int    `yaml:"backoff_max_attempts" env:"RELAY_COG_BACKOFF_MAX_ATTEMPTS" valid:"-"`
+	EncryptionKey   string `yaml:"encryption_key" env:"RELAY_COG_ENCRYPTION_KEY" valid:"-" secret:"true"`
+	PreviousKey     string `yaml:"encryption_previous_key" env:"RELAY_COG_ENCRYPTION_PREVIOUS_KEY" valid:"-" secret:"true"`
 	RefreshInterval string `yaml:"refresh_interval" env:"RELAY_COG_REFRESH_INTERVAL" valid:"required" default:"1m"`
 }
 
-// URL returns a MQTT URL for the upstream Cog host
+// BrokerEndpoints returns the brokers to connect to, primary first.
+// Endpoints replaces Host and Port when set; entries without a port
+// use Port.
+func (ci *CogInfo) BrokerEndpoints() []bus.Endpoint {
+	endpoints, err := parseEndpoints(ci.Endpoints, ci.Port)
+	if err != nil {
+		panic(err)
+	}
+	if len(endpoints) == 0 {
+		return []bus.Endpoint{{Host: ci.Host, Port: ci.Port}}
+	}
+	return endpoints
+}
+
+// BackoffBaseDuration returns BackoffBase as a time.Duration
+func (ci *CogInfo) BackoffBaseDuration() time.Duration {
+	duration, err := time.ParseDuration(ci.BackoffBase)
+	if err != nil {
+		panic(errorBadBackoffDuration)
+	}
+	return duration
+}
+
+// BackoffJitterPercent returns BackoffJitter as an int. It's kept as
+// a string so an explicit 0 isn't replaced by the default.
+func (ci *CogInfo) BackoffJitterPercent() int {
+	jitter, err := strconv.Atoi(ci.BackoffJitter)
+	if err != nil {
+		panic(errorBadBackoffLimits)
+	}
+	return jitter
+}
+
+// BackoffCapDuration returns BackoffCap as a time.Duration
+func (ci *CogInfo) BackoffCapDuration() time.Duration {
+	duration, err := time.ParseDuration(ci.BackoffCap)
+	if err != nil {
+		panic(errorBadBackoffDuration)
+	}
+	return duration
+}
+
+// FailbackDuration returns Failback as a time.Duration
+func (ci *CogInfo) FailbackDuration() time.Duration {
+	duration, err := time.ParseDuration(ci.Failback)
+	if err != nil {
+		panic(errorBadFailbackInterval)
+	}
+	return duration
+}
+
+func parseEndpoints(value string, defaultPort int) ([]bus.Endpoint, error) {
+	endpoints := []bus.Endpoint{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, port := entry, defaultPort
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			parsed, err := strconv.Atoi(p)
+			if err != nil || parsed < 1 || parsed > 65535 {
+				return nil, fmt.Errorf("Bad port in cog/endpoints entry '%s'", entry)
+			}
+			host, port = h, parsed
+		}
+		if host == "" {
+			return nil, fmt.Errorf("Missing host in cog/endpoints entry '%s'", entry)
+		}
+		endpoints = append(endpoints, bus.Endpoint{Host: host, Port: port})
+	}
+	return endpoints, nil
+}
+
+// URL returns a MQTT or NATS URL for the upstream Cog host
 func (ci *CogInfo) URL() string {
 	proto := "tcp"
-	if ci.SSLEnabled {
+	if ci.Transport == bus.NATSTransport {
+		proto = "nats"
+		if ci.SSLEnabled {
+			proto = "tls"
+		}
+	} else if ci.WebSocket {
+		proto = "ws"
+		if ci.SSLEnabled {
+			proto = "wss"
+		}
+		return fmt.Sprintf("%s://%s:%d%s", proto, ci.Host, ci.Port, ci.WebSocketPath)
+	} else if ci.SSLEnabled {
 		proto = "ssl"
 	}
 	return fmt.Sprintf("%s://%s:%d", proto, ci.Host, ci.Port)
 }
+
+// TLSMinVersion returns SSLMinVersion as a crypto/tls version constant
+func (ci *CogInfo) TLSMinVersion() uint16 {
+	version, ok := tlsVersions[ci.SSLMinVersion]
+	if !ok {
+		panic(errorBadTLSVersion)
+	}
+	return version
+}
+
+// TLSCipherSuites returns the IDs of the cipher suites named in
+// SSLCiphers. Returns nil, selecting Go's defaults, when none are named.
+func (ci *CogInfo) TLSCipherSuites() []uint16 {
+	suites, err := parseCipherSuites(ci.SSLCiphers)
+	if err != nil {
+		panic(err)
+	}
+	return suites
+}
+
+// SSLReloadDuration returns SSLReload as a time.Duration
+func (ci *CogInfo) SSLReloadDuration() time.Duration {
+	duration, err := time.ParseDuration(ci.SSLReload)
+	if err != nil {
+		panic(errorBadSSLReloadInterval)
+	}
+	return duration
+}
+
+// EncryptionEnabled returns true when payload encryption is configured
+func (ci *CogInfo) EncryptionEnabled() bool {
+	return ci.EncryptionKey != ""
+}
+
+// EncryptionKeys returns the decoded current and previous encryption
+// keys. previous is nil when no previous key is set.
+func (ci *CogInfo) EncryptionKeys() (current []byte, previous []byte) {
+	current, err := decodeEncryptionKey(ci.EncryptionKey)
+	if err != nil {
+		panic(err)
+	}
+	if ci.PreviousKey != "" {
+		if previous, err = decodeEncryptionKey(ci.PreviousKey); err != nil {
+			panic(err)
+		}
+	}
+	return current, previous
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errorBadEncryptionKey
+	}
+	return key, nil
+}
+
+// tlsVersions maps cog/ssl_min_version values to crypto/tls versions.
+// 1.3 is added by tls_go112.go when the toolchain supports it.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// cipherSuites maps the Go names of the cipher suites cog/ssl_ciphers
+// accepts to their IDs. RC4 and 3DES suites are left out as insecure.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+func parseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+	suites := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite in cog/ssl_ciphers: %s", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+func (ci *CogInfo) verify() error {
+	if validTransport(ci.Transport) == false {
+		return errorBadTransport
+	}
+	if _, err := parseEndpoints(ci.Endpoints, ci.Port); err != nil {
+		return err
+	}
+	if ci.Failover != bus.OrderedFailover && ci.Failover != bus.RandomFailover {
+		return errorBadFailover
+	}
+	if duration, err := time.ParseDuration(ci.Failback); err != nil || duration < 0 {
+		return errorBadFailbackInterval
+	}
+	if ci.BackoffStrategy != bus.ExponentialBackoff && ci.BackoffStrategy != bus.LinearBackoff {
+		return errorBadBackoffStrategy
+	}
+	base, err := time.ParseDuration(ci.BackoffBase)
+	if err != nil || base <= 0 {
+		return errorBadBackoffDuration
+	}
+	if cap, err := time.ParseDuration(ci.BackoffCap); err != nil || cap < base {
+		return errorBadBackoffDuration
+	}
+	jitter, err := strconv.Atoi(ci.BackoffJitter)
+	if err != nil || jitter < 0 || jitter > 100 || ci.BackoffAttempts < 0 {
+		return errorBadBackoffLimits
+	}
+	if ci.Transport != bus.MQTTTransport && (ci.WebSocket || ci.ProxyURL != "") {
+		return errorMQTTOnlyOption
+	}
+	if ci.WebSocket && strings.HasPrefix(ci.WebSocketPath, "/") == false {
+		return errorBadWebSocketPath
+	}
+	if (ci.SSLClientCert == "") != (ci.SSLClientKey == "") {
+		return errorIncompleteClientCert
+	}
+	if _, ok := tlsVersions[ci.SSLMinVersion]; !ok {
+		return errorBadTLSVersion
+	}
+	if _, err := parseCipherSuites(ci.SSLCiphers); err != nil {
+		return err
+	}
+	if duration, err := time.ParseDuration(ci.SSLReload); err != nil || duration < 0 {
+		return errorBadSSLReloadInterval
+	}
+	if ci.PreviousKey != "" && ci.EncryptionKey == "" {
+		return errorMissingEncryptionKey
+	}
+	for _, encoded := range []string{ci.EncryptionKey, ci.PreviousKey} {
+		if encoded == "" {
+			continue
+		}
+		if _, err := decodeEncryptionKey(encoded); err != nil {
+			return err
+		}
+	}
+	if ci.ProxyURL != "" {
+		proxy, err := url.Parse(ci.ProxyURL)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https") || proxy.Host == "" {
+			return errorBadProxyURL
+		}
+	}
+	return nil
+}
+
+// validTransport reports whether name is registered with the bus
+// package. Transports registered with bus.RegisterTransport must be
+// registered before the config is verified.
+func validTransport(name string) bool {
+	for _, transport := range bus.Transports() {
+		if transport == name {
+			return true
+		}
+	}
+	return false
+}
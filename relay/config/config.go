@@ -31,12 +31,17 @@ var validEngineNames = []string{DockerEngine, NativeEngine}
 var errorNoExecutionEngines = errors.New("Invalid Relay configuration detected. At least one execution engine must be enabled.")
 var errorMissingDynamicConfigRoot = errors.New("Enabling 'managed_dynamic_config' requires setting 'dynamic_config_root'.")
 var errorBadDynConfigInterval = errors.New("Error parsing managed_dynamic_config_interval")
+var errorBadShutdownGrace = errors.New("Error parsing shutdown_grace")
+var errorBadQueueDepth = errors.New("queue_depth must be greater than zero")
 
 // Config is the top level struct for all Relay configuration
 type Config struct {
 	Version               int      `yaml:"version" valid:"int64,required"`
 	ID                    string   `yaml:"id" env:"RELAY_ID" valid:"uuid,required"`
 	MaxConcurrent         int      `yaml:"max_concurrent" env:"RELAY_MAX_CONCURRENT" valid:"int64,required" default:"16"`
+	QueueDepth            int      `yaml:"queue_depth" env:"RELAY_QUEUE_DEPTH" valid:"int64,required" default:"64"`
+	ShutdownGrace         string   `yaml:"shutdown_grace" env:"RELAY_SHUTDOWN_GRACE" default:"30s"`
+	AdminListen           string   `yaml:"admin_listen" env:"RELAY_ADMIN_LISTEN" valid:"-"`
 	DynamicConfigRoot     string   `yaml:"dynamic_config_root" env:"RELAY_DYNAMIC_CONFIG_ROOT" valid:"-"`
 	ManagedDynamicConfig  bool     `yaml:"managed_dynamic_config" env:"RELAY_MANAGED_DYNAMIC_CONFIG" valid:"bool" default:"true"`
 	DynamicConfigInterval string   `yaml:"managed_dynamic_config_interval" env:"RELAY_MANAGED_DYNAMIC_CONFIG_INTERVAL" default:"5s"`
@@ -49,6 +54,10 @@ type Config struct {
 	DevMode               bool
 	Docker                *DockerInfo    `yaml:"docker" valid:"-"`
 	Execution             *ExecutionInfo `yaml:"execution" valid:"-"`
+	Trace                 *TraceInfo     `yaml:"trace" valid:"-"`
+	Audit                 *AuditInfo     `yaml:"audit" valid:"-"`
+	Outbox                *OutboxInfo    `yaml:"outbox" valid:"-"`
+	Signing               *SigningInfo   `yaml:"signing" valid:"-"`
 }
 
 // RefreshDuration returns RefreshInterval as a time.Duration
@@ -69,6 +78,15 @@ func (c *Config) ManagedDynamicConfigRefreshDuration() time.Duration {
 	return duration
 }
 
+// ShutdownGraceDuration returns ShutdownGrace as a time.Duration
+func (c *Config) ShutdownGraceDuration() time.Duration {
+	duration, err := time.ParseDuration(c.ShutdownGrace)
+	if err != nil {
+		panic(errorBadShutdownGrace)
+	}
+	return duration
+}
+
 // DockerEnabled returns true when enabled_engines includes "docker"
 func (c *Config) DockerEnabled() bool {
 	return c.engineEnabled(DockerEngine)
@@ -96,6 +114,42 @@ func (c *Config) Verify() error {
 	if c.ManagedDynamicConfig == true && c.DynamicConfigRoot == "" {
 		return errorMissingDynamicConfigRoot
 	}
+	if duration, err := time.ParseDuration(c.ShutdownGrace); err != nil || duration < 0 {
+		return errorBadShutdownGrace
+	}
+	if c.QueueDepth <= 0 {
+		return errorBadQueueDepth
+	}
+	if c.Cog != nil {
+		if err := c.Cog.verify(); err != nil {
+			return err
+		}
+	}
+	if c.Execution != nil {
+		if err := c.Execution.verify(); err != nil {
+			return err
+		}
+	}
+	if c.Trace != nil {
+		if err := c.Trace.verify(); err != nil {
+			return err
+		}
+	}
+	if c.Audit != nil {
+		if err := c.Audit.verify(); err != nil {
+			return err
+		}
+	}
+	if c.Outbox != nil {
+		if err := c.Outbox.verify(); err != nil {
+			return err
+		}
+	}
+	if c.Signing != nil {
+		if err := c.Signing.verify(); err != nil {
+			return err
+		}
+	}
 	if c.ManagedDynamicConfig == true {
 		c.DynamicConfigRoot = path.Join(c.DynamicConfigRoot, ManagedDynamicConfigLink)
 	}
@@ -121,6 +175,27 @@ func (c *Config) populate() {
 	setDefaultValues(c.Execution)
 	setEnvVars(c.Execution)
 	c.Execution.parse()
+	if c.Trace == nil {
+		c.Trace = &TraceInfo{}
+	}
+	setDefaultValues(c.Trace)
+	setEnvVars(c.Trace)
+	if c.Audit == nil {
+		c.Audit = &AuditInfo{}
+	}
+	setDefaultValues(c.Audit)
+	setEnvVars(c.Audit)
+	c.Audit.parse()
+	if c.Outbox == nil {
+		c.Outbox = &OutboxInfo{}
+	}
+	setDefaultValues(c.Outbox)
+	setEnvVars(c.Outbox)
+	if c.Signing == nil {
+		c.Signing = &SigningInfo{}
+	}
+	setDefaultValues(c.Signing)
+	setEnvVars(c.Signing)
 	c.parseEngines()
 }
 
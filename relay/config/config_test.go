@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/base64"
+	"github.com/operable/go-relay/relay/bus"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -73,6 +76,12 @@ func TestApplyConfigDefaults(t *testing.T) {
 	if config.MaxConcurrent != 16 {
 		t.Errorf("Expected default max_concurrent of 16: %d", config.MaxConcurrent)
 	}
+	if config.QueueDepth != 64 {
+		t.Errorf("Expected default queue_depth of 64: %d", config.QueueDepth)
+	}
+	if config.ShutdownGraceDuration() != 30*time.Second {
+		t.Errorf("Expected default shutdown_grace of 30s: %s", config.ShutdownGrace)
+	}
 	cog := config.Cog
 	if cog.Host != "127.0.0.1" {
 		t.Errorf("Expected default cog/host of '127.0.0.1': %s", cog.Host)
@@ -88,6 +97,342 @@ func TestApplyConfigDefaults(t *testing.T) {
 	if docker.RegistryHost != "index.docker.io" {
 		t.Errorf("Expected default docker/registry_host of 'index.docker.io': %s", docker.RegistryHost)
 	}
+	if config.Execution.Timeout != "10m" {
+		t.Errorf("Expected default execution/timeout of '10m': %s", config.Execution.Timeout)
+	}
+}
+
+func TestBadExecutionTimeout(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_EXECUTION_TIMEOUT", "soon")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != errorBadExecutionTimeout {
+		t.Errorf("Expected Verify() to reject bad execution/timeout: %v", err)
+	}
+}
+
+func TestBadQueueDepth(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	for _, depth := range []int{0, -1} {
+		config.QueueDepth = depth
+		if err := config.Verify(); err != errorBadQueueDepth {
+			t.Errorf("Expected Verify() to reject queue_depth of %d: %v", depth, err)
+		}
+	}
+}
+
+func TestBadStreamBatch(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	for _, batch := range []int{0, -1} {
+		config.Execution.StreamBatch = batch
+		if err := config.Verify(); err != errorBadStreamBatch {
+			t.Errorf("Expected Verify() to reject execution/stream_batch_lines of %d: %v", batch, err)
+		}
+	}
+}
+
+func TestBadBundlePriority(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	config.Execution.Priorities = map[string]string{"ec2": "urgent"}
+	if err := config.Verify(); err == nil {
+		t.Error("Expected Verify() to reject unknown bundle priority")
+	}
+	if lane, ok := PriorityLane(LowPriority); ok == false || lane != 2 {
+		t.Errorf("Expected low priority to map to lane 2: %d", lane)
+	}
+}
+
+func TestBadTransport(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_COG_TRANSPORT", "amqp")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != errorBadTransport {
+		t.Errorf("Expected Verify() to reject unknown cog/transport: %v", err)
+	}
+	config.Cog.Transport = bus.NATSTransport
+	if err := config.Verify(); err != nil {
+		t.Errorf("Expected Verify() to accept nats transport: %s", err)
+	}
+	bus.RegisterTransport("amqp", bus.NewMemoryBroker().Transport())
+	config.Cog.Transport = "amqp"
+	if err := config.Verify(); err != nil {
+		t.Errorf("Expected Verify() to accept registered transport: %s", err)
+	}
+}
+
+func TestWebSocketConfig(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_COG_WEBSOCKET", "true")
+	os.Setenv("RELAY_COG_ENABLE_SSL", "true")
+	os.Setenv("RELAY_COG_PORT", "443")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if url := config.Cog.URL(); url != "wss://127.0.0.1:443/mqtt" {
+		t.Errorf("Unexpected WebSocket URL: %s", url)
+	}
+	config.Cog.ProxyURL = "socks5://proxy:1080"
+	if err := config.Verify(); err != errorBadProxyURL {
+		t.Errorf("Expected Verify() to reject non-HTTP proxy: %v", err)
+	}
+	config.Cog.ProxyURL = ""
+	config.Cog.Transport = bus.NATSTransport
+	if err := config.Verify(); err != errorMQTTOnlyOption {
+		t.Errorf("Expected Verify() to reject WebSockets over NATS: %v", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_COG_SSL_CLIENT_CERT_PATH", "/etc/relay/client.pem")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != errorIncompleteClientCert {
+		t.Errorf("Expected Verify() to require a client key: %v", err)
+	}
+	config.Cog.SSLClientKey = "/etc/relay/client.key"
+	config.Cog.SSLMinVersion = "1.4"
+	if err := config.Verify(); err != errorBadTLSVersion {
+		t.Errorf("Expected Verify() to reject unknown TLS version: %v", err)
+	}
+	config.Cog.SSLMinVersion = "1.2"
+	config.Cog.SSLCiphers = "TLS_RSA_WITH_RC4_128_SHA"
+	if err := config.Verify(); err == nil {
+		t.Error("Expected Verify() to reject insecure cipher suite")
+	}
+	config.Cog.SSLCiphers = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	if err := config.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if suites := config.Cog.TLSCipherSuites(); len(suites) != 2 {
+		t.Errorf("Expected 2 cipher suites: %v", suites)
+	}
+	if config.Cog.SSLInsecure {
+		t.Error("Expected certificate verification to be on by default")
+	}
+}
+
+func TestBrokerEndpoints(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_COG_ENDPOINTS", "cog-a.example.com:1883, cog-b.example.com")
+	os.Setenv("RELAY_COG_PORT", "8883")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := config.Cog.BrokerEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Port != 1883 || endpoints[1].Host != "cog-b.example.com" || endpoints[1].Port != 8883 {
+		t.Errorf("Unexpected broker endpoints: %v", endpoints)
+	}
+	config.Cog.Endpoints = "cog-a.example.com:http"
+	if err := config.Verify(); err == nil {
+		t.Error("Expected Verify() to reject bad endpoint port")
+	}
+	config.Cog.Endpoints = ""
+	config.Cog.Failover = "roundrobin"
+	if err := config.Verify(); err != errorBadFailover {
+		t.Errorf("Expected Verify() to reject unknown failover strategy: %v", err)
+	}
+	if endpoints := config.Cog.BrokerEndpoints(); len(endpoints) != 1 || endpoints[0].Host != "127.0.0.1" {
+		t.Errorf("Expected host and port without endpoints: %v", endpoints)
+	}
+}
+
+func TestOutboxConfig(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if config.Outbox.Capacity != 1000 || config.Outbox.TTLDuration() != 5*time.Minute {
+		t.Errorf("Unexpected outbox defaults: %d %s", config.Outbox.Capacity, config.Outbox.TTL)
+	}
+	config.Outbox.TTL = "0s"
+	if err := config.Verify(); err != errorBadOutboxTTL {
+		t.Errorf("Expected Verify() to reject zero outbox/ttl: %v", err)
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if config.Cog.EncryptionEnabled() {
+		t.Errorf("Expected encryption to be disabled by default")
+	}
+	config.Cog.PreviousKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := config.Verify(); err != errorMissingEncryptionKey {
+		t.Errorf("Expected Verify() to require cog/encryption_key: %v", err)
+	}
+	config.Cog.EncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 16))
+	if err := config.Verify(); err != errorBadEncryptionKey {
+		t.Errorf("Expected Verify() to reject short key: %v", err)
+	}
+	config.Cog.EncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := config.Verify(); err != nil {
+		t.Errorf("Expected encryption config to verify: %s", err)
+	}
+	if current, previous := config.Cog.EncryptionKeys(); len(current) != 32 || len(previous) != 32 {
+		t.Errorf("Unexpected encryption keys: %v %v", current, previous)
+	}
+}
+
+func TestSigningConfig(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if config.Signing.Enabled() || config.Signing.ReplayWindowDuration() != 5*time.Minute {
+		t.Errorf("Unexpected signing defaults: %s %s", config.Signing.Algorithm, config.Signing.ReplayWindow)
+	}
+	config.Signing.Algorithm = "md5"
+	if err := config.Verify(); err != errorBadSigningAlgorithm {
+		t.Errorf("Expected Verify() to reject unknown signing algorithm: %v", err)
+	}
+	config.Signing.Algorithm = HMACSigning
+	if err := config.Verify(); err != errorMissingHMACKey {
+		t.Errorf("Expected Verify() to require signing/key: %v", err)
+	}
+	config.Signing.Key = "sekrit"
+	if err := config.Verify(); err != errorMissingSigningKeyID {
+		t.Errorf("Expected Verify() to require signing/key_id: %v", err)
+	}
+	config.Signing.KeyID = "relay-1"
+	if err := config.Verify(); err != nil {
+		t.Errorf("Expected HMAC signing config to verify: %s", err)
+	}
+	if config.Signing.WillMaxAgeDuration() != 24*time.Hour {
+		t.Errorf("Unexpected signing/will_max_age default: %s", config.Signing.WillMaxAge)
+	}
+	config.Signing.WillMaxAge = "1m"
+	if err := config.Verify(); err != errorBadWillMaxAge {
+		t.Errorf("Expected Verify() to reject will_max_age shorter than replay_window: %v", err)
+	}
+}
+
+func TestBackoffConfig(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_COG_BACKOFF_STRATEGY", "linear")
+	os.Setenv("RELAY_COG_BACKOFF_MAX_ATTEMPTS", "10")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Cog.BackoffBaseDuration() != 5*time.Second || config.Cog.BackoffJitterPercent() != 20 || config.Cog.BackoffAttempts != 10 {
+		t.Errorf("Unexpected backoff settings: %s %s %d", config.Cog.BackoffBase, config.Cog.BackoffJitter,
+			config.Cog.BackoffAttempts)
+	}
+	config.Cog.BackoffJitter = "101"
+	if err := config.Verify(); err != errorBadBackoffLimits {
+		t.Errorf("Expected Verify() to reject jitter over 100: %v", err)
+	}
+	config.Cog.BackoffJitter = "20"
+	config.Cog.BackoffCap = "1s"
+	if err := config.Verify(); err != errorBadBackoffDuration {
+		t.Errorf("Expected Verify() to reject cap below base: %v", err)
+	}
+	config.Cog.BackoffCap = "1m"
+	config.Cog.BackoffStrategy = "fibonacci"
+	if err := config.Verify(); err != errorBadBackoffStrategy {
+		t.Errorf("Expected Verify() to reject unknown strategy: %v", err)
+	}
+}
+
+func TestNoBackoffJitter(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(`id: 2bba0d1f-a30c-45ec-87e6-e4c5d8c6104f
+version: 1
+enabled_engines: native
+cog:
+  token: wubba
+  backoff_jitter: 0
+`)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if jitter := config.Cog.BackoffJitterPercent(); jitter != 0 {
+		t.Errorf("Expected backoff_jitter 0 to disable jitter: %d", jitter)
+	}
+}
+
+func TestTraceConfig(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RELAY_TRACE_EXPORTER", "file")
+	rawConfig := RawConfig(disabledDockerConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ManagedDynamicConfig = false
+	if err := config.Verify(); err != errorMissingTraceFile {
+		t.Errorf("Expected Verify() to require trace/file_path: %v", err)
+	}
+	config.Trace.Exporter = "zipkin"
+	if err := config.Verify(); err != errorBadTraceExporter {
+		t.Errorf("Expected Verify() to reject unknown trace exporter: %v", err)
+	}
 }
 
 func TestApplyEnvVars(t *testing.T) {
@@ -130,6 +475,30 @@ func TestApplyEnvVars(t *testing.T) {
 	}
 }
 
+func TestRedactedConfig(t *testing.T) {
+	os.Clearenv()
+	rawConfig := RawConfig(fullConfig)
+	config, err := rawConfig.Parse("0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := config.Redacted()
+	cog := redacted["cog"].(map[string]interface{})
+	if cog["token"] != redactedValue || cog["host"] != "127.0.0.1" {
+		t.Errorf("Expected cog/token to be redacted: %v", cog)
+	}
+	docker := redacted["docker"].(map[string]interface{})
+	if docker["registry_password"] != redactedValue || docker["registry_user"] != "testy" {
+		t.Errorf("Expected docker/registry_password to be redacted: %v", docker)
+	}
+	if cog["encryption_key"] != "" {
+		t.Errorf("Expected unset cog/encryption_key not to be redacted: %v", cog["encryption_key"])
+	}
+	if redacted["max_concurrent"] != 32 {
+		t.Errorf("Expected max_concurrent to be 32: %v", redacted["max_concurrent"])
+	}
+}
+
 func TestOnlyEnvVars(t *testing.T) {
 	os.Clearenv()
 	os.Setenv("RELAY_ID", "2bba0d1f-a30c-45ec-87e6-e4c5d8c6104f")
@@ -17,7 +17,7 @@ type DockerInfo struct {
 	RegistryHost         string `yaml:"registry_host" env:"RELAY_DOCKER_REGISTRY_HOST" valid:"host,required" default:"index.docker.io"`
 	RegistryUser         string `yaml:"registry_user" env:"RELAY_DOCKER_REGISTRY_USER" valid:"-"`
 	RegistryEmail        string `yaml:"registry_email" env:"RELAY_DOCKER_REGISTRY_EMAIL" valid:"-"`
-	RegistryPassword     string `yaml:"registry_password" env:"RELAY_DOCKER_REGISTRY_PASSWORD" valid:"-"`
+	RegistryPassword     string `yaml:"registry_password" env:"RELAY_DOCKER_REGISTRY_PASSWORD" valid:"-" secret:"true"`
 }
 
 // CleanDuration returns CleanInterval as a time.Duration
@@ -1,18 +1,115 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+var errorBadExecutionTimeout = errors.New("Error parsing execution/timeout")
+var errorBadStreamInterval = errors.New("Error parsing execution/stream_interval")
+var errorBadStreamBatch = errors.New("execution/stream_batch_lines must be greater than zero")
+var errorBadOversizePolicy = errors.New("execution/oversize_policy must be either 'truncate' or 'fail'")
+var errorBadOutputLimit = errors.New("execution/max_stdout and execution/max_stderr must be greater than zero")
+var errorBadPriorityAging = errors.New("Error parsing execution/priority_aging")
+
+// Output oversize policies
+const (
+	TruncateOversizeOutput = "truncate"
+	FailOversizeOutput     = "fail"
+)
+
+// Invocation priorities, highest first
+const (
+	HighPriority   = "high"
+	NormalPriority = "normal"
+	LowPriority    = "low"
+)
+
+var priorityLanes = []string{HighPriority, NormalPriority, LowPriority}
+
+// PriorityLane returns the scheduling lane for a priority name. Lane 0
+// is drained first. Returns false if the name isn't a known priority.
+func PriorityLane(priority string) (int, bool) {
+	for i, v := range priorityLanes {
+		if v == priority {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 // ExecutionInfo applies to every container for a given Relay host
 type ExecutionInfo struct {
-	ExtraEnv       []string `yaml:"env" env:"RELAY_CONTAINER_ENV"`
+	ExtraEnv       []string          `yaml:"env" env:"RELAY_CONTAINER_ENV" secret:"true"`
+	Timeout        string            `yaml:"timeout" env:"RELAY_EXECUTION_TIMEOUT" default:"10m"`
+	StreamInterval string            `yaml:"stream_interval" env:"RELAY_EXECUTION_STREAM_INTERVAL" default:"1s"`
+	StreamBatch    int               `yaml:"stream_batch_lines" env:"RELAY_EXECUTION_STREAM_BATCH_LINES" default:"25"`
+	MaxStdout      int               `yaml:"max_stdout" env:"RELAY_EXECUTION_MAX_STDOUT" default:"4194304"`
+	MaxStderr      int               `yaml:"max_stderr" env:"RELAY_EXECUTION_MAX_STDERR" default:"65536"`
+	OversizePolicy string            `yaml:"oversize_policy" env:"RELAY_EXECUTION_OVERSIZE_POLICY" default:"truncate"`
+	Concurrency    map[string]int    `yaml:"concurrency_limits"`
+	Weights        map[string]int    `yaml:"bundle_weights"`
+	Priorities     map[string]string `yaml:"bundle_priorities"`
+	PriorityAging  string            `yaml:"priority_aging" env:"RELAY_EXECUTION_PRIORITY_AGING" default:"30s"`
 	ParsedExtraEnv map[string]string
 }
 
+// TimeoutDuration returns Timeout as a time.Duration. A zero
+// duration disables the relay-wide timeout.
+func (execution *ExecutionInfo) TimeoutDuration() time.Duration {
+	duration, err := time.ParseDuration(execution.Timeout)
+	if err != nil {
+		panic(errorBadExecutionTimeout)
+	}
+	return duration
+}
+
+// StreamDuration returns StreamInterval as a time.Duration
+func (execution *ExecutionInfo) StreamDuration() time.Duration {
+	duration, err := time.ParseDuration(execution.StreamInterval)
+	if err != nil {
+		panic(errorBadStreamInterval)
+	}
+	return duration
+}
+
+// ConcurrencyLimit returns the configured concurrency limit for a
+// bundle ("name") or command ("bundle:command"). Returns 0 if the
+// relay config doesn't limit it.
+func (execution *ExecutionInfo) ConcurrencyLimit(name string) int {
+	return execution.Concurrency[name]
+}
+
+// BundleWeight returns the scheduling weight for a bundle. Bundles
+// default to a weight of 1.
+func (execution *ExecutionInfo) BundleWeight(name string) int {
+	if weight := execution.Weights[name]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// BundlePriority returns the configured priority for a bundle or ""
+// if the relay config doesn't set one.
+func (execution *ExecutionInfo) BundlePriority(name string) string {
+	return execution.Priorities[name]
+}
+
+// AgingDuration returns PriorityAging as a time.Duration. Waiting
+// invocations move up one priority lane each time this much time
+// passes. A zero duration disables aging.
+func (execution *ExecutionInfo) AgingDuration() time.Duration {
+	duration, err := time.ParseDuration(execution.PriorityAging)
+	if err != nil {
+		panic(errorBadPriorityAging)
+	}
+	return duration
+}
+
 func (execution *ExecutionInfo) parse() {
 	execution.ParsedExtraEnv = make(map[string]string)
 	for _, v := range execution.ExtraEnv {
@@ -27,3 +124,40 @@ func (execution *ExecutionInfo) parse() {
 		}
 	}
 }
+
+func (execution *ExecutionInfo) verify() error {
+	if duration, err := time.ParseDuration(execution.Timeout); err != nil || duration < 0 {
+		return errorBadExecutionTimeout
+	}
+	if duration, err := time.ParseDuration(execution.StreamInterval); err != nil || duration <= 0 {
+		return errorBadStreamInterval
+	}
+	if execution.StreamBatch <= 0 {
+		return errorBadStreamBatch
+	}
+	if execution.MaxStdout <= 0 || execution.MaxStderr <= 0 {
+		return errorBadOutputLimit
+	}
+	for name, limit := range execution.Concurrency {
+		if limit < 0 {
+			return fmt.Errorf("execution/concurrency_limits for %s must not be negative", name)
+		}
+	}
+	for name, weight := range execution.Weights {
+		if weight < 1 {
+			return fmt.Errorf("execution/bundle_weights for %s must be at least 1", name)
+		}
+	}
+	for name, priority := range execution.Priorities {
+		if _, ok := PriorityLane(priority); ok == false {
+			return fmt.Errorf("execution/bundle_priorities for %s must be one of %s", name, strings.Join(priorityLanes, ", "))
+		}
+	}
+	if duration, err := time.ParseDuration(execution.PriorityAging); err != nil || duration < 0 {
+		return errorBadPriorityAging
+	}
+	if execution.OversizePolicy != TruncateOversizeOutput && execution.OversizePolicy != FailOversizeOutput {
+		return errorBadOversizePolicy
+	}
+	return nil
+}
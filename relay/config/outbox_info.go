@@ -0,0 +1,36 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+var errorBadOutboxCapacity = errors.New("outbox/capacity must be greater than zero")
+var errorBadOutboxTTL = errors.New("Error parsing outbox/ttl")
+
+// OutboxInfo configures buffering of replies which couldn't be
+// published while the message bus was unavailable
+type OutboxInfo struct {
+	Capacity int    `yaml:"capacity" env:"RELAY_OUTBOX_CAPACITY" default:"1000"`
+	TTL      string `yaml:"ttl" env:"RELAY_OUTBOX_TTL" default:"5m"`
+	Path     string `yaml:"path" env:"RELAY_OUTBOX_PATH"`
+}
+
+// TTLDuration returns TTL as a time.Duration
+func (outbox *OutboxInfo) TTLDuration() time.Duration {
+	duration, err := time.ParseDuration(outbox.TTL)
+	if err != nil {
+		panic(errorBadOutboxTTL)
+	}
+	return duration
+}
+
+func (outbox *OutboxInfo) verify() error {
+	if outbox.Capacity <= 0 {
+		return errorBadOutboxCapacity
+	}
+	if duration, err := time.ParseDuration(outbox.TTL); err != nil || duration <= 0 {
+		return errorBadOutboxTTL
+	}
+	return nil
+}
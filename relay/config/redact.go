@@ -0,0 +1,52 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// redactedValue replaces secrets in redacted configs
+const redactedValue = "********"
+
+// Redacted returns the effective configuration keyed by config file
+// names. Fields tagged `secret:"true"` are replaced when set so the
+// result is safe to display.
+func (c *Config) Redacted() map[string]interface{} {
+	return redactStruct(reflect.ValueOf(c).Elem())
+}
+
+func redactStruct(config reflect.Value) map[string]interface{} {
+	retval := make(map[string]interface{})
+	configType := config.Type()
+	for i := 0; i < config.NumField(); i++ {
+		f := config.Field(i)
+		fdef := configType.Field(i)
+		name := strings.Split(fdef.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		switch {
+		case fdef.Tag.Get("secret") == "true":
+			if isZero(f) {
+				retval[name] = f.Interface()
+			} else {
+				retval[name] = redactedValue
+			}
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			if f.IsNil() {
+				retval[name] = nil
+			} else {
+				retval[name] = redactStruct(f.Elem())
+			}
+		default:
+			retval[name] = f.Interface()
+		}
+	}
+	return retval
+}
+
+// isZero reports whether value holds its type's zero value. Unset
+// secrets are shown as they are so it's clear they're missing.
+func isZero(value reflect.Value) bool {
+	return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
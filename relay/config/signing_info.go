@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// Message signing algorithms
+const (
+	NoSigning      = "none"
+	HMACSigning    = "hmac-sha256"
+	Ed25519Signing = "ed25519"
+)
+
+var errorBadSigningAlgorithm = errors.New("signing/algorithm must be one of 'none', 'hmac-sha256' or 'ed25519'")
+var errorMissingSigningKeyID = errors.New("Message signing requires setting 'signing/key_id'.")
+var errorMissingHMACKey = errors.New("HMAC message signing requires setting 'signing/key'.")
+var errorMissingEd25519Keys = errors.New("Ed25519 message signing requires 'signing/private_key_path' and at least one of 'signing/public_keys'.")
+var errorBadReplayWindow = errors.New("Error parsing signing/replay_window")
+var errorBadWillMaxAge = errors.New("signing/will_max_age must be a duration no shorter than signing/replay_window")
+
+// SigningInfo configures signing of published messages and
+// verification of received ones
+type SigningInfo struct {
+	Algorithm      string            `yaml:"algorithm" env:"RELAY_SIGNING_ALGORITHM" default:"none"`
+	KeyID          string            `yaml:"key_id" env:"RELAY_SIGNING_KEY_ID"`
+	Key            string            `yaml:"key" env:"RELAY_SIGNING_KEY" secret:"true"`
+	PrivateKeyPath string            `yaml:"private_key_path" env:"RELAY_SIGNING_PRIVATE_KEY_PATH"`
+	PublicKeys     map[string]string `yaml:"public_keys"`
+	AllowUnsigned  bool              `yaml:"allow_unsigned" env:"RELAY_SIGNING_ALLOW_UNSIGNED" default:"false"`
+	ReplayWindow   string            `yaml:"replay_window" env:"RELAY_SIGNING_REPLAY_WINDOW" default:"5m"`
+	WillMaxAge     string            `yaml:"will_max_age" env:"RELAY_SIGNING_WILL_MAX_AGE" default:"24h"`
+}
+
+// Enabled returns true when a signing algorithm is selected
+func (signing *SigningInfo) Enabled() bool {
+	return signing.Algorithm != NoSigning
+}
+
+// ReplayWindowDuration returns ReplayWindow as a time.Duration
+func (signing *SigningInfo) ReplayWindowDuration() time.Duration {
+	duration, err := time.ParseDuration(signing.ReplayWindow)
+	if err != nil {
+		panic(errorBadReplayWindow)
+	}
+	return duration
+}
+
+// WillMaxAgeDuration returns WillMaxAge as a time.Duration
+func (signing *SigningInfo) WillMaxAgeDuration() time.Duration {
+	duration, err := time.ParseDuration(signing.WillMaxAge)
+	if err != nil {
+		panic(errorBadWillMaxAge)
+	}
+	return duration
+}
+
+func (signing *SigningInfo) verify() error {
+	switch signing.Algorithm {
+	case NoSigning:
+		return nil
+	case HMACSigning:
+		if signing.Key == "" {
+			return errorMissingHMACKey
+		}
+	case Ed25519Signing:
+		if signing.PrivateKeyPath == "" || len(signing.PublicKeys) == 0 {
+			return errorMissingEd25519Keys
+		}
+	default:
+		return errorBadSigningAlgorithm
+	}
+	if signing.KeyID == "" {
+		return errorMissingSigningKeyID
+	}
+	window, err := time.ParseDuration(signing.ReplayWindow)
+	if err != nil || window <= 0 {
+		return errorBadReplayWindow
+	}
+	if maxAge, err := time.ParseDuration(signing.WillMaxAge); err != nil || maxAge < window {
+		return errorBadWillMaxAge
+	}
+	return nil
+}
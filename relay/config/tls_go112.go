@@ -0,0 +1,13 @@
+//go:build go1.12
+// +build go1.12
+
+package config
+
+import (
+	"crypto/tls"
+)
+
+// TLS 1.3 is only available from Go 1.12
+func init() {
+	tlsVersions["1.3"] = tls.VersionTLS13
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+)
+
+// Trace exporters
+const (
+	NoTraceExporter   = "none"
+	OTLPTraceExporter = "otlp"
+	FileTraceExporter = "file"
+)
+
+var errorBadTraceExporter = errors.New("trace/exporter must be one of 'none', 'otlp' or 'file'")
+var errorBadTraceEndpoint = errors.New("trace/endpoint must be an http or https URL")
+var errorMissingTraceFile = errors.New("Using the 'file' trace exporter requires setting 'trace/file_path'.")
+
+// TraceInfo configures tracing of command invocations
+type TraceInfo struct {
+	Exporter    string `yaml:"exporter" env:"RELAY_TRACE_EXPORTER" default:"none"`
+	Endpoint    string `yaml:"endpoint" env:"RELAY_TRACE_ENDPOINT" default:"http://127.0.0.1:4318/v1/traces"`
+	FilePath    string `yaml:"file_path" env:"RELAY_TRACE_FILE_PATH"`
+	ServiceName string `yaml:"service_name" env:"RELAY_TRACE_SERVICE_NAME" default:"cog-relay"`
+}
+
+func (trace *TraceInfo) verify() error {
+	switch trace.Exporter {
+	case NoTraceExporter:
+	case OTLPTraceExporter:
+		endpoint, err := url.Parse(trace.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return errorBadTraceEndpoint
+		}
+	case FileTraceExporter:
+		if trace.FilePath == "" {
+			return errorMissingTraceFile
+		}
+	default:
+		return errorBadTraceExporter
+	}
+	return nil
+}
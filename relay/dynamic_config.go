@@ -21,8 +21,8 @@ import (
 type DynamicConfigUpdater struct {
 	id                string
 	configTopic       string
-	options           bus.ConnectionOptions
 	conn              bus.Connection
+	connected         bool
 	dynamicConfigRoot string
 	lastSignature     string
 	control           chan interface{}
@@ -30,13 +30,14 @@ type DynamicConfigUpdater struct {
 	refreshTimer      *time.Timer
 }
 
-// NewDynamicConfigUpdater creates a new updater
-func NewDynamicConfigUpdater(relayID string, busOpts bus.ConnectionOptions, dynamicConfigRoot string,
+// NewDynamicConfigUpdater creates a new updater. conn is usually
+// shared with the rest of the Relay through a bus.ConnectionManager.
+func NewDynamicConfigUpdater(relayID string, conn bus.Connection, dynamicConfigRoot string,
 	refreshInterval time.Duration) *DynamicConfigUpdater {
 	return &DynamicConfigUpdater{
 		id:                relayID,
 		configTopic:       fmt.Sprintf("bot/relays/%s/dynconfigs", relayID),
-		options:           busOpts,
+		conn:              conn,
 		dynamicConfigRoot: dynamicConfigRoot,
 		refreshInterval:   refreshInterval,
 		control:           make(chan interface{}),
@@ -46,10 +47,7 @@ func NewDynamicConfigUpdater(relayID string, busOpts bus.ConnectionOptions, dyna
 func (dcu *DynamicConfigUpdater) Run() error {
 	log.Infof("Managed bundle dynamic configs enabled.")
 	log.Infof("Refreshing bundle dynamic configs every %v.", dcu.refreshInterval)
-	dcu.options.AutoReconnect = true
-	dcu.options.EventsHandler = dcu.handleBusEvents
-	conn := &bus.MQTTConnection{}
-	if err := conn.Connect(dcu.options); err != nil {
+	if err := dcu.conn.Connect(bus.ConnectionOptions{EventsHandler: dcu.handleBusEvents}); err != nil {
 		return err
 	}
 	dcu.refreshConfigs()
@@ -60,18 +58,29 @@ func (dcu *DynamicConfigUpdater) Run() error {
 	return nil
 }
 
-// Halt tells the DCU to stop.
+// Halt tells the DCU to stop. Its subscriptions are released.
 func (dcu *DynamicConfigUpdater) Halt() {
 	dcu.control <- 1
 }
 
-func (dcu *DynamicConfigUpdater) handleBusEvents(conn bus.Connection, event bus.Event) {
-	if event == bus.ConnectedEvent {
-		dcu.conn = conn
+func (dcu *DynamicConfigUpdater) handleBusEvents(conn bus.Connection, event bus.Event, info bus.EventInfo) {
+	switch event {
+	case bus.ConnectedEvent:
+		if dcu.connected {
+			log.Info("Resuming bundle dynamic config refreshes.")
+			dcu.refreshConfigs()
+			return
+		}
+		dcu.connected = true
 		if err := dcu.conn.Subscribe(dcu.configTopic, dcu.dynConfigUpdate); err != nil {
 			log.Errorf("Failed to set up dynamic config updater subscriptions: %s.", err)
 			panic(err)
 		}
+	case bus.DisconnectedEvent:
+		log.Warnf("Pausing bundle dynamic config refreshes: %s.", info.Cause)
+		if dcu.refreshTimer != nil {
+			dcu.refreshTimer.Stop()
+		}
 	}
 }
 
@@ -81,14 +90,20 @@ func (dcu *DynamicConfigUpdater) dynConfigUpdate(conn bus.Connection, topic stri
 	decoder := util.NewJSONDecoder(bytes.NewReader(payload))
 	if err := decoder.Decode(&envelope); err != nil {
 		log.Errorf("Error decoding GetDynamicConfigs result: %s.", err)
+		dynConfigRefreshes.Inc("failed")
+		return
 	}
 	if envelope.Signature != dcu.lastSignature && envelope.Changed == true {
 		if dcu.updateConfigs(envelope.Signature, envelope.Configs) {
 			dcu.lastSignature = envelope.Signature
 			dcu.cleanOldConfigs()
 			log.Info("Updated bundle dynamic configs.")
-
+			dynConfigRefreshes.Inc("updated")
+		} else {
+			dynConfigRefreshes.Inc("failed")
 		}
+	} else {
+		dynConfigRefreshes.Inc("unchanged")
 	}
 }
 
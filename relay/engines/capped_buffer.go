@@ -0,0 +1,40 @@
+package engines
+
+import (
+	"bytes"
+)
+
+// cappedBuffer is an io.Writer which keeps at most limit+1 bytes and
+// silently discards the rest. Keeping one byte over the limit lets
+// readers detect the output was cut short. Writes never fail so
+// commands don't see broken pipes.
+type cappedBuffer struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{
+		limit: limit,
+	}
+}
+
+func (cb *cappedBuffer) Write(data []byte) (int, error) {
+	room := cb.limit + 1 - cb.buffer.Len()
+	if room > 0 {
+		if len(data) > room {
+			cb.buffer.Write(data[:room])
+		} else {
+			cb.buffer.Write(data)
+		}
+	}
+	return len(data), nil
+}
+
+func (cb *cappedBuffer) WriteString(data string) (int, error) {
+	return cb.Write([]byte(data))
+}
+
+func (cb *cappedBuffer) Bytes() []byte {
+	return cb.buffer.Bytes()
+}
@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 )
 
 const (
@@ -34,6 +35,7 @@ type DockerEngine struct {
 	config      config.DockerInfo
 	auth        string
 	cache       *envCache
+	lock        sync.Mutex
 }
 
 // NewDockerEngine makes a new DockerEngine instance
@@ -76,14 +78,17 @@ func (de *DockerEngine) IsAvailable(name string, meta string) (bool, error) {
 	pullErr := de.pullImage(fullName)
 	if pullErr != nil {
 		log.Errorf("Error ocurred pulling image %s: %s.", name, pullErr)
+		imagePulls.Inc("failure")
 		return false, pullErr
 	}
 	log.Debugf("Retrieved %s from upstream Docker registry.", fullName)
 	afterID, err := de.IDForName(name, meta)
 	if err != nil {
 		log.Errorf("Image pull completed but no image available for name %s : %s", fullName, err)
+		imagePulls.Inc("failure")
 		return false, err
 	}
+	imagePulls.Inc("success")
 	de.removeOldImage(beforeID, afterID, fullName)
 	return true, nil
 }
@@ -106,6 +111,26 @@ func (de *DockerEngine) ReleaseEnvironment(pipelineID string, bundle *config.Bun
 	}
 }
 
+// KillEnvironment is required by the engines.Engine interface. The
+// environment's container is forcibly removed, the environment is shut
+// down and it is never returned to the cache.
+func (de *DockerEngine) KillEnvironment(pipelineID string, bundle *config.Bundle, env circuit.Environment) {
+	key := makeKey(pipelineID, bundle)
+	de.cache.remove(key, env)
+	containerID := env.GetMetadata()["container"]
+	if containerID != "" && de.ensureConnected() == nil {
+		if err := de.removeContainer(containerID); err != nil {
+			log.Errorf("Error killing Docker container %s: %s.", shortContainerID(containerID), err)
+		} else {
+			log.Infof("Killed Docker container %s for %s.", shortContainerID(containerID), key)
+		}
+	}
+	// The command driver only sees Shutdown once the killed command
+	// has returned, which removing the container forces. Its error is
+	// ignored since the container is usually gone by then.
+	go env.Shutdown()
+}
+
 // IDForName returns the image ID for a given image name
 func (de *DockerEngine) IDForName(name string, meta string) (string, error) {
 	err := de.ensureConnected()
@@ -215,6 +240,8 @@ func (de *DockerEngine) createCircuitDriver() error {
 }
 
 func (de *DockerEngine) attemptAuth() error {
+	de.lock.Lock()
+	defer de.lock.Unlock()
 	if de.auth == "" {
 		authConfig := de.makeAuthConfig()
 		if authConfig == nil {
@@ -269,21 +296,24 @@ func (de *DockerEngine) newEnvironment(bundle *config.Bundle) (circuit.Environme
 	if err != nil {
 		return nil, err
 	}
-	client, err := newClient(de.config)
-	if err != nil {
+	if err := de.ensureConnected(); err != nil {
 		return nil, err
 	}
 	options := circuit.CreateEnvironmentOptions{}
 	options.Kind = circuit.DockerKind
 	options.Bundle = bundle.Name
-	options.DockerOptions.Conn = client
+	options.DockerOptions.Conn = de.client
 	options.DockerOptions.Image = bundle.Docker.Image
 	options.DockerOptions.Tag = bundle.Docker.Tag
 	options.DockerOptions.Binds = bundle.Docker.Binds
 	options.DockerOptions.DriverInstance = "cog-circuit-driver"
 	options.DockerOptions.DriverPath = "/operable/circuit/bin/circuit-driver"
 	options.DockerOptions.Memory = int64(de.relayConfig.Docker.ContainerMemory * megabyte)
-	return circuit.CreateEnvironment(options)
+	env, err := circuit.CreateEnvironment(options)
+	if err != nil {
+		return nil, err
+	}
+	return newDockerEnvironment(env, de.client, de.relayConfig.Execution), nil
 }
 
 func (de *DockerEngine) needsUpdate(name, meta string) bool {
@@ -309,10 +339,13 @@ func (de *DockerEngine) pullImage(fullName string) error {
 	if err != nil {
 		return err
 	}
+	de.lock.Lock()
+	auth := de.auth
+	de.lock.Unlock()
 	closer, pullErr := de.client.ImagePull(context.Background(), fullName,
 		types.ImagePullOptions{
 			All:          false,
-			RegistryAuth: de.auth,
+			RegistryAuth: auth,
 		})
 	if closer != nil {
 		ioutil.ReadAll(closer)
@@ -342,7 +375,11 @@ func (de *DockerEngine) removeOldImage(oldID, newID, fullName string) {
 	}
 }
 
+// ensureConnected creates the engine's Docker client. The client is
+// shared by every environment the engine creates.
 func (de *DockerEngine) ensureConnected() error {
+	de.lock.Lock()
+	defer de.lock.Unlock()
 	if de.client == nil {
 		client, err := newClient(de.config)
 		if err != nil {
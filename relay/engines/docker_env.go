@@ -0,0 +1,160 @@
+package engines
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// execEnvVersion is the first Docker API version which lets docker
+// exec set the command's environment
+const execEnvVersion = "1.25"
+
+// dockerEnvironment wraps circuit's Docker environment. Streaming
+// commands run with docker exec in the environment's container so
+// their output can be read as it is written and capped while it's
+// read; circuit's command driver returns all of a command's output at
+// once, after it has finished. Other commands use the driver.
+type dockerEnvironment struct {
+	circuit.Environment
+	client    *client.Client
+	maxStdout int
+	maxStderr int
+	lock      sync.Mutex
+	exitCode  int
+	exited    bool
+}
+
+func newDockerEnvironment(env circuit.Environment, client *client.Client, execution *config.ExecutionInfo) *dockerEnvironment {
+	return &dockerEnvironment{
+		Environment: env,
+		client:      client,
+		maxStdout:   execution.MaxStdout,
+		maxStderr:   execution.MaxStderr,
+	}
+}
+
+// Run is required by the circuit.Environment interface. The command
+// driver only reports success or failure, so no exit code is recorded.
+func (de *dockerEnvironment) Run(request api.ExecRequest) (api.ExecResult, error) {
+	de.setExitCode(0, false)
+	return de.Environment.Run(request)
+}
+
+// RunStreaming is required by the engines.StreamingEnvironment
+// interface. stdout, if not nil, receives output as it is written.
+// Docker daemons too old to set an exec's environment run the command
+// through the command driver instead, without streaming or capping.
+func (de *dockerEnvironment) RunStreaming(request api.ExecRequest, output io.Writer) (api.ExecResult, error) {
+	if versions.LessThan(de.client.ClientVersion(), execEnvVersion) {
+		return de.Run(request)
+	}
+	stdout := newCappedBuffer(de.maxStdout)
+	stderr := newCappedBuffer(de.maxStderr)
+	var stdoutWriter io.Writer = stdout
+	if output != nil {
+		stdoutWriter = io.MultiWriter(stdout, output)
+	}
+	execConfig := types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          execEnv(request),
+		Cmd:          []string{request.GetExecutable()},
+	}
+	ctx := context.Background()
+	start := time.Now()
+	created, err := de.client.ContainerExecCreate(ctx, de.GetMetadata()["container"], execConfig)
+	if err != nil {
+		return circuit.EmptyExecResult, err
+	}
+	attached, err := de.client.ContainerExecAttach(ctx, created.ID, execConfig)
+	if err != nil {
+		return circuit.EmptyExecResult, err
+	}
+	defer attached.Close()
+	go func() {
+		attached.Conn.Write(request.Stdin)
+		attached.CloseWrite()
+	}()
+	if err := demuxOutput(attached.Reader, stdoutWriter, stderr); err != nil {
+		return circuit.EmptyExecResult, err
+	}
+	finish := time.Now()
+	inspect, err := de.client.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return circuit.EmptyExecResult, err
+	}
+	de.setExitCode(inspect.ExitCode, true)
+	result := api.ExecResult{}
+	result.SetElapsed(finish.Sub(start))
+	if inspect.ExitCode != 0 {
+		// Matches what the command driver reports
+		stderr.WriteString(fmt.Sprintf("exit status %d", inspect.ExitCode))
+		result.SetSuccess(false)
+	} else {
+		result.SetSuccess(true)
+	}
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	return result, nil
+}
+
+// LastExitCode is required by the engines.ExitCodeReporter interface
+func (de *dockerEnvironment) LastExitCode() (int, bool) {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	return de.exitCode, de.exited
+}
+
+func (de *dockerEnvironment) setExitCode(exitCode int, exited bool) {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	de.exitCode = exitCode
+	de.exited = exited
+}
+
+func execEnv(request api.ExecRequest) []string {
+	env := []string{}
+	for _, v := range request.Env {
+		env = append(env, fmt.Sprintf("%s=%s", v.GetName(), v.GetValue()))
+	}
+	return env
+}
+
+// demuxOutput copies a multiplexed Docker attach stream to stdout and
+// stderr until it ends. Each frame is an 8 byte header, holding the
+// stream id and the big-endian payload size, followed by the payload.
+func demuxOutput(reader io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var target io.Writer
+		switch header[0] {
+		case 1:
+			target = stdout
+		case 2:
+			target = stderr
+		default:
+			target = ioutil.Discard
+		}
+		if _, err := io.CopyN(target, reader, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package engines
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func dockerFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemuxOutput(t *testing.T) {
+	stream := bytes.Buffer{}
+	stream.Write(dockerFrame(1, "hello "))
+	stream.Write(dockerFrame(2, "oops"))
+	stream.Write(dockerFrame(1, "world\n"))
+	stdout := newCappedBuffer(8)
+	stderr := newCappedBuffer(1024)
+	if err := demuxOutput(&stream, stdout, stderr); err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout.Bytes()) != "hello wor" || string(stderr.Bytes()) != "oops" {
+		t.Errorf("Unexpected demultiplexed output: %q %q", stdout.Bytes(), stderr.Bytes())
+	}
+	truncated := bytes.NewReader(dockerFrame(1, "hello")[:10])
+	if err := demuxOutput(truncated, stdout, stderr); err == nil {
+		t.Error("Expected truncated frame to be reported")
+	}
+}
@@ -0,0 +1,54 @@
+package engines
+
+import (
+	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"testing"
+	"time"
+)
+
+type shutdownEnvironment struct {
+	shutdown chan bool
+}
+
+func (se *shutdownEnvironment) GetKind() circuit.EnvironmentKind {
+	return circuit.DockerKind
+}
+
+func (se *shutdownEnvironment) SetUserData(data circuit.EnvironmentUserData) error {
+	return nil
+}
+
+func (se *shutdownEnvironment) GetUserData() (circuit.EnvironmentUserData, error) {
+	return nil, nil
+}
+
+func (se *shutdownEnvironment) GetMetadata() circuit.EnvironmentMetadata {
+	return circuit.EnvironmentMetadata{}
+}
+
+func (se *shutdownEnvironment) Run(request api.ExecRequest) (api.ExecResult, error) {
+	return circuit.EmptyExecResult, nil
+}
+
+func (se *shutdownEnvironment) Shutdown() error {
+	se.shutdown <- true
+	return nil
+}
+
+func TestKillShutsDownDockerEnvironment(t *testing.T) {
+	engine := &DockerEngine{
+		cache: newEnvCache(),
+	}
+	env := &shutdownEnvironment{
+		shutdown: make(chan bool, 1),
+	}
+	bundle := &config.Bundle{Name: "test", Version: "1.0"}
+	engine.KillEnvironment("abc", bundle, env)
+	select {
+	case <-env.shutdown:
+	case <-time.After(time.Second):
+		t.Error("Expected killed environment to be shut down")
+	}
+}
@@ -3,7 +3,10 @@ package engines
 import (
 	"errors"
 	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
 	"github.com/operable/go-relay/relay/config"
+	"io"
+	"sync"
 )
 
 // EngineType is an enum describing the various engine types
@@ -27,13 +30,35 @@ type Engine interface {
 	IsAvailable(name string, meta string) (bool, error)
 	NewEnvironment(pipelineID string, bundle *config.Bundle) (circuit.Environment, error)
 	ReleaseEnvironment(pipelineID string, bundle *config.Bundle, env circuit.Environment)
+	KillEnvironment(pipelineID string, bundle *config.Bundle, env circuit.Environment)
 	Clean() int
 }
 
+// StreamingEnvironment is implemented by environments which can
+// report a command's stdout as it is produced.
+type StreamingEnvironment interface {
+	circuit.Environment
+	RunStreaming(request api.ExecRequest, stdout io.Writer) (api.ExecResult, error)
+}
+
+// ExitCodeReporter is implemented by environments which know the
+// exit code of the last command they ran.
+type ExitCodeReporter interface {
+	LastExitCode() (int, bool)
+}
+
+// ImageIdentifier is implemented by engines which run bundles from
+// images and can report the id of the image used.
+type ImageIdentifier interface {
+	IDForName(name string, meta string) (string, error)
+}
+
 // Engines knows how to create engines based on bundle type
 type Engines struct {
 	relayConfig *config.Config
 	cache       *envCache
+	lock        sync.Mutex
+	docker      Engine
 }
 
 // NewEngines constructs a new Engines instance
@@ -53,13 +78,40 @@ func (e *Engines) EngineForBundle(bundle *config.Bundle) (Engine, error) {
 	return e.GetEngine(NativeEngineType)
 }
 
-// GetEngine returns the specified engine (if available)
+// GetEngine returns the specified engine (if available). The Docker
+// engine is created once so every caller shares its Docker client.
 func (e *Engines) GetEngine(engineType EngineType) (Engine, error) {
 	if engineType == DockerEngineType {
-		if e.relayConfig.DockerEnabled() {
-			return NewDockerEngine(e.relayConfig, e.cache)
+		if e.relayConfig.DockerEnabled() == false {
+			return nil, ErrDockerDisabled
+		}
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.docker == nil {
+			docker, err := NewDockerEngine(e.relayConfig, e.cache)
+			if err != nil {
+				return nil, err
+			}
+			e.docker = docker
 		}
-		return nil, ErrDockerDisabled
+		return e.docker, nil
 	}
 	return NewNativeEngine(e.relayConfig)
 }
+
+// Shutdown shuts down every cached environment. Returns the number
+// of environments shut down.
+func (e *Engines) Shutdown() int {
+	count := 0
+	for _, env := range e.cache.drain() {
+		if env.Shutdown() == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// CachedEnvironments describes the environments currently cached
+func (e *Engines) CachedEnvironments() []CachedEnvironment {
+	return e.cache.snapshot()
+}
@@ -15,6 +15,14 @@ type cacheEntry struct {
 	lastUsed time.Time
 }
 
+// CachedEnvironment describes an entry in the environment cache
+type CachedEnvironment struct {
+	Key      string                      `json:"key"`
+	Metadata circuit.EnvironmentMetadata `json:"metadata"`
+	InUse    bool                        `json:"in_use"`
+	LastUsed time.Time                   `json:"last_used"`
+}
+
 type envCache struct {
 	envs map[string]*cacheEntry
 	lock sync.Mutex
@@ -38,8 +46,10 @@ func (ec *envCache) get(key string) circuit.Environment {
 		retval.inUse = true
 		retval.lastUsed = time.Now()
 		log.Debugf("Reusing environment for %s", key)
+		envCacheRequests.Inc("hit")
 		return retval.env
 	}
+	envCacheRequests.Inc("miss")
 	return nil
 }
 
@@ -66,6 +76,16 @@ func (ec *envCache) put(key string, env circuit.Environment) bool {
 	return true
 }
 
+// Remove drops the cache entry for key if it holds env. Used
+// when an environment is killed instead of released.
+func (ec *envCache) remove(key string, env circuit.Environment) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if entry := ec.envs[key]; entry != nil && entry.env == env {
+		delete(ec.envs, key)
+	}
+}
+
 func (ec *envCache) getOld() []circuit.Environment {
 	retval := []circuit.Environment{}
 	ec.lock.Lock()
@@ -81,3 +101,31 @@ func (ec *envCache) getOld() []circuit.Environment {
 	}
 	return retval
 }
+
+// drain empties the cache and returns every environment it held
+func (ec *envCache) drain() []circuit.Environment {
+	retval := []circuit.Environment{}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for key, value := range ec.envs {
+		delete(ec.envs, key)
+		retval = append(retval, value.env)
+	}
+	return retval
+}
+
+// snapshot describes every cached environment
+func (ec *envCache) snapshot() []CachedEnvironment {
+	retval := []CachedEnvironment{}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for key, value := range ec.envs {
+		retval = append(retval, CachedEnvironment{
+			Key:      key,
+			Metadata: value.env.GetMetadata(),
+			InUse:    value.inUse,
+			LastUsed: value.lastUsed,
+		})
+	}
+	return retval
+}
@@ -0,0 +1,10 @@
+package engines
+
+import (
+	"github.com/operable/go-relay/relay/metrics"
+)
+
+var envCacheRequests = metrics.NewCounter("relay_env_cache_requests_total",
+	"Environment cache lookups, by result (hit or miss).", "result")
+var imagePulls = metrics.NewCounter("relay_docker_image_pulls_total",
+	"Docker image pulls, by result (success or failure).", "result")
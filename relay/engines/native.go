@@ -37,10 +37,7 @@ func (ne *NativeEngine) IsAvailable(name string, version string) (bool, error) {
 
 // NewEnvironment is required by the engines.Engine interface
 func (ne *NativeEngine) NewEnvironment(pipelineID string, bundle *config.Bundle) (circuit.Environment, error) {
-	options := circuit.CreateEnvironmentOptions{}
-	options.Kind = circuit.NativeKind
-	options.Bundle = bundle.Name
-	return circuit.CreateEnvironment(options)
+	return newNativeEnvironment(bundle.Name, ne.relayConfig.Execution), nil
 }
 
 // ReleaseEnvironment is required by the engines.Engine interface
@@ -48,6 +45,15 @@ func (ne *NativeEngine) ReleaseEnvironment(pipelineID string, bundle *config.Bun
 	env.Shutdown()
 }
 
+// KillEnvironment is required by the engines.Engine interface
+func (ne *NativeEngine) KillEnvironment(pipelineID string, bundle *config.Bundle, env circuit.Environment) {
+	if native, ok := env.(*nativeEnvironment); ok {
+		native.Kill()
+		return
+	}
+	env.Shutdown()
+}
+
 // Clean required by engines.Engine interface
 func (ne *NativeEngine) Clean() int {
 	return 0
@@ -0,0 +1,156 @@
+package engines
+
+import (
+	"errors"
+	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"io"
+	"os/exec"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var forkExecPrefix = regexp.MustCompile("^fork/exec ")
+var errorEnvironmentKilled = errors.New("Environment was killed")
+
+// nativeEnvironment runs commands directly on the Relay host. Unlike
+// circuit's native environment it keeps track of the running process
+// so it can be forcibly terminated.
+type nativeEnvironment struct {
+	bundle    string
+	maxStdout int
+	maxStderr int
+	userData  circuit.EnvironmentUserData
+	lock      sync.Mutex
+	command   *exec.Cmd
+	exitCode  int
+	exited    bool
+	isDead    bool
+}
+
+func newNativeEnvironment(bundle string, execution *config.ExecutionInfo) *nativeEnvironment {
+	return &nativeEnvironment{
+		bundle:    bundle,
+		maxStdout: execution.MaxStdout,
+		maxStderr: execution.MaxStderr,
+	}
+}
+
+func (ne *nativeEnvironment) GetKind() circuit.EnvironmentKind {
+	return circuit.NativeKind
+}
+
+func (ne *nativeEnvironment) SetUserData(data circuit.EnvironmentUserData) error {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if ne.isDead {
+		return circuit.ErrorDeadEnvironment
+	}
+	ne.userData = data
+	return nil
+}
+
+func (ne *nativeEnvironment) GetUserData() (circuit.EnvironmentUserData, error) {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if ne.isDead {
+		return nil, circuit.ErrorDeadEnvironment
+	}
+	return ne.userData, nil
+}
+
+func (ne *nativeEnvironment) GetMetadata() circuit.EnvironmentMetadata {
+	return circuit.EnvironmentMetadata{
+		"bundle": ne.bundle,
+	}
+}
+
+func (ne *nativeEnvironment) Run(request api.ExecRequest) (api.ExecResult, error) {
+	return ne.RunStreaming(request, nil)
+}
+
+// RunStreaming is required by the engines.StreamingEnvironment
+// interface. stdout, if not nil, receives output as it is written.
+func (ne *nativeEnvironment) RunStreaming(request api.ExecRequest, output io.Writer) (api.ExecResult, error) {
+	command := request.ToExecCommand()
+	stdout := newCappedBuffer(ne.maxStdout)
+	stderr := newCappedBuffer(ne.maxStderr)
+	command.Stdout = stdout
+	if output != nil {
+		command.Stdout = io.MultiWriter(stdout, output)
+	}
+	command.Stderr = stderr
+	// Run in its own process group so Kill reaches any children
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	start := time.Now()
+	ne.lock.Lock()
+	if ne.isDead {
+		ne.lock.Unlock()
+		return circuit.EmptyExecResult, circuit.ErrorDeadEnvironment
+	}
+	err := command.Start()
+	if err == nil {
+		ne.command = &command
+		ne.lock.Unlock()
+		err = command.Wait()
+	} else {
+		ne.lock.Unlock()
+	}
+	finish := time.Now()
+	ne.lock.Lock()
+	ne.command = nil
+	ne.exited = command.ProcessState != nil
+	if ne.exited {
+		ne.exitCode = command.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	killed := ne.isDead
+	ne.lock.Unlock()
+	if killed {
+		return circuit.EmptyExecResult, errorEnvironmentKilled
+	}
+	result := api.ExecResult{}
+	result.SetElapsed(finish.Sub(start))
+	if err != nil {
+		stderr.WriteString(forkExecPrefix.ReplaceAllString(err.Error(), ""))
+		result.SetSuccess(false)
+	} else {
+		result.SetSuccess(true)
+	}
+	result.Stderr = stderr.Bytes()
+	result.Stdout = stdout.Bytes()
+	return result, nil
+}
+
+// LastExitCode is required by the engines.ExitCodeReporter interface
+func (ne *nativeEnvironment) LastExitCode() (int, bool) {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	return ne.exitCode, ne.exited
+}
+
+func (ne *nativeEnvironment) Shutdown() error {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if ne.isDead {
+		return circuit.ErrorDeadEnvironment
+	}
+	ne.isDead = true
+	return nil
+}
+
+// Kill terminates the running process and everything it started, if
+// any, and marks the environment dead. Killing only the process would
+// leave children holding its output pipes open, so Wait would block
+// until they exit.
+func (ne *nativeEnvironment) Kill() error {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	ne.isDead = true
+	if ne.command != nil && ne.command.Process != nil {
+		return syscall.Kill(-ne.command.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package engines
+
+import (
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestKillStopsBackgroundChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "native-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Same as sh -c 'sleep 60 & sleep 60'
+	script := path.Join(dir, "sleepy")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 60 &\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := newNativeEnvironment("test", &config.ExecutionInfo{MaxStdout: 1024, MaxStderr: 1024})
+	request := api.ExecRequest{}
+	request.SetExecutable(script)
+	done := make(chan error, 1)
+	go func() {
+		_, err := env.Run(request)
+		done <- err
+	}()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	if err := env.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != errorEnvironmentKilled {
+			t.Errorf("Expected killed environment to report it was killed: %v", err)
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Run didn't return after the environment was killed")
+	}
+}
+
+func TestLastExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "native-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "failing")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := newNativeEnvironment("test", &config.ExecutionInfo{MaxStdout: 1024, MaxStderr: 1024})
+	request := api.ExecRequest{}
+	request.SetExecutable(script)
+	if _, err := env.Run(request); err != nil {
+		t.Fatal(err)
+	}
+	if code, exited := env.LastExitCode(); code != 3 || exited == false {
+		t.Errorf("Expected exit code 3: %d %t", code, exited)
+	}
+}
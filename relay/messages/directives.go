@@ -27,6 +27,18 @@ type BundleSpec struct {
 	ConfigFile config.Bundle `json:"config_file,omitempty"`
 }
 
+// CancelEnvelope is a wrapper around a Cancel directive.
+type CancelEnvelope struct {
+	Cancel *CancelMessage `json:"cancel"`
+}
+
+// CancelMessage asks a Relay to abort any queued or running
+// command invocations belonging to a pipeline or invocation.
+type CancelMessage struct {
+	PipelineID   string `json:"pipeline_id"`
+	InvocationID string `json:"invocation_id"`
+}
+
 // BundleRef is a lightweight record describing the bundle name
 // and version installed on a Relay
 type BundleRef struct {
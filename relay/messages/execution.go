@@ -23,6 +23,8 @@ type ExecutionRequest struct {
 	Room           ChatRoom               `json:"room"`
 	ServiceToken   string                 `json:"service_token"`
 	ServicesRoot   string                 `json:"services_root"`
+	Priority       string                 `json:"priority,omitempty"`
+	Traceparent    string                 `json:"traceparent,omitempty"`
 	bundleName     string
 	commandName    string
 	pipelineID     string
@@ -57,14 +59,30 @@ type ChatRoom struct {
 
 // ExecutionResponse contains the results of executing a command
 type ExecutionResponse struct {
-	Room          string      `json:"room"`
-	Bundle        string      `json:"bundle"`
-	Status        string      `json:"status"`
-	StatusMessage string      `json:"status_message"`
-	Template      string      `json:"template,omitempty"`
-	Body          interface{} `json:"body"`
-	IsJSON        bool        `json:"omit"`
-	Aborted       bool        `json:"omit"`
+	Room          string                `json:"room"`
+	Bundle        string                `json:"bundle"`
+	Status        string                `json:"status"`
+	StatusMessage string                `json:"status_message"`
+	Template      string                `json:"template,omitempty"`
+	Body          interface{}           `json:"body"`
+	Attachments   map[string]Attachment `json:"attachments,omitempty"`
+	Sequence      int                   `json:"sequence,omitempty"`
+	Partial       bool                  `json:"partial,omitempty"`
+	ExitCode      *int                  `json:"exit_code,omitempty"`
+	Elapsed       int64                 `json:"elapsed_ms,omitempty"`
+	QueueWait     int64                 `json:"queue_wait_ms,omitempty"`
+	RetryAfter    int                   `json:"retry_after,omitempty"`
+	Stderr        string                `json:"stderr,omitempty"`
+	RelayID       string                `json:"relay_id,omitempty"`
+	IsJSON        bool                  `json:"-"`
+	Aborted       bool                  `json:"-"`
+}
+
+// Attachment is a named piece of content returned alongside a
+// command's response body. Data is base64 encoded.
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`
 }
 
 var errorCommandNotFound = errors.New("Command not found")
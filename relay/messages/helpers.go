@@ -6,6 +6,7 @@ import (
 )
 
 var errorUnknownMessageType = errors.New("Unknown message type")
+var errorEmptyCancel = errors.New("Cancel directive is missing pipeline and invocation ids")
 
 // ParseUntypedDirective inspects the JSON message
 // and selects the appropriate struct to use
@@ -23,5 +24,15 @@ func ParseUntypedDirective(payload []byte) (interface{}, error) {
 		return result, err
 	}
 
+	// CancelEnvelope
+	if _, ok := untypedPayload["cancel"]; ok {
+		result := &CancelEnvelope{}
+		err = json.Unmarshal(payload, result)
+		if err == nil && (result.Cancel == nil || (result.Cancel.PipelineID == "" && result.Cancel.InvocationID == "")) {
+			err = errorEmptyCancel
+		}
+		return result, err
+	}
+
 	return nil, errorUnknownMessageType
 }
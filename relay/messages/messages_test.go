@@ -18,3 +18,23 @@ func TestEmptyTemplate(t *testing.T) {
 		t.Error("Empty template field included in marshaled output")
 	}
 }
+
+func TestParseCancelDirective(t *testing.T) {
+	directive, err := ParseUntypedDirective([]byte(`{"cancel": {"pipeline_id": "abc123"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, ok := directive.(*CancelEnvelope)
+	if ok == false {
+		t.Fatalf("Unexpected directive type: %T", directive)
+	}
+	if envelope.Cancel.PipelineID != "abc123" {
+		t.Errorf("Unexpected pipeline id: %s", envelope.Cancel.PipelineID)
+	}
+}
+
+func TestParseEmptyCancelDirective(t *testing.T) {
+	if _, err := ParseUntypedDirective([]byte(`{"cancel": {}}`)); err == nil {
+		t.Error("Expected cancel directive without ids to be rejected")
+	}
+}
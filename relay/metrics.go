@@ -0,0 +1,14 @@
+package relay
+
+import (
+	"github.com/operable/go-relay/relay/metrics"
+)
+
+var announcementSeconds = metrics.NewHistogram("relay_announcement_rtt_seconds",
+	"Time between sending a bundle announcement and Cog acking it.", nil)
+var busOutages = metrics.NewCounter("relay_bus_outages_total",
+	"Losses of the connection to Cog.")
+var busOutageSeconds = metrics.NewCounter("relay_bus_outage_seconds_total",
+	"Total time spent without a connection to Cog.")
+var dynConfigRefreshes = metrics.NewCounter("relay_dynamic_config_refreshes_total",
+	"Dynamic config refresh replies, by result (updated, unchanged or failed).", "result")
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+)
+
+// Counter is a monotonically increasing value per label set
+type Counter struct {
+	family
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a Counter and registers it with DefaultRegistry
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		family: family{name: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	DefaultRegistry.Register(c)
+	return c
+}
+
+// Inc adds 1 to the series identified by values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta to the series identified by values. Negative deltas
+// are ignored.
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	key := c.key(values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+}
+
+// Value returns the current value of the series identified by values
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) writeText(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		c.writeSample(w, "", key, nil, c.values[key])
+	}
+}
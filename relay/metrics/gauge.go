@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+)
+
+// Gauge is a value per label set which can go up and down
+type Gauge struct {
+	family
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// GaugeFunc is an unlabelled gauge whose value is computed when
+// metrics are collected
+type GaugeFunc struct {
+	family
+	value func() float64
+}
+
+// NewGauge creates a Gauge and registers it with DefaultRegistry
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		family: family{name: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	DefaultRegistry.Register(g)
+	return g
+}
+
+// NewGaugeFunc creates a GaugeFunc and registers it with
+// DefaultRegistry
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		family: family{name: name, help: help},
+		value:  value,
+	}
+	DefaultRegistry.Register(g)
+	return g
+}
+
+// Set replaces the value of the series identified by values
+func (g *Gauge) Set(value float64, values ...string) {
+	key := g.key(values)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = value
+}
+
+// Add adds delta to the series identified by values
+func (g *Gauge) Add(delta float64, values ...string) {
+	key := g.key(values)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] += delta
+}
+
+func (g *Gauge) writeText(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		g.writeSample(w, "", key, nil, g.values[key])
+	}
+}
+
+func (g *GaugeFunc) writeText(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	g.writeSample(w, "", "", nil, g.value())
+}
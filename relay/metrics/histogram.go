@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"sort"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds suited to
+// command executions, which range from milliseconds to minutes
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into buckets per label set
+type Histogram struct {
+	family
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// NewHistogram creates a Histogram and registers it with
+// DefaultRegistry. buckets are upper bounds; DefaultBuckets is used
+// when buckets is nil.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		family:  family{name: name, help: help, labels: labels},
+		buckets: sorted,
+		values:  make(map[string]*histogramValue),
+	}
+	DefaultRegistry.Register(h)
+	return h
+}
+
+// Observe records value in the series identified by values
+func (h *Histogram) Observe(value float64, values ...string) {
+	key := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += value
+}
+
+// Count returns the number of observations in the series identified
+// by values
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if hv := h.values[key]; hv != nil {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) writeText(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w, "histogram")
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			h.writeSample(w, "_bucket", key, []string{"le", formatFloat(bound)}, float64(hv.counts[i]))
+		}
+		h.writeSample(w, "_bucket", key, []string{"le", formatFloat(math.Inf(1))}, float64(hv.count))
+		h.writeSample(w, "_sum", key, nil, hv.sum)
+		h.writeSample(w, "_count", key, nil, float64(hv.count))
+	}
+}
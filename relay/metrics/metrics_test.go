@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterText(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.\nBy result.", "result")
+	c.Inc("ok")
+	c.Add(2, "ok")
+	c.Inc(`say "hi"`)
+	c.Add(-1, "ok")
+	var buf bytes.Buffer
+	c.writeText(&buf)
+	expected := `# HELP test_requests_total Requests.\nBy result.
+# TYPE test_requests_total counter
+test_requests_total{result="ok"} 3
+test_requests_total{result="say \"hi\""} 1
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected counter output:\n%s", buf.String())
+	}
+}
+
+func TestHistogramText(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.5})
+	h.Observe(0.25)
+	h.Observe(0.75)
+	h.Observe(3)
+	var buf bytes.Buffer
+	h.writeText(&buf)
+	expected := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 4
+test_duration_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected histogram output:\n%s", buf.String())
+	}
+}
+
+func TestRegistryText(t *testing.T) {
+	NewGaugeFunc("test_zz_gauge", "Last.", func() float64 { return 7 })
+	NewGauge("test_aa_gauge", "First.", "bundle").Set(2, "ec2")
+	var buf bytes.Buffer
+	if err := DefaultRegistry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	first := strings.Index(text, `test_aa_gauge{bundle="ec2"} 2`)
+	last := strings.Index(text, "test_zz_gauge 7")
+	if first < 0 || last < 0 || first > last {
+		t.Errorf("Expected metrics sorted by name:\n%s", text)
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected wrong label count to panic")
+		}
+	}()
+	NewCounter("test_mismatch_total", "Mismatch.", "a", "b").Inc("a")
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metric is a family of series which can write itself in the
+// Prometheus text exposition format
+type Metric interface {
+	Name() string
+	writeText(w io.Writer)
+}
+
+// Registry holds the metrics exported by Relay
+type Registry struct {
+	lock    sync.Mutex
+	metrics map[string]Metric
+}
+
+// DefaultRegistry is used by the New* constructors and Handler
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]Metric),
+	}
+}
+
+// Register adds a metric to the registry. A metric registered under
+// an existing name replaces it.
+func (r *Registry) Register(metric Metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics[metric.Name()] = metric
+}
+
+// WriteText writes every registered metric, sorted by name, in the
+// Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	names := []string{}
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]Metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.lock.Unlock()
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		metric.writeText(&buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Handler serves DefaultRegistry in the Prometheus text exposition
+// format
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := DefaultRegistry.WriteText(w); err != nil {
+			log.Errorf("Writing metrics failed: %s.", err)
+		}
+	}
+}
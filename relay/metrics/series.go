@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelSeparator joins label values into series keys. It can't occur
+// in valid UTF-8 label values.
+const labelSeparator = "\xff"
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// family holds what every metric type shares: a name, help text and
+// label names
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// Name is required by the Metric interface
+func (f *family) Name() string {
+	return f.name
+}
+
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Errorf("Metric %s expects %d label values; got %d", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+func (f *family) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, kind)
+}
+
+// writeSample writes one sample line. extra is an additional label
+// pair such as a histogram bucket's le.
+func (f *family) writeSample(w io.Writer, suffix string, key string, extra []string, value float64) {
+	pairs := []string{}
+	if len(f.labels) > 0 {
+		for i, v := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], labelEscaper.Replace(v)))
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s%s%s %s\n", f.name, suffix, labels, formatFloat(value))
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/audit"
 	"github.com/operable/go-relay/relay/bundle"
 	"github.com/operable/go-relay/relay/bus"
 	"github.com/operable/go-relay/relay/config"
 	"github.com/operable/go-relay/relay/engines"
 	"github.com/operable/go-relay/relay/messages"
+	"github.com/operable/go-relay/relay/metrics"
+	"github.com/operable/go-relay/relay/trace"
 	"github.com/operable/go-relay/relay/worker"
 	"golang.org/x/net/context"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,6 +31,14 @@ const (
 	// commandTopicTemplate is a topic template used by Relays to
 	// receive command execution requests from Cog
 	commandTopicTemplate = "/bot/commands/%s/#"
+
+	// discoveryTopic is the topic Relays use to tell Cog they are
+	// going offline
+	discoveryTopic = "bot/relays/discover"
+
+	// killWait is how long Stop waits for killed invocations to
+	// be answered once the shutdown grace period has passed
+	killWait = time.Duration(5) * time.Second
 )
 
 // Relay is responsible for connecting to the message bus
@@ -35,13 +47,19 @@ const (
 type Relay interface {
 	Start() error
 	Stop() error
+	// Failed delivers an error if the relay can no longer reach Cog
+	Failed() <-chan error
 }
 
 type cogRelay struct {
 	config            *config.Config
 	connOpts          bus.ConnectionOptions
+	manager           *bus.ConnectionManager
 	conn              bus.Connection
-	queue             chan interface{}
+	outbox            *bus.Outbox
+	codecs            []bus.Codec
+	queue             *worker.Scheduler
+	registry          *worker.Registry
 	engines           *engines.Engines
 	dockerEngine      engines.Engine
 	catalog           *bundle.Catalog
@@ -50,17 +68,66 @@ type cogRelay struct {
 	directivesReplyTo string
 	bundleTimer       *time.Timer
 	cleanTimer        *time.Timer
+	admin             *adminServer
+	tracer            *trace.Tracer
+	audit             *audit.Logger
+	failed            chan error
+	busLock           sync.Mutex
+	busOutage         error
+	outageSince       time.Time
 }
 
 // NewRelay constructs a new Relay instance
 func NewRelay(config *config.Config) (Relay, error) {
-	return &cogRelay{
+	tracer, err := newTracer(config.Trace)
+	if err != nil {
+		return nil, err
+	}
+	var auditLog *audit.Logger
+	if config.Audit.Enabled() {
+		auditLog, err = audit.NewLogger(config.Audit.Path, int64(config.Audit.MaxSize), config.Audit.MaxFiles,
+			config.Audit.RedactKeys)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Writing execution audit log to %s.", config.Audit.Path)
+	}
+	codecs, err := newCodecs(config)
+	if err != nil {
+		return nil, err
+	}
+	catalog := bundle.NewCatalog()
+	metrics.NewGaugeFunc("relay_catalog_unacked_epochs",
+		"Bundle catalog epochs not yet acked by Cog.", func() float64 {
+			return float64(catalog.UnackedEpochs())
+		})
+	relay := &cogRelay{
 		config:            config,
 		engines:           engines.NewEngines(config),
-		catalog:           bundle.NewCatalog(),
-		queue:             make(chan interface{}, config.MaxConcurrent),
+		catalog:           catalog,
+		queue:             worker.NewScheduler(config.QueueDepth, config.Execution.AgingDuration(), worker.ConfiguredPolicy),
+		registry:          worker.NewRegistry(),
+		tracer:            tracer,
+		audit:             auditLog,
+		codecs:            codecs,
 		directivesReplyTo: fmt.Sprintf(directiveTopicTemplate, config.ID),
-	}, nil
+		failed:            make(chan error, 1),
+	}
+	metrics.NewGaugeFunc("relay_outbox_depth",
+		"Replies held until the message bus is available.", func() float64 {
+			if relay.outbox == nil {
+				return 0
+			}
+			return float64(relay.outbox.Len())
+		})
+	metrics.NewGaugeFunc("relay_bus_connected",
+		"1 while the relay is connected to Cog.", func() float64 {
+			if relay.conn == nil || relay.conn.IsConnected() == false || relay.outage() != nil {
+				return 0
+			}
+			return 1
+		})
+	return relay, nil
 }
 
 func (r *cogRelay) Start() error {
@@ -76,9 +143,8 @@ func (r *cogRelay) Start() error {
 	}
 	r.connOpts = r.makeConnOpts()
 	r.connOpts.Userid = fmt.Sprintf("%s/announcer", r.config.ID)
-	r.connOpts.EventsHandler = r.handleBusEvents
 	r.connOpts.OnDisconnect = &bus.DisconnectMessage{
-		Topic: "bot/relays/discover",
+		Topic: discoveryTopic,
 		Body:  newWill(r.config.ID, fmt.Sprintf("bot/relays/%s/announcer", r.config.ID)),
 	}
 	for i := 0; i < r.config.MaxConcurrent; i++ {
@@ -87,8 +153,27 @@ func (r *cogRelay) Start() error {
 		}()
 	}
 	log.Infof("Started %d request workers.", r.config.MaxConcurrent)
-	conn := &bus.MQTTConnection{}
-	if err := conn.Connect(r.connOpts); err != nil {
+	conn, err := bus.NewConnection(r.connOpts.Transport)
+	if err != nil {
+		return err
+	}
+	// Every subsystem shares one connection to Cog
+	r.manager = bus.NewConnectionManager(conn)
+	r.conn = r.manager.Owner("relay")
+	r.outbox, err = bus.NewOutbox(r.conn, r.config.Outbox.Capacity, r.config.Outbox.TTLDuration(), r.config.Outbox.Path)
+	if err != nil {
+		return err
+	}
+	if r.config.AdminListen != "" {
+		r.admin = newAdminServer(r)
+		if err := r.admin.Run(); err != nil {
+			return err
+		}
+	}
+	if err := r.conn.Connect(bus.ConnectionOptions{EventsHandler: r.handleBusEvents}); err != nil {
+		return err
+	}
+	if err := r.manager.Connect(r.connOpts); err != nil {
 		return err
 	}
 	if r.config.DockerEnabled() {
@@ -99,12 +184,22 @@ func (r *cogRelay) Start() error {
 	return nil
 }
 
+// Stop drains the relay. It stops taking new invocations, tells Cog
+// the relay is going offline and gives running invocations until the
+// shutdown grace period passes to finish. Anything left after that is
+// answered with relay_shutting_down.
 func (r *cogRelay) Stop() error {
+	r.queue.Drain()
+	if r.conn != nil {
+		if err := r.conn.Unsubscribe(fmt.Sprintf(commandTopicTemplate, r.config.ID)); err != nil {
+			log.Errorf("Failed to unsubscribe from command topic: %s.", err)
+		}
+	}
 	if r.bundleTimer != nil {
 		r.bundleTimer.Stop()
 	}
 	if r.config.DockerEnabled() {
-		if r.bundleTimer != nil {
+		if r.cleanTimer != nil {
 			r.cleanTimer.Stop()
 		}
 	}
@@ -114,43 +209,147 @@ func (r *cogRelay) Stop() error {
 	if r.dynConfigUpdater != nil {
 		r.dynConfigUpdater.Halt()
 	}
+	if r.conn != nil {
+		announcement := newWill(r.config.ID, fmt.Sprintf("bot/relays/%s/announcer", r.config.ID))
+		if err := r.conn.Publish(discoveryTopic, []byte(announcement)); err != nil {
+			log.Errorf("Failed to announce Relay is going offline: %s.", err)
+		}
+	}
+	grace := r.config.ShutdownGraceDuration()
+	log.Infof("Waiting up to %v for %d running and %d queued invocations.", grace, r.registry.Len()-r.queue.Len(),
+		r.queue.Len())
+	if r.queue.Wait(grace) == false {
+		for _, ctx := range r.queue.Close() {
+			invoke := ctx.Value("invoke").(*worker.CommandInvocation)
+			r.registry.Remove(invoke)
+			log.Debugf("(P: %s C: %s) Abandoning queued invocation.", invoke.Request.PipelineID(), invoke.Request.Command)
+			invoke.Reply(worker.ShuttingDownResponse())
+		}
+		if killed := r.registry.Shutdown(); killed > 0 {
+			log.Warnf("Killing %d invocations still running after %v.", killed, grace)
+			if r.queue.Wait(killWait) == false {
+				log.Errorf("Gave up waiting for killed invocations to finish.")
+			}
+		}
+	}
+	r.queue.Close()
+	if count := r.engines.Shutdown(); count > 0 {
+		log.Infof("Shut down %d cached environments.", count)
+	}
+	if r.conn != nil {
+		if r.conn.IsConnected() {
+			r.outbox.Flush()
+		}
+		if held := r.outbox.Len(); held > 0 {
+			log.Warnf("Shutting down with %d unsent replies in the outbox.", held)
+		}
+		r.outbox.Close()
+		r.manager.Disconnect()
+	}
+	r.tracer.Shutdown()
+	if r.audit != nil {
+		r.audit.Close()
+	}
+	if r.admin != nil {
+		r.admin.Halt()
+	}
 	return nil
 }
 
-func (r *cogRelay) handleBusEvents(conn bus.Connection, event bus.Event) {
-	if event == bus.ConnectedEvent {
-		r.conn = conn
-		if r.announcer == nil {
-			r.announcer = NewAnnouncer(r.config.ID, r.conn, r.catalog)
-			if err := r.announcer.Run(); err != nil {
-				log.Errorf("Failed to start announcer: %s.", err)
+// Failed is required by the Relay interface
+func (r *cogRelay) Failed() <-chan error {
+	return r.failed
+}
+
+// busFailed is called when a bus connection gives up reconnecting
+func (r *cogRelay) busFailed(err error) {
+	select {
+	case r.failed <- err:
+	default:
+	}
+}
+
+func (r *cogRelay) handleBusEvents(conn bus.Connection, event bus.Event, info bus.EventInfo) {
+	switch event {
+	case bus.ConnectedEvent:
+		r.busRestored()
+		r.busConnected()
+	case bus.DisconnectedEvent:
+		log.Warnf("Lost connection to Cog: %s. Pausing bundle announcements.", info.Cause)
+		r.busLost(info.Cause)
+		if r.announcer != nil {
+			r.announcer.Pause()
+		}
+	case bus.ReconnectingEvent:
+		log.Infof("Reconnecting to Cog (attempt %d) after: %s.", info.Attempt, info.Cause)
+		r.busLost(info.Cause)
+	case bus.SubscriptionFailedEvent:
+		log.Errorf("Message bus refused subscription to %s: %s.", info.Topic, info.Cause)
+	}
+}
+
+// busLost records why the bus is unavailable. Readiness stays false
+// until the connection is restored.
+func (r *cogRelay) busLost(cause error) {
+	r.busLock.Lock()
+	defer r.busLock.Unlock()
+	if r.busOutage == nil {
+		r.outageSince = time.Now()
+		busOutages.Inc()
+	}
+	r.busOutage = cause
+}
+
+func (r *cogRelay) busRestored() {
+	r.busLock.Lock()
+	defer r.busLock.Unlock()
+	if r.busOutage != nil {
+		outage := time.Now().Sub(r.outageSince)
+		busOutageSeconds.Add(outage.Seconds())
+		// Rounded to the second by hand; Duration.Round needs Go 1.9
+		log.Infof("Connection to Cog restored after %v.", time.Duration(outage.Seconds()+0.5)*time.Second)
+	}
+	r.busOutage = nil
+}
+
+// outage returns the reason the bus is unavailable, or nil
+func (r *cogRelay) outage() error {
+	r.busLock.Lock()
+	defer r.busLock.Unlock()
+	return r.busOutage
+}
+
+// busConnected sets up subscriptions the first time the bus connection
+// is established and announces the relay each time. The connection
+// manager restores subscriptions after a reconnect.
+func (r *cogRelay) busConnected() {
+	if r.announcer == nil {
+		r.announcer = NewAnnouncer(r.config.ID, r.manager.Owner("announcer"), r.catalog)
+		if err := r.announcer.Run(); err != nil {
+			log.Errorf("Failed to start announcer: %s.", err)
+			panic(err)
+		}
+		if r.config.ManagedDynamicConfig == true {
+			r.dynConfigUpdater = NewDynamicConfigUpdater(r.config.ID, r.manager.Owner("dynamic_config"),
+				r.config.DynamicConfigRoot, r.config.ManagedDynamicConfigRefreshDuration())
+			if err := r.dynConfigUpdater.Run(); err != nil {
+				log.Errorf("Failed to start bundle dynamic config updater: %s.", err)
 				panic(err)
 			}
-			if r.config.ManagedDynamicConfig == true {
-				opts := r.makeConnOpts()
-				r.dynConfigUpdater = NewDynamicConfigUpdater(r.config.ID, opts, r.config.DynamicConfigRoot,
-					r.config.ManagedDynamicConfigRefreshDuration())
-				if err := r.dynConfigUpdater.Run(); err != nil {
-					log.Errorf("Failed to start bundle dynamic config updater: %s.", err)
-					panic(err)
-				}
-			}
-		} else {
-			if err := r.announcer.SetSubscriptions(); err != nil {
-				log.Fatalf("Failed to subscribe to required bundle announcement topics: %s.", err);
-			}
-			r.announcer.SendAnnouncement();
 		}
 		if err := r.setSubscriptions(); err != nil {
 			log.Errorf("Failed to set Relay subscriptions: %s.", err)
 			panic(err)
 		}
-		if r.catalog.Len() > 0 {
-			r.catalog.Reconnected()
-		} else {
-			log.Info("Loading bundle catalog.")
-			r.requestBundles()
-		}
+	} else {
+		r.announcer.SendAnnouncement()
+	}
+	go r.outbox.Flush()
+	if r.catalog.Len() > 0 {
+		r.catalog.Reconnected()
+	} else {
+		log.Info("Loading bundle catalog.")
+		r.requestBundles()
 	}
 }
 
@@ -159,21 +358,55 @@ func (r *cogRelay) setSubscriptions() error {
 	if err := r.conn.Subscribe(fmt.Sprintf(directiveTopicTemplate, r.config.ID), r.handleDirective); err != nil {
 		return err
 	}
+	// Don't take new work if draining began before connecting
+	if r.queue.Draining() {
+		return nil
+	}
 	return r.conn.Subscribe(fmt.Sprintf(commandTopicTemplate, r.config.ID), r.handleCommand)
 }
 
 func (r *cogRelay) handleCommand(conn bus.Connection, topic string, message []byte) {
+	received := time.Now()
 	log.Debugf("Got invocation request on %s", topic)
 	invoke := &worker.CommandInvocation{
 		RelayConfig: r.config,
 		Engines:     r.engines,
-		Publisher:   r.conn,
+		Publisher:   r.outbox,
 		Catalog:     r.catalog,
+		Registry:    r.registry,
+		Audit:       r.audit,
 		Topic:       topic,
 		Payload:     message,
 	}
-	ctx := context.WithValue(context.Background(), "invoke", invoke)
-	r.queue <- ctx
+	if err := invoke.Parse(); err != nil {
+		log.Errorf("Ignoring malformed execution request: %s.", err)
+		return
+	}
+	invoke.Span = r.tracer.StartSpan("relay.invocation", invoke.Request.Traceparent)
+	invoke.Span.SetAttribute("cog.bundle", invoke.Request.BundleName())
+	invoke.Span.SetAttribute("cog.command", invoke.Request.CommandName())
+	invoke.Span.SetAttribute("cog.pipeline_id", invoke.Request.PipelineID())
+	invoke.Span.SetAttribute("cog.invocation_id", invoke.Request.InvocationID)
+	receipt := invoke.Span.ChildAt("relay.receive", received)
+	defer receipt.Finish()
+	invoke.Enqueued = time.Now()
+	invoke.QueueDepth = r.queue.Len()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "invoke", invoke))
+	r.registry.Add(invoke, cancel)
+	// Never block here: blocking stalls the MQTT client's delivery
+	// goroutine and can break keepalives.
+	if r.queue.Enqueue(ctx) == false {
+		r.registry.Remove(invoke)
+		if r.queue.Draining() {
+			log.Infof("(P: %s C: %s) Rejected invocation; Relay is shutting down.", invoke.Request.PipelineID(),
+				invoke.Request.Command)
+			invoke.Reply(worker.ShuttingDownResponse())
+			return
+		}
+		log.Warnf("(P: %s C: %s) Rejected invocation; request queue is full (%d).", invoke.Request.PipelineID(),
+			invoke.Request.Command, r.config.QueueDepth)
+		invoke.Reply(worker.OverloadedResponse())
+	}
 }
 
 func (r *cogRelay) handleDirective(conn bus.Connection, topic string, message []byte) {
@@ -187,6 +420,16 @@ func (r *cogRelay) handleDirective(conn bus.Connection, topic string, message []
 	case *messages.ListBundlesResponseEnvelope:
 		log.Debug("Processing bundle catalog updates.")
 		r.updateCatalog(tm.(*messages.ListBundlesResponseEnvelope))
+	case *messages.CancelEnvelope:
+		r.cancelInvocations(tm.(*messages.CancelEnvelope).Cancel)
+	}
+}
+
+func (r *cogRelay) cancelInvocations(cancel *messages.CancelMessage) {
+	log.Infof("Cancelling invocations for pipeline '%s' invocation '%s'.", cancel.PipelineID, cancel.InvocationID)
+	for _, invoke := range r.registry.Cancel(cancel.PipelineID, cancel.InvocationID) {
+		log.Debugf("(P: %s C: %s) Cancelled queued invocation.", invoke.Request.PipelineID(), invoke.Request.Command)
+		invoke.Reply(worker.CancelledResponse())
 	}
 }
 
@@ -251,7 +494,7 @@ func (r *cogRelay) requestBundles() error {
 	}
 	raw, _ := json.Marshal(&msg)
 	log.Debug("Refreshing command catalog.")
-	return r.conn.Publish(infoTopic, raw)
+	return r.outbox.Publish(infoTopic, raw)
 }
 
 func (r *cogRelay) scheduledBundleRefresh() {
@@ -275,12 +518,35 @@ func (r *cogRelay) scheduledDockerCleanup() {
 
 func (r *cogRelay) makeConnOpts() bus.ConnectionOptions {
 	connOpts := bus.ConnectionOptions{
-		Userid:        r.config.ID,
-		Password:      r.config.Cog.Token,
-		Host:          r.config.Cog.Host,
-		Port:          r.config.Cog.Port,
-		SSLEnabled:    r.config.Cog.SSLEnabled,
-		SSLCertPath:   r.config.Cog.SSLCertPath,
+		Transport:         r.config.Cog.Transport,
+		Userid:            r.config.ID,
+		Password:          r.config.Cog.Token,
+		Host:              r.config.Cog.Host,
+		Port:              r.config.Cog.Port,
+		Endpoints:         r.config.Cog.BrokerEndpoints(),
+		Failover:          r.config.Cog.Failover,
+		FailbackInterval:  r.config.Cog.FailbackDuration(),
+		SSLEnabled:        r.config.Cog.SSLEnabled,
+		SSLCertPath:       r.config.Cog.SSLCertPath,
+		SSLInsecure:       r.config.Cog.SSLInsecure,
+		SSLClientCertPath: r.config.Cog.SSLClientCert,
+		SSLClientKeyPath:  r.config.Cog.SSLClientKey,
+		SSLServerName:     r.config.Cog.SSLServerName,
+		SSLMinVersion:     r.config.Cog.TLSMinVersion(),
+		SSLCipherSuites:   r.config.Cog.TLSCipherSuites(),
+		SSLReloadInterval: r.config.Cog.SSLReloadDuration(),
+		WebSocket:         r.config.Cog.WebSocket,
+		WebSocketPath:     r.config.Cog.WebSocketPath,
+		ProxyURL:          r.config.Cog.ProxyURL,
+		OnGiveUp:          r.busFailed,
+		Codecs:            r.codecs,
+		Backoff: bus.BackoffOptions{
+			Strategy:    r.config.Cog.BackoffStrategy,
+			Base:        r.config.Cog.BackoffBaseDuration(),
+			Cap:         r.config.Cog.BackoffCapDuration(),
+			Jitter:      r.config.Cog.BackoffJitterPercent(),
+			MaxAttempts: r.config.Cog.BackoffAttempts,
+		},
 	}
 	return connOpts
 }
@@ -0,0 +1,244 @@
+// Package relaytest runs a Relay against an in-memory message bus and
+// a fake Cog, so whole-relay behaviour can be tested without a broker.
+package relaytest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/operable/go-relay/relay"
+	"github.com/operable/go-relay/relay/bus"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/messages"
+	"sync"
+	"time"
+)
+
+// RelayID is the id of every relay started by a Harness
+const RelayID = "8e2d3c7a-5f0b-4a1e-9c6d-2b7f4e1a9d30"
+
+// Timeout bounds every wait performed by a Harness
+var Timeout = time.Duration(10) * time.Second
+
+const baseConfig = `version: 1
+id: %s
+max_concurrent: 4
+shutdown_grace: 1s
+enabled_engines: native
+cog:
+  token: relaytest
+`
+
+var errorNoRelayConnection = errors.New("Relay isn't connected to the message bus")
+
+var transportLock sync.Mutex
+var transportCount int
+
+// Harness connects a Relay and a fake Cog to the same in-memory
+// broker. The fake Cog answers bundle list requests with Bundles and
+// acknowledges bundle announcements.
+type Harness struct {
+	Config  *config.Config
+	Broker  *bus.MemoryBroker
+	Cog     *bus.MemoryConnection
+	Relay   relay.Relay
+	lock    sync.Mutex
+	bundles []*config.Bundle
+	nextID  int
+}
+
+// NewHarness builds a harness whose Cog assigns bundles to the relay.
+// rawConfig is appended to a minimal native-only relay config and may
+// be empty.
+func NewHarness(rawConfig string, bundles ...*config.Bundle) (*Harness, error) {
+	relayConfig, err := config.RawConfig(fmt.Sprintf(baseConfig, RelayID) + rawConfig).Parse("relaytest")
+	if err != nil {
+		return nil, err
+	}
+	// Boolean defaults can't be overridden with false in YAML
+	relayConfig.ManagedDynamicConfig = false
+	if err := relayConfig.Verify(); err != nil {
+		return nil, err
+	}
+	broker := bus.NewMemoryBroker()
+	transportLock.Lock()
+	transportCount++
+	transport := fmt.Sprintf("relaytest-%d", transportCount)
+	transportLock.Unlock()
+	bus.RegisterTransport(transport, broker.Transport())
+	relayConfig.Cog.Transport = transport
+	harness := &Harness{
+		Config:  relayConfig,
+		Broker:  broker,
+		Cog:     broker.NewConnection(),
+		bundles: bundles,
+	}
+	if err := harness.Cog.Connect(bus.ConnectionOptions{Userid: "cog"}); err != nil {
+		return nil, err
+	}
+	harness.Cog.Subscribe("bot/relays/info", harness.handleInfo)
+	harness.Cog.Subscribe("bot/relays/discover", harness.handleDiscover)
+	harness.Cog.Subscribe("/bot/pipelines/#", nil)
+	return harness, nil
+}
+
+// Start starts the relay and waits for its first bundle announcement
+func (h *Harness) Start() error {
+	r, err := relay.NewRelay(h.Config)
+	if err != nil {
+		return err
+	}
+	h.Relay = r
+	if err := r.Start(); err != nil {
+		return err
+	}
+	_, err = h.WaitForAnnouncements(1)
+	return err
+}
+
+// Stop stops the relay and disconnects the fake Cog
+func (h *Harness) Stop() error {
+	var err error
+	if h.Relay != nil {
+		err = h.Relay.Stop()
+	}
+	h.Cog.Disconnect()
+	return err
+}
+
+// SetBundles replaces the bundles Cog assigns to the relay. The relay
+// sees them the next time it asks for its bundle list.
+func (h *Harness) SetBundles(bundles ...*config.Bundle) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.bundles = bundles
+}
+
+// WaitForAnnouncements waits until the relay has made count online
+// announcements and handled Cog's receipts for them. Returns the last
+// of them.
+func (h *Harness) WaitForAnnouncements(count int) (*messages.Announcement, error) {
+	for received := 1; len(h.announcements()) < count; received++ {
+		if _, err := h.Cog.WaitForMessages("bot/relays/discover", received, Timeout); err != nil {
+			return nil, err
+		}
+	}
+	conn := h.relayConnection()
+	if conn == nil {
+		return nil, errorNoRelayConnection
+	}
+	if _, err := conn.WaitForMessages(fmt.Sprintf("bot/relays/%s/announcer", RelayID), count, Timeout); err != nil {
+		return nil, err
+	}
+	return h.announcements()[count-1], nil
+}
+
+// Execute asks the relay to run bundle:command with args and returns
+// its final response
+func (h *Harness) Execute(command string, args ...interface{}) (*messages.ExecutionResponse, error) {
+	h.lock.Lock()
+	h.nextID++
+	pipelineID := fmt.Sprintf("pipeline-%d", h.nextID)
+	h.lock.Unlock()
+	replyTo := fmt.Sprintf("/bot/pipelines/%s/reply", pipelineID)
+	request := messages.ExecutionRequest{
+		Options:      map[string]interface{}{},
+		Args:         args,
+		InvocationID: pipelineID,
+		Command:      command,
+		ReplyTo:      replyTo,
+		Requestor:    messages.ChatUser{Handle: "relaytest"},
+		User:         messages.CogUser{Username: "relaytest"},
+		Room:         messages.ChatRoom{Name: "direct"},
+	}
+	raw, _ := json.Marshal(request)
+	if err := h.Cog.Publish(fmt.Sprintf("/bot/commands/%s/%s", RelayID, command), raw); err != nil {
+		return nil, err
+	}
+	for count := 1; ; count++ {
+		replies, err := h.Cog.WaitForMessages(replyTo, count, Timeout)
+		if err != nil {
+			return nil, err
+		}
+		response := &messages.ExecutionResponse{}
+		if err := json.Unmarshal(replies[count-1].Payload, response); err != nil {
+			return nil, err
+		}
+		if response.Partial == false {
+			return response, nil
+		}
+	}
+}
+
+// DropRelay simulates the relay losing its message bus connection and
+// waits for Cog to receive its last will
+func (h *Harness) DropRelay() error {
+	conn := h.relayConnection()
+	if conn == nil {
+		return errorNoRelayConnection
+	}
+	seen := len(h.Cog.Received("bot/relays/discover"))
+	conn.Drop()
+	_, err := h.Cog.WaitForMessages("bot/relays/discover", seen+1, Timeout)
+	return err
+}
+
+// ReconnectRelay restores a connection dropped by DropRelay
+func (h *Harness) ReconnectRelay() error {
+	conn := h.relayConnection()
+	if conn == nil {
+		return errorNoRelayConnection
+	}
+	return conn.Reconnect()
+}
+
+func (h *Harness) relayConnection() *bus.MemoryConnection {
+	return h.Broker.Connection(fmt.Sprintf("%s/announcer", RelayID))
+}
+
+// announcements returns the online announcements Cog has received
+func (h *Harness) announcements() []*messages.Announcement {
+	announcements := []*messages.Announcement{}
+	for _, message := range h.Cog.Received("bot/relays/discover") {
+		envelope := messages.AnnouncementEnvelope{}
+		if err := json.Unmarshal(message.Payload, &envelope); err != nil || envelope.Announcement == nil {
+			continue
+		}
+		if envelope.Announcement.Online {
+			announcements = append(announcements, envelope.Announcement)
+		}
+	}
+	return announcements
+}
+
+func (h *Harness) handleInfo(conn bus.Connection, topic string, payload []byte) {
+	request := messages.ListBundlesEnvelope{}
+	if err := json.Unmarshal(payload, &request); err != nil || request.ListBundles == nil {
+		return
+	}
+	h.lock.Lock()
+	response := messages.ListBundlesResponseEnvelope{}
+	for _, bundle := range h.bundles {
+		response.Bundles = append(response.Bundles, messages.BundleSpec{ConfigFile: *bundle})
+	}
+	h.lock.Unlock()
+	raw, _ := json.Marshal(response)
+	conn.Publish(request.ListBundles.ReplyTo, raw)
+}
+
+func (h *Harness) handleDiscover(conn bus.Connection, topic string, payload []byte) {
+	envelope := messages.AnnouncementEnvelope{}
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Announcement == nil {
+		return
+	}
+	announcement := envelope.Announcement
+	if announcement.Online == false || announcement.ReplyTo == "" {
+		return
+	}
+	receipt := messages.AnnouncementReceipt{
+		ID:     announcement.ID,
+		Status: "success",
+	}
+	raw, _ := json.Marshal(receipt)
+	conn.Publish(announcement.ReplyTo, raw)
+}
@@ -0,0 +1,110 @@
+package relaytest
+
+import (
+	"github.com/operable/go-relay/relay/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var echoBundle = &config.Bundle{
+	BundleVersion: 4,
+	Name:          "test",
+	Version:       "1.0.0",
+	Commands: map[string]*config.BundleCommand{
+		"echo": &config.BundleCommand{
+			Executable: "/bin/echo",
+		},
+	},
+}
+
+func startHarness(t *testing.T) *Harness {
+	harness, err := NewHarness("", echoBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harness.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return harness
+}
+
+func TestAnnouncesBundles(t *testing.T) {
+	harness := startHarness(t)
+	defer harness.Stop()
+	announcement, err := harness.WaitForAnnouncements(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(announcement.Bundles) != 1 || announcement.Bundles[0].Name != "test" {
+		t.Errorf("Unexpected bundle announcement: %+v", announcement)
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	harness := startHarness(t)
+	defer harness.Stop()
+	response, err := harness.Execute("test:echo", "hello", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "ok" || response.Body == nil {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	harness := startHarness(t)
+	defer harness.Stop()
+	if err := harness.DropRelay(); err != nil {
+		t.Fatal(err)
+	}
+	offline := 0
+	for _, message := range harness.Cog.Received("bot/relays/discover") {
+		if strings.Contains(string(message.Payload), `"online":false`) {
+			offline++
+		}
+	}
+	if offline != 1 {
+		t.Errorf("Expected relay's last will to be published once: %d", offline)
+	}
+	if err := harness.ReconnectRelay(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := harness.WaitForAnnouncements(2); err != nil {
+		t.Errorf("Expected relay to announce its bundles after reconnecting: %s", err)
+	}
+	response, err := harness.Execute("test:echo", "again")
+	if err != nil || response.Status != "ok" {
+		t.Errorf("Expected relay to execute commands after reconnecting: %+v %v", response, err)
+	}
+}
+
+func TestSharedConnection(t *testing.T) {
+	harness, err := NewHarness("", echoBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "relaytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	harness.Config.ManagedDynamicConfig = true
+	harness.Config.DynamicConfigRoot = filepath.Join(dir, "dynamic")
+	if err := harness.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := harness.Cog.WaitForMessages("bot/relays/info", 2, Timeout); err != nil {
+		t.Fatal(err)
+	}
+	if conns := len(harness.Broker.Connections()); conns != 2 {
+		t.Errorf("Expected relay to open a single bus connection: %d", conns-1)
+	}
+	harness.Stop()
+	if harness.relayConnection() != nil {
+		t.Errorf("Expected relay to close its bus connection")
+	}
+}
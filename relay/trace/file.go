@@ -0,0 +1,44 @@
+package trace
+
+import (
+	"os"
+	"sync"
+)
+
+// FileExporter appends each batch of spans to a file as one line of
+// OTLP JSON. Useful where no collector is reachable; the lines can be
+// replayed to a collector later.
+type FileExporter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens path for appending, creating it if needed
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{
+		file: file,
+	}, nil
+}
+
+// Export is required by the Exporter interface
+func (fe *FileExporter) Export(service string, spans []*Span) error {
+	body, err := encodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	_, err = fe.file.Write(append(body, '\n'))
+	return err
+}
+
+// Shutdown is required by the Exporter interface
+func (fe *FileExporter) Shutdown() error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.file.Close()
+}
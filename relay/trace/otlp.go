@@ -0,0 +1,169 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLP span kinds and status codes used by Relay
+const (
+	otlpKindInternal = 1
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// otlpTimeout bounds each export request
+var otlpTimeout = time.Duration(10) * time.Second
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using the
+// OTLP/HTTP JSON encoding
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter which posts to endpoint, the
+// collector's full traces URL (e.g. http://127.0.0.1:4318/v1/traces)
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: otlpTimeout,
+		},
+	}
+}
+
+// Export is required by the Exporter interface
+func (oe *OTLPExporter) Export(service string, spans []*Span) error {
+	body, err := encodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	resp, err := oe.client.Post(oe.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Collector %s returned %s", oe.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown is required by the Exporter interface
+func (oe *OTLPExporter) Shutdown() error {
+	return nil
+}
+
+// encodeOTLP builds an OTLP ExportTraceServiceRequest in its JSON form
+func encodeOTLP(service string, spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes()),
+			Status: otlpStatus{
+				Code: otlpStatusOK,
+			},
+		}
+		if span.ParentID.IsZero() == false {
+			encoded[i].ParentSpanID = span.ParentID.String()
+		}
+		if message := span.Error(); message != "" {
+			encoded[i].Status = otlpStatus{
+				Code:    otlpStatusError,
+				Message: message,
+			}
+		}
+	}
+	request := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: otlpAttributes(map[string]string{"service.name": service}),
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "github.com/operable/go-relay"},
+						Spans: encoded,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(request)
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := []string{}
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	retval := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		retval[i] = otlpAttribute{
+			Key:   key,
+			Value: otlpValue{StringValue: attributes[key]},
+		}
+	}
+	return retval
+}
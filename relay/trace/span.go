@@ -0,0 +1,192 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errorBadTraceparent = errors.New("Malformed traceparent")
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// IsZero returns true for the invalid all-zero trace id
+func (id TraceID) IsZero() bool {
+	return id == TraceID{}
+}
+
+// IsZero returns true for the invalid all-zero span id
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of a span propagated across process
+// boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent decodes a W3C traceparent header value
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, errorBadTraceparent
+	}
+	// Version 00 has exactly four fields; later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, errorBadTraceparent
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil || sc.TraceID.IsZero() {
+		return sc, errorBadTraceparent
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil || sc.SpanID.IsZero() {
+		return sc, errorBadTraceparent
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, errorBadTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Traceparent encodes the span context as a W3C traceparent value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Span records a timed operation. All methods are safe to call on a
+// nil Span, which is what a nil Tracer hands out.
+type Span struct {
+	tracer     *Tracer
+	Name       string
+	Context    SpanContext
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	lock       sync.Mutex
+	attributes map[string]string
+	errMessage string
+	finished   bool
+}
+
+// SetAttribute records a string attribute on the span
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errMessage = message
+}
+
+// Child starts a span which is a child of s
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+// ChildAt starts a child span of s which began at start. Used for
+// stages which are only known to have happened after the fact.
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	child := s.tracer.newSpan(name, start)
+	child.Context.TraceID = s.Context.TraceID
+	child.Context.Sampled = s.Context.Sampled
+	child.ParentID = s.Context.SpanID
+	return child
+}
+
+// Finish ends the span and hands it to the tracer for export. Only
+// the first call has any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	s.lock.Unlock()
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Traceparent returns the W3C traceparent for the span or "" for a
+// nil span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.Traceparent()
+}
+
+// Attributes returns a copy of the span's attributes
+func (s *Span) Attributes() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	retval := make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		retval[k] = v
+	}
+	return retval
+}
+
+// Error returns the message set by SetError
+func (s *Span) Error() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.errMessage
+}
+
+func decodeHex(dst []byte, value string) error {
+	if len(value) != hex.EncodedLen(len(dst)) || strings.ToLower(value) != value {
+		return errorBadTraceparent
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err
+}
+
+func randomBytes(dst []byte) {
+	if _, err := rand.Read(dst); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,118 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+type captureExporter struct {
+	spans []*Span
+}
+
+func (ce *captureExporter) Export(service string, spans []*Span) error {
+	ce.spans = append(ce.spans, spans...)
+	return nil
+}
+
+func (ce *captureExporter) Shutdown() error {
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(testTraceparent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("Unexpected span context: %v", sc)
+	}
+	if sc.Traceparent() != testTraceparent {
+		t.Errorf("Expected traceparent to round trip: %s", sc.Traceparent())
+	}
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
+
+func TestContinueTrace(t *testing.T) {
+	exporter := &captureExporter{}
+	tracer := NewTracer("test", exporter)
+	root := tracer.StartSpan("root", testTraceparent)
+	child := root.Child("child")
+	child.Finish()
+	root.Finish()
+	root.Finish()
+	tracer.Flush()
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 exported spans: %d", len(exporter.spans))
+	}
+	if root.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected root span to continue incoming trace: %s", root.Traceparent())
+	}
+	if child.Context.TraceID != root.Context.TraceID || child.ParentID != root.Context.SpanID {
+		t.Error("Expected child span to be parented by root")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.StartSpan("root", testTraceparent)
+	span.SetAttribute("key", "value")
+	span.Child("child").Finish()
+	span.Finish()
+	tracer.Shutdown()
+	if span.Traceparent() != "" {
+		t.Error("Expected nil span to have no traceparent")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exporter, err := NewFileExporter(path.Join(dir, "spans.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("cog-relay", exporter)
+	span := tracer.StartSpan("relay.invocation", "")
+	span.SetAttribute("cog.bundle", "ec2")
+	span.SetError("Command failed.")
+	span.Finish()
+	tracer.Shutdown()
+	file, _ := os.Open(path.Join(dir, "spans.jsonl"))
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if scanner.Scan() == false {
+		t.Fatal("Expected a line of spans")
+	}
+	request := otlpRequest{}
+	if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+		t.Fatal(err)
+	}
+	resource := request.ResourceSpans[0]
+	if resource.Resource.Attributes[0].Value.StringValue != "cog-relay" {
+		t.Errorf("Expected service name resource attribute: %v", resource.Resource)
+	}
+	encoded := resource.ScopeSpans[0].Spans[0]
+	if encoded.Name != "relay.invocation" || encoded.TraceID != span.Context.TraceID.String() ||
+		encoded.ParentSpanID != "" || encoded.Status.Code != otlpStatusError {
+		t.Errorf("Unexpected encoded span: %v", encoded)
+	}
+	if encoded.Attributes[0].Key != "cog.bundle" || encoded.Attributes[0].Value.StringValue != "ec2" {
+		t.Errorf("Unexpected span attributes: %v", encoded.Attributes)
+	}
+}
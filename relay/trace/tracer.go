@@ -0,0 +1,116 @@
+package trace
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// batchSize is the number of finished spans which triggers an export
+const batchSize = 64
+
+// flushInterval is the longest a finished span waits to be exported
+var flushInterval = time.Duration(5) * time.Second
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(service string, spans []*Span) error
+	Shutdown() error
+}
+
+// Tracer creates spans and exports them in batches. A nil Tracer is
+// valid and disables tracing.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	lock     sync.Mutex
+	pending  []*Span
+	timer    *time.Timer
+}
+
+// NewTracer returns a Tracer which reports spans for service
+// through exporter
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{
+		service:  service,
+		exporter: exporter,
+	}
+}
+
+// StartSpan starts a root span. If traceparent holds a valid W3C
+// trace context the span continues that trace; otherwise a new,
+// sampled trace is started.
+func (t *Tracer) StartSpan(name string, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, time.Now())
+	if traceparent != "" {
+		if parent, err := ParseTraceparent(traceparent); err == nil {
+			span.Context.TraceID = parent.TraceID
+			span.Context.Sampled = parent.Sampled
+			span.ParentID = parent.SpanID
+			return span
+		}
+		log.Debugf("Ignoring malformed traceparent '%s'.", traceparent)
+	}
+	randomBytes(span.Context.TraceID[:])
+	span.Context.Sampled = true
+	return span
+}
+
+// Flush exports every finished span right away
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	spans := t.pending
+	t.pending = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(t.service, spans); err != nil {
+		log.Errorf("Exporting %d trace spans failed: %s.", len(spans), err)
+	}
+}
+
+// Shutdown flushes finished spans and shuts down the exporter
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.Flush()
+	if err := t.exporter.Shutdown(); err != nil {
+		log.Errorf("Shutting down trace exporter failed: %s.", err)
+	}
+}
+
+func (t *Tracer) newSpan(name string, start time.Time) *Span {
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Start:      start,
+		attributes: make(map[string]string),
+	}
+	randomBytes(span.Context.SpanID[:])
+	return span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.lock.Lock()
+	t.pending = append(t.pending, span)
+	full := len(t.pending) >= batchSize
+	if full == false && t.timer == nil {
+		t.timer = time.AfterFunc(flushInterval, t.Flush)
+	}
+	t.lock.Unlock()
+	if full {
+		go t.Flush()
+	}
+}
@@ -0,0 +1,25 @@
+package relay
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/trace"
+)
+
+// newTracer builds the invocation tracer described by info. Returns
+// nil when tracing is disabled.
+func newTracer(info *config.TraceInfo) (*trace.Tracer, error) {
+	switch info.Exporter {
+	case config.OTLPTraceExporter:
+		log.Infof("Exporting invocation traces to %s.", info.Endpoint)
+		return trace.NewTracer(info.ServiceName, trace.NewOTLPExporter(info.Endpoint)), nil
+	case config.FileTraceExporter:
+		exporter, err := trace.NewFileExporter(info.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Writing invocation traces to %s.", info.FilePath)
+		return trace.NewTracer(info.ServiceName, exporter), nil
+	}
+	return nil, nil
+}
@@ -1,65 +1,107 @@
 package worker
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/audit"
 	"github.com/operable/go-relay/relay/bundle"
 	"github.com/operable/go-relay/relay/bus"
 	"github.com/operable/go-relay/relay/config"
 	"github.com/operable/go-relay/relay/engines"
 	"github.com/operable/go-relay/relay/messages"
+	"github.com/operable/go-relay/relay/trace"
 	"github.com/operable/go-relay/relay/util"
 	"golang.org/x/net/context"
+	"io"
+	"time"
 )
 
+// maxResponseStderr caps the copy of stderr included in responses
+const maxResponseStderr = 4096
+
+// overloadRetryAfter is the number of seconds Cog is asked to wait
+// before retrying an invocation rejected by a full queue
+const overloadRetryAfter = 5
+
 // CommandInvocation request
 type CommandInvocation struct {
 	RelayConfig *config.Config
 	Publisher   bus.MessagePublisher
 	Catalog     *bundle.Catalog
 	Engines     *engines.Engines
+	Registry    *Registry
 	Topic       string
 	Payload     []byte
+	Request     *messages.ExecutionRequest
+	Enqueued    time.Time
+	QueueDepth  int
+	QueueWait   time.Duration
 	Shutdown    bool
+	Span        *trace.Span
+	Audit       *audit.Logger
+}
+
+// Parse decodes the invocation's payload into an ExecutionRequest
+func (invoke *CommandInvocation) Parse() error {
+	request := &messages.ExecutionRequest{}
+	decoder := util.NewJSONDecoder(bytes.NewReader(invoke.Payload))
+	if err := decoder.Decode(request); err != nil {
+		return err
+	}
+	request.Parse()
+	invoke.Request = request
+	return nil
+}
+
+// Reply publishes response to the request's reply topic
+func (invoke *CommandInvocation) Reply(response *messages.ExecutionResponse) error {
+	response.RelayID = invoke.RelayConfig.ID
+	response.QueueWait = int64(invoke.QueueWait / time.Millisecond)
+	if response.Partial == false {
+		executionsTotal.Inc(invoke.Request.BundleName(), invoke.Request.CommandName(), response.Status)
+		invoke.Span.SetAttribute("cog.status", response.Status)
+		if response.Status != "ok" {
+			invoke.Span.SetError(response.StatusMessage)
+		}
+		defer invoke.Span.Finish()
+	}
+	responseBytes, _ := json.Marshal(response)
+	return invoke.Publisher.Publish(invoke.Request.ReplyTo, responseBytes)
 }
 
 // ExecutionWorker is the entry point for command execution
-// goroutines.
-func ExecutionWorker(queue chan interface{}) {
-	var decoder *json.Decoder
-	var bufferedReader *bufio.Reader
+// goroutines. It returns when the scheduler is closed.
+func ExecutionWorker(queue *Scheduler) {
 	for {
-		thing := <-queue
-		// Convert dequeued thing to context
-		ctx, ok := thing.(context.Context)
-
+		ctx, ok := queue.Next()
 		if ok == false {
-			log.Error("Dropping improperly queued request.")
-			continue
+			return
 		}
 		invoke := ctx.Value("invoke").(*CommandInvocation)
-		if bufferedReader == nil {
-			bufferedReader = bufio.NewReader(bytes.NewReader(invoke.Payload))
-			decoder = util.NewJSONDecoder(bufferedReader)
+		invoke.QueueWait = time.Now().Sub(invoke.Enqueued)
+		queueWaitSeconds.Observe(invoke.QueueWait.Seconds())
+		invoke.Span.ChildAt("relay.queue_wait", invoke.Enqueued).Finish()
+		log.Debugf("(P: %s C: %s) Dequeued after waiting %v behind %d invocations.", invoke.Request.PipelineID(),
+			invoke.Request.Command, invoke.QueueWait, invoke.QueueDepth)
+		if invoke.Registry != nil && invoke.Registry.Start(invoke) == false {
+			log.Debugf("(P: %s C: %s) Skipping cancelled invocation.", invoke.Request.PipelineID(),
+				invoke.Request.Command)
 		} else {
-			bufferedReader.Reset(bytes.NewReader(invoke.Payload))
+			executeCommand(ctx, invoke)
+			if invoke.Registry != nil {
+				invoke.Registry.Remove(invoke)
+			}
 		}
-		executeCommand(decoder, invoke)
+		queue.Done(ctx)
 	}
 }
 
-func executeCommand(decoder *json.Decoder, invoke *CommandInvocation) {
-	request := &messages.ExecutionRequest{}
-
-	if err := decoder.Decode(request); err != nil {
-		log.Errorf("Ignoring malformed execution request: %s.", err)
-		return
-	}
-	request.Parse()
+func executeCommand(ctx context.Context, invoke *CommandInvocation) {
+	request := invoke.Request
 	bundle := invoke.Catalog.Find(request.BundleName())
 	response := &messages.ExecutionResponse{}
 	if bundle == nil {
@@ -70,7 +112,12 @@ func executeCommand(decoder *json.Decoder, invoke *CommandInvocation) {
 		if err != nil {
 			setError(response, err)
 		} else {
+			acquire := invoke.Span.Child("relay.acquire_environment")
 			env, err := engine.NewEnvironment(request.PipelineID(), bundle)
+			if err != nil {
+				acquire.SetError(err.Error())
+			}
+			acquire.Finish()
 			if err != nil {
 				setError(response, err)
 			} else {
@@ -87,21 +134,228 @@ func executeCommand(decoder *json.Decoder, invoke *CommandInvocation) {
 				circuitRequest, foundDynamicConfig, err := request.ToCircuitRequest(bundle, invoke.RelayConfig, hasDynamicConfig)
 				if err != nil {
 					setError(response, err)
+				} else if parser, err := NewOutputParser(bundle.OutputVersion); err != nil {
+					engine.ReleaseEnvironment(request.PipelineID(), bundle, env)
+					setError(response, err)
 				} else {
 					if foundDynamicConfig == false {
 						userData["dynamic-config"] = false
 						env.SetUserData(userData)
 					}
-					result, err := env.Run(*circuitRequest)
-					engine.ReleaseEnvironment(request.PipelineID(), bundle, env)
-					parser := NewOutputParserV1()
-					response = parser.Parse(result, *request, err)
+					timeout := bundle.CommandTimeout(request.CommandName(), invoke.RelayConfig.Execution.TimeoutDuration())
+					runCtx, cancel := withTimeout(ctx, timeout)
+					var streamer *outputStreamer
+					var stdout io.Writer
+					// Only the line-oriented V1 protocol can be streamed
+					if v1, ok := parser.(*OutputParserV1); ok && bundle.StreamsOutput(request.CommandName()) {
+						streamer = newOutputStreamer(invoke, v1.IsDirective)
+						stdout = streamer
+					}
+					run := invoke.Span.Child("relay.run")
+					if traceparent := run.Traceparent(); traceparent != "" {
+						circuitRequest.PutEnv("COG_TRACEPARENT", traceparent)
+					} else if request.Traceparent != "" {
+						circuitRequest.PutEnv("COG_TRACEPARENT", request.Traceparent)
+					}
+					start := time.Now()
+					result, err := runCommand(runCtx, env, *circuitRequest, stdout)
+					elapsed := time.Now().Sub(start)
+					if err != nil {
+						run.SetError(err.Error())
+					}
+					run.Finish()
+					cancel()
+					executionSeconds.Observe(elapsed.Seconds(), request.BundleName(), request.CommandName())
+					streamed := 0
+					if streamer != nil {
+						streamed = streamer.Finish()
+					}
+					if err == context.Canceled && invoke.Shutdown {
+						engine.KillEnvironment(request.PipelineID(), bundle, env)
+						log.Warnf("(P: %s C: %s) Command killed by relay shut down.", request.PipelineID(), request.Command)
+						response = ShuttingDownResponse()
+					} else if err == context.Canceled {
+						engine.KillEnvironment(request.PipelineID(), bundle, env)
+						log.Infof("(P: %s C: %s) Command cancelled by Cog.", request.PipelineID(), request.Command)
+						response = CancelledResponse()
+					} else if err == context.DeadlineExceeded {
+						engine.KillEnvironment(request.PipelineID(), bundle, env)
+						log.Warnf("(P: %s C: %s) Command killed after running for %v.", request.PipelineID(), request.Command, elapsed)
+						response.Status = "timeout"
+						response.StatusMessage = fmt.Sprintf("Command timed out after running for %v.", roundDuration(elapsed))
+					} else {
+						exitCode := exitCodeFor(env, result, err)
+						engine.ReleaseEnvironment(request.PipelineID(), bundle, env)
+						execution := invoke.RelayConfig.Execution
+						stdoutCut, stderrCut := truncateOutput(&result, execution)
+						if (stdoutCut || stderrCut) && execution.OversizePolicy == config.FailOversizeOutput {
+							response = tooLargeResponse(execution)
+						} else {
+							response = parser.Parse(result, *request, err)
+							if streamed > 0 && response.IsJSON == false {
+								// Output has already been delivered in partial responses
+								response.Body = nil
+							} else if stdoutCut && markTruncated(response, execution.MaxStdout) == false {
+								response = tooLargeResponse(execution)
+							}
+						}
+						if stdoutCut || stderrCut {
+							log.Warnf("(P: %s C: %s) Command output exceeded size limits.", request.PipelineID(), request.Command)
+						}
+						response.ExitCode = exitCode
+						response.Stderr = capStderr(result.Stderr)
+					}
+					response.Elapsed = int64(elapsed / time.Millisecond)
+					if streamed > 0 {
+						response.Sequence = streamed + 1
+					}
+					auditExecution(invoke, bundle, engine, response)
 				}
 			}
 		}
 	}
-	responseBytes, _ := json.Marshal(response)
-	invoke.Publisher.Publish(request.ReplyTo, responseBytes)
+	if err := invoke.Reply(response); err != nil {
+		log.Errorf("(P: %s C: %s) Reply lost: %s.", invoke.Request.PipelineID(), invoke.Request.Command, err)
+	}
+}
+
+// auditExecution records a command run in the audit log, if enabled
+func auditExecution(invoke *CommandInvocation, bundle *config.Bundle, engine engines.Engine,
+	response *messages.ExecutionResponse) {
+	if invoke.Audit == nil {
+		return
+	}
+	request := invoke.Request
+	record := &audit.Record{
+		Timestamp:     time.Now().UTC(),
+		RelayID:       invoke.RelayConfig.ID,
+		PipelineID:    request.PipelineID(),
+		InvocationID:  request.InvocationID,
+		CogUser:       request.User.Username,
+		ChatHandle:    request.Requestor.Handle,
+		Room:          request.Room.Name,
+		Bundle:        bundle.Name,
+		BundleVersion: bundle.Version,
+		Command:       request.CommandName(),
+		Args:          request.Args,
+		Options:       request.Options,
+		Engine:        config.NativeEngine,
+		Status:        response.Status,
+		ExitCode:      response.ExitCode,
+		Duration:      response.Elapsed,
+	}
+	if bundle.IsDocker() {
+		record.Engine = config.DockerEngine
+		record.Image = fmt.Sprintf("%s:%s", bundle.Docker.Image, bundle.Docker.Tag)
+		if identifier, ok := engine.(engines.ImageIdentifier); ok {
+			record.ImageDigest, _ = identifier.IDForName(bundle.Docker.Image, bundle.Docker.Tag)
+		}
+	}
+	if err := invoke.Audit.Write(record); err != nil {
+		log.Errorf("(P: %s C: %s) Writing audit record failed: %s.", request.PipelineID(), request.Command, err)
+	}
+}
+
+// OverloadedResponse builds the response sent when an invocation
+// is rejected because the relay's queue is full.
+func OverloadedResponse() *messages.ExecutionResponse {
+	return &messages.ExecutionResponse{
+		Status:        "overloaded",
+		StatusMessage: "Relay is too busy to accept more commands. Please try again later.",
+		RetryAfter:    overloadRetryAfter,
+	}
+}
+
+// CancelledResponse builds the response sent when an invocation
+// is cancelled by Cog.
+func CancelledResponse() *messages.ExecutionResponse {
+	return &messages.ExecutionResponse{
+		Status:        "cancelled",
+		StatusMessage: "Command cancelled.",
+	}
+}
+
+// ShuttingDownResponse builds the response sent when an invocation
+// is abandoned because the relay is shutting down.
+func ShuttingDownResponse() *messages.ExecutionResponse {
+	return &messages.ExecutionResponse{
+		Status:        "relay_shutting_down",
+		StatusMessage: "Relay is shutting down. Please try again.",
+	}
+}
+
+// exitCodeFor returns the exit code of the command which produced
+// result. Environments which can't report exit codes are assumed to
+// have exited with 0 on success; their failures have no exit code.
+func exitCodeFor(env circuit.Environment, result api.ExecResult, err error) *int {
+	if err != nil {
+		return nil
+	}
+	if reporter, ok := env.(engines.ExitCodeReporter); ok {
+		if exitCode, exited := reporter.LastExitCode(); exited {
+			return &exitCode
+		}
+		return nil
+	}
+	if result.GetSuccess() {
+		exitCode := 0
+		return &exitCode
+	}
+	return nil
+}
+
+// capStderr returns at most maxResponseStderr bytes of stderr
+func capStderr(stderr []byte) string {
+	if len(stderr) > maxResponseStderr {
+		return string(stderr[:maxResponseStderr])
+	}
+	return string(stderr)
+}
+
+type runResult struct {
+	result api.ExecResult
+	err    error
+}
+
+// runCommand executes request in env and waits for it to finish or
+// for ctx to be done, whichever comes first. The environment is left
+// untouched when ctx finishes first; callers are expected to kill it.
+// If stdout is not nil and env supports streaming, output is copied
+// to stdout as it is produced.
+func runCommand(ctx context.Context, env circuit.Environment, request api.ExecRequest, stdout io.Writer) (api.ExecResult, error) {
+	done := make(chan runResult, 1)
+	go func() {
+		var result api.ExecResult
+		var err error
+		if streamingEnv, ok := env.(engines.StreamingEnvironment); ok && stdout != nil {
+			result, err = streamingEnv.RunStreaming(request, stdout)
+		} else {
+			result, err = env.Run(request)
+		}
+		done <- runResult{result, err}
+	}()
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-ctx.Done():
+		return circuit.EmptyExecResult, ctx.Err()
+	}
+}
+
+// withTimeout derives a context which expires after timeout. A zero
+// timeout means no deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d
+	}
+	return d - (d % (time.Millisecond * 100))
 }
 
 func setError(resp *messages.ExecutionResponse, err error) {
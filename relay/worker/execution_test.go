@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"github.com/operable/circuit"
+	"github.com/operable/circuit-driver/api"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+type sleepyEnvironment struct {
+	delay time.Duration
+}
+
+func (se *sleepyEnvironment) GetKind() circuit.EnvironmentKind {
+	return circuit.NativeKind
+}
+
+func (se *sleepyEnvironment) SetUserData(data circuit.EnvironmentUserData) error {
+	return nil
+}
+
+func (se *sleepyEnvironment) GetUserData() (circuit.EnvironmentUserData, error) {
+	return nil, nil
+}
+
+func (se *sleepyEnvironment) GetMetadata() circuit.EnvironmentMetadata {
+	return circuit.EnvironmentMetadata{}
+}
+
+func (se *sleepyEnvironment) Run(request api.ExecRequest) (api.ExecResult, error) {
+	time.Sleep(se.delay)
+	result := api.ExecResult{
+		Stdout: []byte("done"),
+	}
+	result.SetSuccess(true)
+	return result, nil
+}
+
+func (se *sleepyEnvironment) Shutdown() error {
+	return nil
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	env := &sleepyEnvironment{
+		delay: time.Duration(1) * time.Second,
+	}
+	ctx, cancel := withTimeout(context.Background(), time.Duration(10)*time.Millisecond)
+	defer cancel()
+	_, err := runCommand(ctx, env, api.ExecRequest{}, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected runCommand to time out: %v", err)
+	}
+}
+
+func TestRunCommandNoTimeout(t *testing.T) {
+	env := &sleepyEnvironment{
+		delay: time.Duration(10) * time.Millisecond,
+	}
+	ctx, cancel := withTimeout(context.Background(), 0)
+	defer cancel()
+	result, err := runCommand(ctx, env, api.ExecRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "done" {
+		t.Errorf("Unexpected runCommand result: %s", result.Stdout)
+	}
+}
+
+type exitingEnvironment struct {
+	sleepyEnvironment
+	exitCode int
+}
+
+func (ee *exitingEnvironment) LastExitCode() (int, bool) {
+	return ee.exitCode, true
+}
+
+func TestExitCodeFromReporter(t *testing.T) {
+	env := &exitingEnvironment{
+		exitCode: 3,
+	}
+	result := api.ExecResult{}
+	result.SetSuccess(false)
+	exitCode := exitCodeFor(env, result, nil)
+	if exitCode == nil || *exitCode != 3 {
+		t.Errorf("Expected exit code 3: %v", exitCode)
+	}
+}
+
+func TestExitCodeWithoutReporter(t *testing.T) {
+	env := &sleepyEnvironment{}
+	result := api.ExecResult{}
+	result.SetSuccess(true)
+	if exitCode := exitCodeFor(env, result, nil); exitCode == nil || *exitCode != 0 {
+		t.Errorf("Expected exit code 0 for successful command: %v", exitCode)
+	}
+	result.SetSuccess(false)
+	if exitCode := exitCodeFor(env, result, nil); exitCode != nil {
+		t.Errorf("Expected no exit code for failed command: %v", *exitCode)
+	}
+}
+
+func TestCapStderr(t *testing.T) {
+	stderr := make([]byte, maxResponseStderr+10)
+	if capped := capStderr(stderr); len(capped) != maxResponseStderr {
+		t.Errorf("Expected stderr to be capped at %d bytes: %d", maxResponseStderr, len(capped))
+	}
+}
@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/messages"
+)
+
+// truncateOutput enforces the relay's stdout and stderr limits on
+// result. stdout is cut at the last complete line which fits so
+// parsers never see a partial line. Returns true for each stream
+// which was cut short.
+func truncateOutput(result *api.ExecResult, execution *config.ExecutionInfo) (bool, bool) {
+	stdoutCut := false
+	stderrCut := false
+	if len(result.Stdout) > execution.MaxStdout {
+		stdout := result.Stdout[:execution.MaxStdout]
+		if idx := bytes.LastIndexByte(stdout, '\n'); idx >= 0 {
+			stdout = stdout[:idx+1]
+		}
+		result.Stdout = stdout
+		stdoutCut = true
+	}
+	if len(result.Stderr) > execution.MaxStderr {
+		stderr := append([]byte{}, result.Stderr[:execution.MaxStderr]...)
+		result.Stderr = append(stderr, []byte("\n"+truncationMarker("stderr", execution.MaxStderr))...)
+		stderrCut = true
+	}
+	return stdoutCut, stderrCut
+}
+
+// markTruncated appends a truncation marker to a text response body.
+// Returns false if the body can't carry a marker, for example because
+// it was JSON which no longer parses.
+func markTruncated(response *messages.ExecutionResponse, limit int) bool {
+	marker := truncationMarker("output", limit)
+	if response.Status != "ok" && response.Status != "abort" {
+		return false
+	}
+	switch body := response.Body.(type) {
+	case []map[string][]string:
+		last := body[len(body)-1]
+		last["body"] = append(last["body"], marker)
+		return true
+	case nil:
+		if response.IsJSON {
+			return false
+		}
+		response.Body = []map[string][]string{
+			map[string][]string{
+				"body": []string{marker},
+			},
+		}
+		return true
+	}
+	return false
+}
+
+// tooLargeResponse builds the response sent when a command's output
+// exceeds the relay's limits and can't be truncated.
+func tooLargeResponse(execution *config.ExecutionInfo) *messages.ExecutionResponse {
+	return &messages.ExecutionResponse{
+		Status: "too_large",
+		StatusMessage: fmt.Sprintf("Command output exceeded the relay's limits of %d bytes of stdout and %d bytes of stderr.",
+			execution.MaxStdout, execution.MaxStderr),
+	}
+}
+
+func truncationMarker(stream string, limit int) string {
+	return fmt.Sprintf("[%s truncated at %d bytes]", stream, limit)
+}
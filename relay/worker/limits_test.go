@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/config"
+	"testing"
+)
+
+var limits = &config.ExecutionInfo{
+	MaxStdout:      10,
+	MaxStderr:      4,
+	OversizePolicy: config.TruncateOversizeOutput,
+}
+
+func TestTruncateOutput(t *testing.T) {
+	result := api.ExecResult{
+		Stdout: []byte("abc\ndef\nghijkl\n"),
+		Stderr: []byte("oops, again"),
+	}
+	stdoutCut, stderrCut := truncateOutput(&result, limits)
+	if stdoutCut == false || stderrCut == false {
+		t.Fatalf("Expected stdout and stderr to be cut: %v %v", stdoutCut, stderrCut)
+	}
+	if string(result.Stdout) != "abc\ndef\n" {
+		t.Errorf("Expected stdout to be cut at a line boundary: %q", result.Stdout)
+	}
+	if string(result.Stderr) != "oops\n[stderr truncated at 4 bytes]" {
+		t.Errorf("Unexpected truncated stderr: %q", result.Stderr)
+	}
+}
+
+func TestOutputWithinLimits(t *testing.T) {
+	result := api.ExecResult{
+		Stdout: []byte("abc\n"),
+	}
+	if stdoutCut, stderrCut := truncateOutput(&result, limits); stdoutCut || stderrCut {
+		t.Error("Expected output within limits to be left alone")
+	}
+}
+
+func TestMarkTruncatedTextBody(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("abc\ndef\n"),
+	}
+	result.SetSuccess(true)
+	resp := outputParser.Parse(result, req, nil)
+	if markTruncated(resp, 10) == false {
+		t.Fatal("Expected text body to be marked")
+	}
+	text, _ := json.Marshal(resp.Body)
+	if string(text) != "[{\"body\":[\"abc\",\"def\",\"[output truncated at 10 bytes]\"]}]" {
+		t.Errorf("Unexpected marked body: %s", text)
+	}
+}
+
+func TestMarkTruncatedJSONBody(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("JSON\n{\"foo\": "),
+	}
+	result.SetSuccess(true)
+	resp := outputParser.Parse(result, req, nil)
+	if markTruncated(resp, 10) == true {
+		t.Error("Expected truncated JSON body not to be marked")
+	}
+}
@@ -0,0 +1,12 @@
+package worker
+
+import (
+	"github.com/operable/go-relay/relay/metrics"
+)
+
+var executionsTotal = metrics.NewCounter("relay_executions_total",
+	"Command invocations answered, by bundle, command and status.", "bundle", "command", "status")
+var executionSeconds = metrics.NewHistogram("relay_execution_duration_seconds",
+	"Time spent running commands.", nil, "bundle", "command")
+var queueWaitSeconds = metrics.NewHistogram("relay_queue_wait_seconds",
+	"Time invocations spent queued before a worker picked them up.", nil)
@@ -1,11 +1,27 @@
 package worker
 
 import (
+	"errors"
 	"github.com/operable/circuit-driver/api"
 	"github.com/operable/go-relay/relay/messages"
 )
 
+var errorUnknownOutputVersion = errors.New("Unsupported bundle output_version")
+
 // OutputParser parses logging directives and content emitted by commands
 type OutputParser interface {
 	Parse(api.ExecResult, messages.ExecutionRequest, error) *messages.ExecutionResponse
 }
+
+// NewOutputParser returns the OutputParser for a bundle's declared
+// output protocol version. Bundles which don't declare a version use
+// the original protocol.
+func NewOutputParser(version int) (OutputParser, error) {
+	switch version {
+	case 0, 1:
+		return NewOutputParserV1(), nil
+	case 2:
+		return NewOutputParserV2(), nil
+	}
+	return nil, errorUnknownOutputVersion
+}
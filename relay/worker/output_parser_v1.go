@@ -103,6 +103,17 @@ func (op *OutputParserV1) Parse(result api.ExecResult, req messages.ExecutionReq
 	return resp
 }
 
+// IsDirective returns true if line is one of the protocol's output
+// directives rather than command output
+func (op *OutputParserV1) IsDirective(line string) bool {
+	for re := range op.matchers {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
 func (op *OutputParserV1) writeToLog(line []string, resp *messages.ExecutionResponse, req messages.ExecutionRequest) {
 	message := strings.Trim(line[1], " ")
 	if message == "" {
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/circuit-driver/api"
+	"github.com/operable/go-relay/relay/messages"
+	"github.com/operable/go-relay/relay/util"
+	"strings"
+)
+
+// envelopeSeparator starts a framed output envelope. Framing follows
+// RFC 7464 JSON text sequences: an ASCII record separator, the JSON
+// text, and a trailing newline.
+const envelopeSeparator = '\x1e'
+
+type outputEnvelope struct {
+	Body        interface{}                    `json:"body"`
+	Template    string                         `json:"template"`
+	Logs        []outputLogEntry               `json:"logs"`
+	Action      string                         `json:"action"`
+	Attachments map[string]messages.Attachment `json:"attachments"`
+}
+
+type outputLogEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// OutputParserV2 understands the framed JSON output protocol. Commands
+// write a single envelope carrying the response body, template, log
+// entries, action, and named attachments. Output outside the envelope
+// is discarded.
+type OutputParserV2 struct{}
+
+// NewOutputParserV2 returns an OutputParser instance which understands
+// Relay's framed JSON output protocol.
+func NewOutputParserV2() OutputParser {
+	return &OutputParserV2{}
+}
+
+// Parse is required by the OutputParser interface
+func (op *OutputParserV2) Parse(result api.ExecResult, req messages.ExecutionRequest, err error) *messages.ExecutionResponse {
+	resp := &messages.ExecutionResponse{}
+	resp.Status = "ok"
+	if err != nil {
+		resp.Status = "error"
+		resp.StatusMessage = fmt.Sprintf("%s", err)
+		return resp
+	}
+	envelope, err := op.extractEnvelope(result.Stdout, req)
+	if envelope != nil {
+		op.writeToLog(envelope.Logs, req)
+	}
+	if !result.GetSuccess() {
+		resp.Status = "error"
+		resp.StatusMessage = string(result.Stderr)
+		return resp
+	}
+	if err != nil {
+		resp.Status = "error"
+		resp.StatusMessage = fmt.Sprintf("%s", err)
+		return resp
+	}
+	if envelope == nil {
+		return resp
+	}
+	resp.Body = envelope.Body
+	resp.Template = strings.Trim(envelope.Template, " ")
+	resp.Attachments = envelope.Attachments
+	switch strings.Trim(envelope.Action, " ") {
+	case "":
+		break
+	case "abort":
+		resp.Aborted = true
+		resp.Status = "abort"
+	default:
+		log.Warnf("(P: %s C: %s) Ignoring unknown output action '%s'.", req.PipelineID(), req.Command, envelope.Action)
+	}
+	return resp
+}
+
+// extractEnvelope finds and decodes the envelope frame. Returns nil
+// without an error if the command produced no output at all.
+func (op *OutputParserV2) extractEnvelope(stdout []byte, req messages.ExecutionRequest) (*outputEnvelope, error) {
+	frames := bytes.Split(stdout, []byte{envelopeSeparator})
+	stray := bytes.TrimSpace(frames[0])
+	if len(frames) == 1 {
+		if len(stray) == 0 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Command output is missing an output envelope.")
+	}
+	if len(frames) > 2 {
+		return nil, fmt.Errorf("Command output contains %d output envelopes; expected 1.", len(frames)-1)
+	}
+	if len(stray) > 0 {
+		log.Debugf("(P: %s C: %s) Discarding %d bytes of output outside of the output envelope.",
+			req.PipelineID(), req.Command, len(stray))
+	}
+	envelope := &outputEnvelope{}
+	decoder := util.NewJSONDecoder(bytes.NewReader(frames[1]))
+	if err := decoder.Decode(envelope); err != nil {
+		return nil, fmt.Errorf("Command returned an invalid output envelope: %s.", err)
+	}
+	return envelope, nil
+}
+
+func (op *OutputParserV2) writeToLog(entries []outputLogEntry, req messages.ExecutionRequest) {
+	format := "(P: %s C: %s) %s"
+	for _, entry := range entries {
+		message := strings.Trim(entry.Message, " ")
+		if message == "" {
+			continue
+		}
+		switch strings.ToLower(entry.Level) {
+		case "debug":
+			log.Debugf(format, req.PipelineID(), req.Command, message)
+		case "warn":
+			log.Warnf(format, req.PipelineID(), req.Command, message)
+		case "err":
+			fallthrough
+		case "error":
+			log.Errorf(format, req.PipelineID(), req.Command, message)
+		default:
+			log.Infof(format, req.PipelineID(), req.Command, message)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/operable/circuit-driver/api"
+	"testing"
+)
+
+var outputParserV2 = NewOutputParserV2()
+
+func TestParseEnvelope(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("stray output\n\x1e{\"body\": {\"foo\": 123}, \"template\": \"foo\", " +
+			"\"logs\": [{\"level\": \"debug\", \"message\": \"Testing 123\"}], " +
+			"\"attachments\": {\"report.txt\": {\"content_type\": \"text/plain\", \"data\": \"aGVsbG8=\"}}}\n"),
+		Stderr: emptyStream,
+	}
+	result.SetSuccess(true)
+	resp := outputParserV2.Parse(result, req, nil)
+	if resp.Status != "ok" {
+		t.Fatalf("Unexpected response status %s: %s", resp.Status, resp.StatusMessage)
+	}
+	text, _ := json.Marshal(resp.Body)
+	if string(text) != "{\"foo\":123}" {
+		t.Errorf("Unexpected body: %s", text)
+	}
+	if resp.Template != "foo" {
+		t.Errorf("Unexpected template: %s", resp.Template)
+	}
+	attachment, ok := resp.Attachments["report.txt"]
+	if ok == false || attachment.ContentType != "text/plain" || attachment.Data != "aGVsbG8=" {
+		t.Errorf("Unexpected attachments: %+v", resp.Attachments)
+	}
+}
+
+func TestParseEnvelopeAbort(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("\x1e{\"action\": \"abort\"}\n"),
+	}
+	result.SetSuccess(true)
+	resp := outputParserV2.Parse(result, req, nil)
+	if resp.Status != "abort" {
+		t.Errorf("Unexpected response status %s", resp.Status)
+	}
+}
+
+func TestParseMissingEnvelope(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("COGCMD_ACTION: abort\n"),
+	}
+	result.SetSuccess(true)
+	resp := outputParserV2.Parse(result, req, nil)
+	if resp.Status != "error" {
+		t.Errorf("Unexpected response status %s", resp.Status)
+	}
+}
+
+func TestParseMultipleEnvelopes(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{
+		Stdout: []byte("\x1e{\"body\": 1}\n\x1e{\"body\": 2}\n"),
+	}
+	result.SetSuccess(true)
+	resp := outputParserV2.Parse(result, req, nil)
+	if resp.Status != "error" {
+		t.Errorf("Unexpected response status %s", resp.Status)
+	}
+}
+
+func TestParseNoOutputV2(t *testing.T) {
+	req.Parse()
+	result := api.ExecResult{}
+	result.SetSuccess(true)
+	resp := outputParserV2.Parse(result, req, nil)
+	if resp.Status != "ok" || resp.Body != nil {
+		t.Errorf("Unexpected parse result: %+v", resp)
+	}
+}
+
+func TestSelectOutputParser(t *testing.T) {
+	if parser, _ := NewOutputParser(0); parser == nil {
+		t.Error("Expected default output parser")
+	}
+	if parser, _ := NewOutputParser(2); parser == nil {
+		t.Error("Expected V2 output parser")
+	}
+	if _, err := NewOutputParser(3); err == nil {
+		t.Error("Expected unknown output version to be rejected")
+	}
+}
@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+type registryEntry struct {
+	cancel    context.CancelFunc
+	running   bool
+	cancelled bool
+	started   time.Time
+}
+
+// InvocationStatus describes a tracked invocation
+type InvocationStatus struct {
+	PipelineID   string     `json:"pipeline_id"`
+	InvocationID string     `json:"invocation_id"`
+	Command      string     `json:"command"`
+	State        string     `json:"state"`
+	Enqueued     time.Time  `json:"enqueued"`
+	Started      *time.Time `json:"started,omitempty"`
+}
+
+// Registry tracks queued and running command invocations so
+// they can be found and cancelled by pipeline or invocation id.
+type Registry struct {
+	lock    sync.Mutex
+	entries map[*CommandInvocation]*registryEntry
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[*CommandInvocation]*registryEntry),
+	}
+}
+
+// Add registers a queued invocation. cancel is called if the
+// invocation is cancelled.
+func (r *Registry) Add(invoke *CommandInvocation, cancel context.CancelFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[invoke] = &registryEntry{
+		cancel: cancel,
+	}
+}
+
+// Start marks a queued invocation as running. Returns false if
+// the invocation was cancelled while queued and should be skipped.
+func (r *Registry) Start(invoke *CommandInvocation) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := r.entries[invoke]
+	if entry == nil {
+		return true
+	}
+	if entry.cancelled {
+		delete(r.entries, invoke)
+		return false
+	}
+	entry.running = true
+	entry.started = time.Now()
+	return true
+}
+
+// Remove forgets a finished invocation
+func (r *Registry) Remove(invoke *CommandInvocation) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry := r.entries[invoke]; entry != nil {
+		entry.cancel()
+		delete(r.entries, invoke)
+	}
+}
+
+// Len returns the number of tracked invocations
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.entries)
+}
+
+// Snapshot describes every tracked invocation. State is one of
+// queued, running or cancelled.
+func (r *Registry) Snapshot() []InvocationStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	statuses := []InvocationStatus{}
+	for invoke, entry := range r.entries {
+		status := InvocationStatus{
+			PipelineID:   invoke.Request.PipelineID(),
+			InvocationID: invoke.Request.InvocationID,
+			Command:      invoke.Request.Command,
+			State:        "queued",
+			Enqueued:     invoke.Enqueued,
+		}
+		if entry.running {
+			started := entry.started
+			status.State = "running"
+			status.Started = &started
+		}
+		if entry.cancelled {
+			status.State = "cancelled"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Cancel aborts every tracked invocation matching either pipelineID
+// or invocationID. Empty ids never match. Running invocations are
+// killed and answered by their worker; queued invocations are
+// returned so the caller can answer them right away.
+func (r *Registry) Cancel(pipelineID string, invocationID string) []*CommandInvocation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	queued := []*CommandInvocation{}
+	for invoke, entry := range r.entries {
+		if entry.cancelled || !matchesInvocation(invoke, pipelineID, invocationID) {
+			continue
+		}
+		entry.cancelled = true
+		entry.cancel()
+		if entry.running == false {
+			queued = append(queued, invoke)
+		}
+	}
+	return queued
+}
+
+// Shutdown aborts every running invocation. Their workers answer
+// them with a relay_shutting_down response.
+func (r *Registry) Shutdown() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	count := 0
+	for invoke, entry := range r.entries {
+		if entry.running == false || entry.cancelled {
+			continue
+		}
+		// Set before cancelling so the worker sees it once
+		// the invocation's context is done.
+		invoke.Shutdown = true
+		entry.cancelled = true
+		entry.cancel()
+		count++
+	}
+	return count
+}
+
+func matchesInvocation(invoke *CommandInvocation, pipelineID string, invocationID string) bool {
+	if invoke.Request == nil {
+		return false
+	}
+	if pipelineID != "" && invoke.Request.PipelineID() == pipelineID {
+		return true
+	}
+	return invocationID != "" && invoke.Request.InvocationID == invocationID
+}
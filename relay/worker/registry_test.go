@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func newTestInvocation(t *testing.T, replyTo string, invocationID string) *CommandInvocation {
+	invoke := &CommandInvocation{
+		Payload: []byte(`{"command": "foo:bar", "reply_to": "` + replyTo + `", "invocation_id": "` + invocationID + `"}`),
+	}
+	if err := invoke.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	return invoke
+}
+
+func TestCancelQueuedInvocation(t *testing.T) {
+	registry := NewRegistry()
+	invoke := newTestInvocation(t, "/bot/pipelines/p1/reply", "i1")
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.Add(invoke, cancel)
+	queued := registry.Cancel("p1", "")
+	if len(queued) != 1 || queued[0] != invoke {
+		t.Fatalf("Expected queued invocation to be returned: %v", queued)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Error("Expected invocation context to be cancelled")
+	}
+	if registry.Start(invoke) == true {
+		t.Error("Expected cancelled invocation to be skipped")
+	}
+	if registry.Len() != 0 {
+		t.Errorf("Expected empty registry: %d", registry.Len())
+	}
+}
+
+func TestCancelRunningInvocation(t *testing.T) {
+	registry := NewRegistry()
+	first := newTestInvocation(t, "/bot/pipelines/p1/reply", "i1")
+	second := newTestInvocation(t, "/bot/pipelines/p2/reply", "i2")
+	firstCtx, firstCancel := context.WithCancel(context.Background())
+	secondCtx, secondCancel := context.WithCancel(context.Background())
+	registry.Add(first, firstCancel)
+	registry.Add(second, secondCancel)
+	registry.Start(first)
+	if queued := registry.Cancel("", "i1"); len(queued) != 0 {
+		t.Errorf("Expected running invocation to be answered by its worker: %v", queued)
+	}
+	if firstCtx.Err() != context.Canceled {
+		t.Error("Expected running invocation context to be cancelled")
+	}
+	if secondCtx.Err() != nil {
+		t.Error("Expected unmatched invocation to keep running")
+	}
+}
+
+func TestShutdownRunningInvocations(t *testing.T) {
+	registry := NewRegistry()
+	running := newTestInvocation(t, "/bot/pipelines/p1/reply", "i1")
+	queued := newTestInvocation(t, "/bot/pipelines/p2/reply", "i2")
+	runningCtx, runningCancel := context.WithCancel(context.Background())
+	queuedCtx, queuedCancel := context.WithCancel(context.Background())
+	registry.Add(running, runningCancel)
+	registry.Add(queued, queuedCancel)
+	registry.Start(running)
+	if killed := registry.Shutdown(); killed != 1 {
+		t.Errorf("Expected one running invocation to be killed: %d", killed)
+	}
+	if runningCtx.Err() != context.Canceled || running.Shutdown == false {
+		t.Error("Expected running invocation to be shut down")
+	}
+	if queuedCtx.Err() != nil || queued.Shutdown == true {
+		t.Error("Expected queued invocation to be left alone")
+	}
+}
@@ -0,0 +1,326 @@
+package worker
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/config"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+type queuedInvocation struct {
+	ctx        context.Context
+	bundle     string
+	command    string
+	scheduling Scheduling
+	enqueued   time.Time
+}
+
+type bundleQueue struct {
+	name    string
+	weight  int
+	current int
+	items   []*queuedInvocation
+}
+
+// Scheduler is a bounded queue of command invocations which keeps a
+// sub-queue per bundle. Higher priority invocations are handed to
+// workers first; within a priority, bundles are served in weighted
+// round robin order so one busy bundle can't starve the others.
+// Waiting invocations are promoted one priority lane per aging
+// interval so low priority work still runs under sustained load.
+// Invocations whose bundle or command is already running at its
+// concurrency limit wait until a slot frees up.
+type Scheduler struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	capacity int
+	aging    time.Duration
+	size     int
+	draining bool
+	closed   bool
+	policy   SchedulingPolicy
+	bundles  map[string]*bundleQueue
+	running  map[string]int
+	active   map[context.Context]*queuedInvocation
+}
+
+// Scheduling describes how an invocation is scheduled. A limit of 0
+// means unlimited. Priority is a lane index; lane 0 is drained first.
+type Scheduling struct {
+	BundleLimit  int
+	CommandLimit int
+	Weight       int
+	Priority     int
+}
+
+// SchedulingPolicy looks up the Scheduling for a command invocation
+type SchedulingPolicy func(invoke *CommandInvocation) Scheduling
+
+// ConfiguredPolicy is the SchedulingPolicy used by Relay. Settings in
+// the relay config take precedence over those declared by the bundle.
+// A priority set on the request itself overrides both.
+func ConfiguredPolicy(invoke *CommandInvocation) Scheduling {
+	request := invoke.Request
+	execution := invoke.RelayConfig.Execution
+	scheduling := Scheduling{
+		BundleLimit:  execution.ConcurrencyLimit(request.BundleName()),
+		CommandLimit: execution.ConcurrencyLimit(request.Command),
+		Weight:       execution.BundleWeight(request.BundleName()),
+	}
+	priority := execution.BundlePriority(request.BundleName())
+	if bundle := invoke.Catalog.Find(request.BundleName()); bundle != nil {
+		if scheduling.BundleLimit == 0 {
+			scheduling.BundleLimit = bundle.MaxConcurrent
+		}
+		if command := bundle.Commands[request.CommandName()]; command != nil && scheduling.CommandLimit == 0 {
+			scheduling.CommandLimit = command.MaxConcurrent
+		}
+		if priority == "" {
+			priority = bundle.Priority
+		}
+	}
+	if request.Priority != "" {
+		priority = request.Priority
+	}
+	scheduling.Priority, _ = config.PriorityLane(config.NormalPriority)
+	if priority != "" {
+		if lane, ok := config.PriorityLane(priority); ok {
+			scheduling.Priority = lane
+		} else {
+			log.Warnf("(P: %s C: %s) Ignoring unknown priority '%s'.", request.PipelineID(), request.Command, priority)
+		}
+	}
+	return scheduling
+}
+
+// NewScheduler returns an empty Scheduler which holds at most
+// capacity waiting invocations. An aging interval of 0 disables
+// priority promotion.
+func NewScheduler(capacity int, aging time.Duration, policy SchedulingPolicy) *Scheduler {
+	s := &Scheduler{
+		capacity: capacity,
+		aging:    aging,
+		policy:   policy,
+		bundles:  make(map[string]*bundleQueue),
+		running:  make(map[string]int),
+		active:   make(map[context.Context]*queuedInvocation),
+	}
+	s.ready = sync.NewCond(&s.lock)
+	return s
+}
+
+// Enqueue adds an invocation context to its bundle's sub-queue.
+// Returns false without blocking if the scheduler is full, draining
+// or closed.
+func (s *Scheduler) Enqueue(ctx context.Context) bool {
+	invoke := ctx.Value("invoke").(*CommandInvocation)
+	scheduling := s.policy(invoke)
+	if scheduling.Weight < 1 {
+		scheduling.Weight = 1
+	}
+	item := &queuedInvocation{
+		ctx:        ctx,
+		bundle:     invoke.Request.BundleName(),
+		command:    invoke.Request.Command,
+		scheduling: scheduling,
+		enqueued:   time.Now(),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.draining || s.closed || s.size >= s.capacity {
+		return false
+	}
+	queue := s.bundles[item.bundle]
+	if queue == nil {
+		queue = &bundleQueue{
+			name: item.bundle,
+		}
+		s.bundles[item.bundle] = queue
+	}
+	queue.weight = scheduling.Weight
+	queue.items = append(queue.items, item)
+	s.size++
+	s.ready.Broadcast()
+	return true
+}
+
+// Next blocks until an invocation may run and returns its context.
+// Returns false once the scheduler is closed.
+func (s *Scheduler) Next() (context.Context, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.closed {
+			return nil, false
+		}
+		if item := s.pick(time.Now()); item != nil {
+			s.size--
+			s.running[item.bundle]++
+			s.running[item.command]++
+			s.active[item.ctx] = item
+			return item.ctx, true
+		}
+		s.ready.Wait()
+	}
+}
+
+// Done releases the concurrency slots held by a finished invocation
+func (s *Scheduler) Done(ctx context.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	item := s.active[ctx]
+	if item == nil {
+		return
+	}
+	delete(s.active, ctx)
+	s.release(item.bundle)
+	s.release(item.command)
+	s.ready.Broadcast()
+}
+
+// Len returns the number of waiting invocations
+func (s *Scheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// Drain stops the scheduler from accepting new invocations. Waiting
+// invocations are still handed to workers.
+func (s *Scheduler) Drain() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.draining = true
+}
+
+// Draining returns true once Drain or Close has been called
+func (s *Scheduler) Draining() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.draining || s.closed
+}
+
+// Wait blocks until no invocations are waiting or running, or until
+// timeout passes. Returns false on timeout.
+func (s *Scheduler) Wait(timeout time.Duration) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		expired = true
+		s.ready.Broadcast()
+	})
+	defer timer.Stop()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.size > 0 || len(s.active) > 0 {
+		if expired {
+			return false
+		}
+		s.ready.Wait()
+	}
+	return true
+}
+
+// Close wakes up all waiting workers and makes them exit. Returns the
+// contexts of invocations which were still waiting; they will never
+// be run.
+func (s *Scheduler) Close() []context.Context {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	discarded := []context.Context{}
+	for _, queue := range s.bundles {
+		for _, item := range queue.items {
+			discarded = append(discarded, item.ctx)
+		}
+	}
+	s.bundles = make(map[string]*bundleQueue)
+	s.size = 0
+	s.ready.Broadcast()
+	return discarded
+}
+
+func (s *Scheduler) release(key string) {
+	if s.running[key] <= 1 {
+		delete(s.running, key)
+	} else {
+		s.running[key]--
+	}
+}
+
+// pick selects the next runnable invocation. Only bundles whose best
+// runnable invocation is in the highest priority lane available take
+// part; among those, smooth weighted round robin decides.
+func (s *Scheduler) pick(now time.Time) *queuedInvocation {
+	candidates := make(map[*bundleQueue]int)
+	bestLane := -1
+	for _, queue := range s.bundles {
+		index, lane := s.runnable(queue, now)
+		if index < 0 {
+			continue
+		}
+		if bestLane < 0 || lane < bestLane {
+			bestLane = lane
+			candidates = make(map[*bundleQueue]int)
+		}
+		if lane == bestLane {
+			candidates[queue] = index
+		}
+	}
+	var best *bundleQueue
+	total := 0
+	for queue := range candidates {
+		queue.current += queue.weight
+		total += queue.weight
+		if best == nil || queue.current > best.current {
+			best = queue
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.current -= total
+	index := candidates[best]
+	item := best.items[index]
+	best.items = append(best.items[:index], best.items[index+1:]...)
+	if len(best.items) == 0 {
+		delete(s.bundles, best.name)
+	}
+	return item
+}
+
+// runnable returns the index and effective priority lane of the
+// oldest, highest priority invocation in queue which is under its
+// concurrency limits. Returns -1 if there is none.
+func (s *Scheduler) runnable(queue *bundleQueue, now time.Time) (int, int) {
+	bestIndex := -1
+	bestLane := 0
+	for i, item := range queue.items {
+		if item.scheduling.BundleLimit > 0 && s.running[item.bundle] >= item.scheduling.BundleLimit {
+			return -1, 0
+		}
+		if item.scheduling.CommandLimit > 0 && s.running[item.command] >= item.scheduling.CommandLimit {
+			continue
+		}
+		lane := s.lane(item, now)
+		if bestIndex < 0 || lane < bestLane {
+			bestIndex = i
+			bestLane = lane
+		}
+	}
+	return bestIndex, bestLane
+}
+
+// lane returns an invocation's priority lane after aging
+func (s *Scheduler) lane(item *queuedInvocation, now time.Time) int {
+	lane := item.scheduling.Priority
+	if s.aging > 0 {
+		lane -= int(now.Sub(item.enqueued) / s.aging)
+	}
+	if lane < 0 {
+		return 0
+	}
+	return lane
+}
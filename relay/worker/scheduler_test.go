@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+type testPolicy map[string]Scheduling
+
+func (tp testPolicy) lookup(invoke *CommandInvocation) Scheduling {
+	return tp[invoke.Request.Command]
+}
+
+func enqueueCommand(t *testing.T, s *Scheduler, command string) context.Context {
+	invoke := &CommandInvocation{
+		Payload: []byte(`{"command": "` + command + `", "reply_to": "/bot/pipelines/p1/reply"}`),
+	}
+	if err := invoke.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), "invoke", invoke)
+	if s.Enqueue(ctx) == false {
+		t.Fatalf("Failed to enqueue %s", command)
+	}
+	return ctx
+}
+
+func nextCommand(t *testing.T, s *Scheduler) string {
+	ctx, ok := s.Next()
+	if ok == false {
+		t.Fatal("Scheduler closed unexpectedly")
+	}
+	return ctx.Value("invoke").(*CommandInvocation).Request.Command
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	policy := testPolicy{"heavy:cmd": {Weight: 3}, "light:cmd": {Weight: 1}}
+	s := NewScheduler(16, 0, policy.lookup)
+	for i := 0; i < 4; i++ {
+		enqueueCommand(t, s, "heavy:cmd")
+		enqueueCommand(t, s, "light:cmd")
+	}
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		counts[nextCommand(t, s)]++
+	}
+	if counts["heavy:cmd"] != 3 || counts["light:cmd"] != 1 {
+		t.Errorf("Expected a 3:1 split: %v", counts)
+	}
+}
+
+func TestSchedulerBundleLimit(t *testing.T) {
+	policy := testPolicy{"foo:bar": {BundleLimit: 1}, "foo:baz": {BundleLimit: 1}}
+	s := NewScheduler(16, 0, policy.lookup)
+	first := enqueueCommand(t, s, "foo:bar")
+	enqueueCommand(t, s, "foo:baz")
+	if ctx, _ := s.Next(); ctx != first {
+		t.Fatal("Expected oldest invocation first")
+	}
+	if s.pick(time.Now()) != nil {
+		t.Error("Expected bundle limit to hold back foo:baz")
+	}
+	s.Done(first)
+	if command := nextCommand(t, s); command != "foo:baz" {
+		t.Errorf("Expected foo:baz after slot freed: %s", command)
+	}
+}
+
+func TestSchedulerCommandLimit(t *testing.T) {
+	policy := testPolicy{"foo:bar": {CommandLimit: 1}}
+	s := NewScheduler(16, 0, policy.lookup)
+	enqueueCommand(t, s, "foo:bar")
+	enqueueCommand(t, s, "foo:bar")
+	enqueueCommand(t, s, "foo:baz")
+	if command := nextCommand(t, s); command != "foo:bar" {
+		t.Fatalf("Expected foo:bar first: %s", command)
+	}
+	if command := nextCommand(t, s); command != "foo:baz" {
+		t.Errorf("Expected capped foo:bar to be skipped: %s", command)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected one waiting invocation: %d", s.Len())
+	}
+}
+
+func TestSchedulerCapacity(t *testing.T) {
+	s := NewScheduler(1, 0, testPolicy{}.lookup)
+	enqueueCommand(t, s, "foo:bar")
+	invoke := &CommandInvocation{
+		Payload: []byte(`{"command": "foo:bar", "reply_to": "/bot/pipelines/p1/reply"}`),
+	}
+	invoke.Parse()
+	if s.Enqueue(context.WithValue(context.Background(), "invoke", invoke)) == true {
+		t.Error("Expected full scheduler to reject invocation")
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := NewScheduler(1, 0, testPolicy{}.lookup)
+	done := make(chan bool)
+	go func() {
+		_, ok := s.Next()
+		done <- ok
+	}()
+	s.Close()
+	if ok := <-done; ok == true {
+		t.Error("Expected Next to return false after Close")
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	policy := testPolicy{"batch:cmd": {Priority: 2}, "chat:cmd": {Priority: 0}}
+	s := NewScheduler(16, 0, policy.lookup)
+	enqueueCommand(t, s, "batch:cmd")
+	enqueueCommand(t, s, "batch:cmd")
+	enqueueCommand(t, s, "chat:cmd")
+	if command := nextCommand(t, s); command != "chat:cmd" {
+		t.Errorf("Expected high priority invocation first: %s", command)
+	}
+}
+
+func TestSchedulerAging(t *testing.T) {
+	policy := testPolicy{"batch:cmd": {Priority: 2}, "ops:cmd": {Priority: 1}}
+	s := NewScheduler(16, time.Minute, policy.lookup)
+	enqueueCommand(t, s, "batch:cmd")
+	enqueueCommand(t, s, "ops:cmd")
+	if item := s.pick(time.Now()); item.command != "ops:cmd" {
+		t.Fatalf("Expected higher priority invocation first: %s", item.command)
+	}
+	enqueueCommand(t, s, "ops:cmd")
+	s.bundles["batch"].items[0].enqueued = time.Now().Add(-3 * time.Minute)
+	if item := s.pick(time.Now()); item.command != "batch:cmd" {
+		t.Errorf("Expected aged invocation to be promoted: %s", item.command)
+	}
+}
+
+func TestSchedulerDrain(t *testing.T) {
+	s := NewScheduler(4, 0, testPolicy{}.lookup)
+	enqueueCommand(t, s, "foo:bar")
+	enqueueCommand(t, s, "foo:baz")
+	s.Drain()
+	invoke := &CommandInvocation{
+		Payload: []byte(`{"command": "foo:bar", "reply_to": "/bot/pipelines/p1/reply"}`),
+	}
+	invoke.Parse()
+	if s.Enqueue(context.WithValue(context.Background(), "invoke", invoke)) == true {
+		t.Error("Expected draining scheduler to reject invocation")
+	}
+	ctx, _ := s.Next()
+	if s.Wait(10*time.Millisecond) == true {
+		t.Error("Expected Wait to time out with work outstanding")
+	}
+	if discarded := s.Close(); len(discarded) != 1 {
+		t.Errorf("Expected one discarded invocation: %d", len(discarded))
+	}
+	s.Done(ctx)
+	if s.Wait(time.Second) == false {
+		t.Error("Expected idle scheduler")
+	}
+}
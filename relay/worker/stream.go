@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"github.com/operable/go-relay/relay/messages"
+	"sync"
+	"time"
+)
+
+// outputStreamer batches a command's stdout lines and publishes them
+// to Cog as partial ExecutionResponses. Lines are flushed once a batch
+// fills up or the stream interval elapses, whichever comes first.
+// Output directives are filtered out so they only take effect in the
+// final response. Streaming stops if the command switches to JSON
+// output since partial JSON documents can't be rendered, or once the
+// relay's stdout limit is reached.
+type outputStreamer struct {
+	invoke      *CommandInvocation
+	isDirective func(string) bool
+	batchSize   int
+	interval    time.Duration
+	limit       int
+	written     int
+	lock        sync.Mutex
+	pending     []byte
+	lines       []string
+	sequence    int
+	stopped     bool
+	timer       *time.Timer
+}
+
+func newOutputStreamer(invoke *CommandInvocation, isDirective func(string) bool) *outputStreamer {
+	execution := invoke.RelayConfig.Execution
+	return &outputStreamer{
+		invoke:      invoke,
+		isDirective: isDirective,
+		batchSize:   execution.StreamBatch,
+		interval:    execution.StreamDuration(),
+		limit:       execution.MaxStdout,
+	}
+}
+
+// Write is required by the io.Writer interface
+func (ost *outputStreamer) Write(data []byte) (int, error) {
+	ost.lock.Lock()
+	defer ost.lock.Unlock()
+	size := len(data)
+	if ost.stopped {
+		return size, nil
+	}
+	overflow := false
+	if ost.written+size > ost.limit {
+		data = data[:ost.limit-ost.written]
+		overflow = true
+	}
+	ost.written += len(data)
+	ost.pending = append(ost.pending, data...)
+	for ost.stopped == false {
+		idx := bytes.IndexByte(ost.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(ost.pending[:idx])
+		ost.pending = ost.pending[idx+1:]
+		ost.addLine(line)
+	}
+	if overflow && ost.stopped == false {
+		ost.pending = nil
+		ost.lines = append(ost.lines, truncationMarker("output", ost.limit))
+		ost.flush()
+		ost.stopped = true
+	} else if len(ost.lines) >= ost.batchSize {
+		ost.flush()
+	} else if len(ost.lines) > 0 && ost.timer == nil {
+		ost.timer = time.AfterFunc(ost.interval, ost.timedFlush)
+	}
+	return size, nil
+}
+
+// Finish publishes any remaining output and returns the number of
+// partial responses sent.
+func (ost *outputStreamer) Finish() int {
+	ost.lock.Lock()
+	defer ost.lock.Unlock()
+	if ost.stopped == false && len(ost.pending) > 0 {
+		ost.addLine(string(ost.pending))
+		ost.pending = nil
+	}
+	ost.flush()
+	ost.stopped = true
+	return ost.sequence
+}
+
+func (ost *outputStreamer) addLine(line string) {
+	if line == "JSON" {
+		ost.stopped = true
+		ost.lines = nil
+		ost.pending = nil
+		return
+	}
+	if ost.isDirective(line) {
+		return
+	}
+	ost.lines = append(ost.lines, line)
+}
+
+func (ost *outputStreamer) timedFlush() {
+	ost.lock.Lock()
+	defer ost.lock.Unlock()
+	ost.timer = nil
+	ost.flush()
+}
+
+func (ost *outputStreamer) flush() {
+	if ost.timer != nil {
+		ost.timer.Stop()
+		ost.timer = nil
+	}
+	if len(ost.lines) == 0 {
+		return
+	}
+	ost.sequence++
+	chunk := &messages.ExecutionResponse{
+		Status:   "ok",
+		Partial:  true,
+		Sequence: ost.sequence,
+		Body: []map[string][]string{
+			map[string][]string{
+				"body": ost.lines,
+			},
+		},
+	}
+	ost.lines = nil
+	if err := ost.invoke.Reply(chunk); err != nil {
+		log.Errorf("(P: %s C: %s) Publishing partial output %d failed: %s.", ost.invoke.Request.PipelineID(),
+			ost.invoke.Request.Command, ost.sequence, err)
+	}
+}
@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/operable/go-relay/relay/config"
+	"github.com/operable/go-relay/relay/messages"
+	"testing"
+	"time"
+)
+
+type capturePublisher struct {
+	messages []*messages.ExecutionResponse
+}
+
+func (cp *capturePublisher) Publish(topic string, payload []byte) error {
+	resp := &messages.ExecutionResponse{}
+	if err := json.Unmarshal(payload, resp); err != nil {
+		return err
+	}
+	cp.messages = append(cp.messages, resp)
+	return nil
+}
+
+func newStreamingInvocation(t *testing.T, publisher *capturePublisher) *CommandInvocation {
+	invoke := newTestInvocation(t, "/bot/pipelines/p1/reply", "i1")
+	invoke.Publisher = publisher
+	invoke.RelayConfig = &config.Config{
+		Execution: &config.ExecutionInfo{
+			StreamInterval: "1h",
+			StreamBatch:    2,
+			MaxStdout:      1024,
+		},
+	}
+	return invoke
+}
+
+func TestStreamBatchesLines(t *testing.T) {
+	publisher := &capturePublisher{}
+	invoke := newStreamingInvocation(t, publisher)
+	streamer := newOutputStreamer(invoke, NewOutputParserV1().(*OutputParserV1).IsDirective)
+	streamer.Write([]byte("one\nCOGCMD_INFO: hidden\ntw"))
+	streamer.Write([]byte("o\nthree"))
+	if len(publisher.messages) != 1 {
+		t.Fatalf("Expected 1 partial response: %d", len(publisher.messages))
+	}
+	if sent := streamer.Finish(); sent != 2 {
+		t.Errorf("Expected 2 partial responses: %d", sent)
+	}
+	first := publisher.messages[0]
+	if first.Partial == false || first.Sequence != 1 {
+		t.Errorf("Unexpected partial response: %+v", first)
+	}
+	text, _ := json.Marshal(first.Body)
+	if string(text) != "[{\"body\":[\"one\",\"two\"]}]" {
+		t.Errorf("Unexpected partial response body: %s", text)
+	}
+	text, _ = json.Marshal(publisher.messages[1].Body)
+	if string(text) != "[{\"body\":[\"three\"]}]" {
+		t.Errorf("Unexpected partial response body: %s", text)
+	}
+}
+
+func TestStreamFlushesOnInterval(t *testing.T) {
+	publisher := &capturePublisher{}
+	invoke := newStreamingInvocation(t, publisher)
+	invoke.RelayConfig.Execution.StreamInterval = "10ms"
+	streamer := newOutputStreamer(invoke, NewOutputParserV1().(*OutputParserV1).IsDirective)
+	streamer.Write([]byte("one\n"))
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	if sent := streamer.Finish(); sent != 1 {
+		t.Errorf("Expected 1 partial response: %d", sent)
+	}
+}
+
+func TestStreamStopsOnJSON(t *testing.T) {
+	publisher := &capturePublisher{}
+	invoke := newStreamingInvocation(t, publisher)
+	streamer := newOutputStreamer(invoke, NewOutputParserV1().(*OutputParserV1).IsDirective)
+	streamer.Write([]byte("JSON\n{\"foo\": 1}\n{\"bar\": 2}\n"))
+	if sent := streamer.Finish(); sent != 0 {
+		t.Errorf("Expected JSON output not to be streamed: %d", sent)
+	}
+}
+
+func TestStreamStopsAtLimit(t *testing.T) {
+	publisher := &capturePublisher{}
+	invoke := newStreamingInvocation(t, publisher)
+	invoke.RelayConfig.Execution.MaxStdout = 8
+	streamer := newOutputStreamer(invoke, NewOutputParserV1().(*OutputParserV1).IsDirective)
+	streamer.Write([]byte("one\ntwo\nthree\n"))
+	streamer.Write([]byte("four\n"))
+	if sent := streamer.Finish(); sent != 1 {
+		t.Fatalf("Expected 1 partial response: %d", sent)
+	}
+	text, _ := json.Marshal(publisher.messages[0].Body)
+	if string(text) != "[{\"body\":[\"one\",\"two\",\"[output truncated at 8 bytes]\"]}]" {
+		t.Errorf("Unexpected partial response body: %s", text)
+	}
+}